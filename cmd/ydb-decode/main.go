@@ -0,0 +1,73 @@
+// Command ydb-decode decompresses the values written by the plugin to the compressed Bytes columns.
+//
+// It reads the value from the files given as arguments, or from the standard input,
+// and writes the decompressed value to the standard output:
+//
+//	ydb-decode value.bin
+//	ydb-decode -codec zstd < value.bin
+//	ydb-decode -base64 <<< '+1lDASi1L/0...'
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ydb-platform/fluent-bit-ydb/pkg/codec"
+)
+
+func main() {
+	name := flag.String("codec", "",
+		"codec of the values without the magic prefix: zstd, gzip, lz4 or snappy; detected by the prefix if not set")
+	b64 := flag.Bool("base64", false, "input values are base64 encoded")
+	flag.Parse()
+
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	for _, input := range inputs {
+		if err := decode(input, codec.Name(*name), *b64, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "ydb-decode: %s: %v\n", input, err)
+			os.Exit(1)
+		}
+	}
+}
+
+func decode(input string, name codec.Name, b64 bool, out io.Writer) error {
+	var (
+		data []byte
+		err  error
+	)
+	if input == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(input)
+	}
+	if err != nil {
+		return err
+	}
+
+	if b64 {
+		data, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil {
+			return fmt.Errorf("failed to decode base64: %w", err)
+		}
+	}
+
+	if name == "" {
+		data, err = codec.Decode(data)
+	} else {
+		data, err = codec.DecodeWith(name, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(data)
+
+	return err
+}
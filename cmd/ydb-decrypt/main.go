@@ -0,0 +1,101 @@
+// Command ydb-decrypt decrypts the values written by the plugin to the encrypted Bytes columns.
+//
+// It reads the value from the files given as arguments, or from the standard input,
+// and writes the decrypted value to the standard output. The key file is the one configured
+// in EncryptionKeyFile, or a copy having the keys of the values to decrypt:
+//
+//	ydb-decrypt -keys keys.json value.bin
+//	ydb-decrypt -keys keys.json -base64 -decompress <<< '+1lFAQ...'
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ydb-platform/fluent-bit-ydb/pkg/codec"
+	"github.com/ydb-platform/fluent-bit-ydb/pkg/fieldcrypt"
+)
+
+func main() {
+	keys := flag.String("keys", "", "path to the key file, required")
+	b64 := flag.Bool("base64", false, "input values are base64 encoded")
+	decompress := flag.Bool("decompress", false, "decompress the decrypted values having the codec prefix")
+	keyID := flag.Bool("key-id", false, "print the ID of the key the value is encrypted with instead of decrypting it")
+	flag.Parse()
+
+	if *keys == "" && !*keyID {
+		fmt.Fprintln(os.Stderr, "ydb-decrypt: -keys is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var keyring *fieldcrypt.Keyring
+	if !*keyID {
+		var err error
+		if keyring, err = fieldcrypt.LoadKeyring(*keys); err != nil {
+			fmt.Fprintf(os.Stderr, "ydb-decrypt: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	for _, input := range inputs {
+		if err := decrypt(input, keyring, *b64, *decompress, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "ydb-decrypt: %s: %v\n", input, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// decrypt writes the decrypted value, or the key ID if keyring is nil.
+func decrypt(input string, keyring *fieldcrypt.Keyring, b64, decompress bool, out io.Writer) error {
+	var (
+		data []byte
+		err  error
+	)
+	if input == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(input)
+	}
+	if err != nil {
+		return err
+	}
+
+	if b64 {
+		data, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil {
+			return fmt.Errorf("failed to decode base64: %w", err)
+		}
+	}
+
+	if keyring == nil {
+		id, err := fieldcrypt.KeyID(data)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, id)
+
+		return err
+	}
+
+	if data, err = keyring.Decrypt(data); err != nil {
+		return err
+	}
+	if decompress {
+		if data, err = codec.Decode(data); err != nil {
+			return err
+		}
+	}
+
+	_, err = out.Write(data)
+
+	return err
+}
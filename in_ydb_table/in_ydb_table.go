@@ -0,0 +1,81 @@
+// Command in_ydb_table is the Fluent Bit input plugin tailing a YDB table by a cursor column.
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C" //nolint:gocritic
+
+import (
+	"unsafe" //nolint:gocritic
+
+	"github.com/fluent/fluent-bit-go/input"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/source"
+)
+
+var (
+	cfg    config.TableInputConfig
+	plugin = source.Plugin{
+		Name:        "ydb_table",
+		Description: "YDB table reader",
+		Records:     "rows",
+		Position:    "store cursor",
+		Configure: func(p unsafe.Pointer) (_ *config.InputSettings, err error) {
+			cfg, err = config.ReadTableInputConfigFromPlugin(p)
+
+			return &cfg.InputSettings, err
+		},
+		NewReader: func() (source.Reader, error) {
+			return source.NewTableReader(&cfg)
+		},
+	}
+)
+
+//export FLBPluginRegister
+func FLBPluginRegister(def unsafe.Pointer) int {
+	return plugin.Register(def)
+}
+
+//export FLBPluginInit
+func FLBPluginInit(p unsafe.Pointer) int {
+	return plugin.Init(p)
+}
+
+//export FLBPluginInputCallback
+func FLBPluginInputCallback(data *unsafe.Pointer, size *C.size_t) int {
+	records, code := plugin.Collect()
+	if len(records) == 0 {
+		*data, *size = nil, 0
+
+		return code
+	}
+
+	*data = C.CBytes(records)
+	*size = C.size_t(len(records))
+
+	return code
+}
+
+//export FLBPluginInputCleanupCallback
+func FLBPluginInputCleanupCallback(data unsafe.Pointer) int {
+	if data != nil {
+		C.free(data)
+	}
+
+	return plugin.Cleanup()
+}
+
+//export FLBPluginExit
+func FLBPluginExit() int {
+	return plugin.Exit()
+}
+
+//export FLBPluginUnregister
+func FLBPluginUnregister(def unsafe.Pointer) {
+	input.FLBPluginUnregister(def)
+}
+
+func main() {
+}
@@ -7,7 +7,9 @@ import (
 	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
@@ -15,6 +17,8 @@ import (
 	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
 	"github.com/ydb-platform/ydb-go-sdk/v3/credentials"
 	yc "github.com/ydb-platform/ydb-go-yc"
+
+	"github.com/ydb-platform/fluent-bit-ydb/pkg/codec"
 )
 
 const (
@@ -30,13 +34,208 @@ const (
 	ParamCredentialsToken               = "CredentialsToken"
 	ParamCredentialsAnonymous           = "CredentialsAnonymous"
 	ParamLogLevel                       = "LogLevel"
+	ParamWriteTimeout                   = "WriteTimeout"
+	ParamRetryMaxAttempts               = "RetryMaxAttempts"
+	ParamRetryBackoff                   = "RetryBackoff"
+	ParamRetryMaxBackoff                = "RetryMaxBackoff"
+	ParamFallbackPath                   = "FallbackPath"
+	ParamMaxConcurrentUpserts           = "MaxConcurrentUpserts"
+	ParamMaxConcurrentUpsertsPerFlush   = "MaxConcurrentUpsertsPerFlush"
+	ParamUpsertQueueTimeout             = "UpsertQueueTimeout"
+	ParamPortionMaxBytes                = "PortionMaxBytes"
+	ParamPortionMaxRows                 = "PortionMaxRows"
+	ParamBatchMaxRows                   = "BatchMaxRows"
+	ParamBatchMaxBytes                  = "BatchMaxBytes"
+	ParamBatchMaxAge                    = "BatchMaxAge"
+	ParamBatchAck                       = "BatchAck"
+	ParamBatchSpoolPath                 = "BatchSpoolPath"
+	ParamRateLimitRows                  = "RateLimitRows"
+	ParamRateLimitBytes                 = "RateLimitBytes"
+	ParamMetricsListen                  = "MetricsListen"
+	ParamRateLimiterCoordinationNode    = "RateLimiterCoordinationNode"
+	ParamRateLimiterResource            = "RateLimiterResource"
+	ParamRateLimiterUnit                = "RateLimiterUnit"
+	ParamRateLimiterAction              = "RateLimiterAction"
+	ParamRateLimiterTimeout             = "RateLimiterTimeout"
+	ParamBreakerFailureThreshold        = "BreakerFailureThreshold"
+	ParamBreakerOpenTimeout             = "BreakerOpenTimeout"
+	ParamInitTimeout                    = "InitTimeout"
+	ParamLazyInit                       = "LazyInit"
+	ParamExitTimeout                    = "ExitTimeout"
+	ParamFailoverAfter                  = "FailoverAfter"
+	ParamFailbackInterval               = "FailbackInterval"
+	ParamMirrorConnectionURL            = "MirrorConnectionURL"
+	ParamMirrorTablePath                = "MirrorTablePath"
+	ParamMirrorPolicy                   = "MirrorPolicy"
+	ParamAgentID                        = "AgentID"
+	ParamSequenceStatePath              = "SequenceStatePath"
+	ParamHeartbeatTable                 = "HeartbeatTable"
+	ParamHeartbeatInterval              = "HeartbeatInterval"
+	ParamCanaryWrite                    = "CanaryWrite"
+	ParamCanaryTable                    = "CanaryTable"
+	ParamCanaryDelete                   = "CanaryDelete"
+	ParamMaxValueBytes                  = "MaxValueBytes"
+	ParamOversizedPolicy                = "OversizedPolicy"
+	ParamColumnCodecs                   = "ColumnCodecs"
+	ParamCodecPrefix                    = "CodecPrefix"
+	ParamEncryptColumns                 = "EncryptColumns"
+	ParamEncryptionKeyFile              = "EncryptionKeyFile"
+	ParamRedactionRules                 = "RedactionRules"
+	ParamPseudonymizeColumns            = "PseudonymizeColumns"
+	ParamPseudonymizationKeyFile        = "PseudonymizationKeyFile"
+	ParamSink                           = "Sink"
+	ParamTopicPath                      = "TopicPath"
+	ParamTopicFormat                    = "TopicFormat"
+	ParamTopicMessageKey                = "TopicMessageKey"
+	ParamTopicCodec                     = "TopicCodec"
+	ParamTopicProducerID                = "TopicProducerID"
+	ParamWriteMode                      = "WriteMode"
+	ParamWriteQuery                     = "WriteQuery"
+	ParamWriteQueryTxMode               = "WriteQueryTxMode"
+	ParamBulkUpsertFormat               = "BulkUpsertFormat"
+	ParamSortRows                       = "SortRows"
+
+	// ParamMirrorPrefix prefixes the certificates and credentials parameters of the mirror database.
+	ParamMirrorPrefix = "Mirror"
+	// ParamFailoverPrefix prefixes the connection parameters of the secondary databases,
+	// numbered from 1: Failover1ConnectionURL, Failover1CredentialsToken and so on.
+	ParamFailoverPrefix  = "Failover"
+	MaxFailoverEndpoints = 9
 
 	KeyTimestamp = ".timestamp"
 	KeyInput     = ".input"
 	KeyOthers    = ".others"
 	KeyHash      = ".hash"
+	KeyAgentID   = ".agent_id"
+	KeySeq       = ".seq"
+
+	KeyChunkIndex = ".chunk_index"
+	KeyChunkCount = ".chunk_count"
+
+	// KeyPseudonymKey is the ID of the key the pseudonyms of the row are computed with.
+	KeyPseudonymKey = ".pseudonym_key"
+)
+
+const (
+	// BatchAckWrite acknowledges the flush after the batch containing it is written. Fluent Bit does not start
+	// the next flush of a worker until the current one is acknowledged, so the batch merges the flushes
+	// of the different workers only.
+	BatchAckWrite = "write"
+	// BatchAckBuffer acknowledges the flush after it is stored in the batch spool.
+	BatchAckBuffer = "buffer"
+)
+
+const (
+	RateLimiterUnitRows  = "rows"
+	RateLimiterUnitBytes = "bytes"
+
+	// RateLimiterActionWait keeps waiting for the units until UpsertQueueTimeout, or WriteTimeout if it is not set.
+	RateLimiterActionWait = "wait"
+	// RateLimiterActionRetry fails the write with a retryable error.
+	RateLimiterActionRetry = "retry"
+	// RateLimiterActionSpool passes the records to the fallback.
+	RateLimiterActionSpool = "spool"
+)
+
+const (
+	// OversizedTruncate cuts the value to the limit and appends the marker.
+	OversizedTruncate = "truncate"
+	// OversizedReject passes the record to the fallback, or drops it if the fallback is not configured.
+	OversizedReject = "reject"
+	// OversizedSplit splits the record into several rows, each having a part of the value.
+	OversizedSplit = "split"
+
+	// OversizedDefaultField sets the policy of the fields which are not listed.
+	OversizedDefaultField = "*"
+)
+
+const (
+	// MirrorPolicyPrimary acknowledges the flush written to the primary database, the mirror failures are reported only.
+	MirrorPolicyPrimary = "primary"
+	// MirrorPolicyBoth acknowledges the flush written to both the primary and the mirror databases.
+	MirrorPolicyBoth = "both"
 )
 
+const (
+	// SinkTable writes the records as the rows of the table.
+	SinkTable = "table"
+	// SinkTopic writes the records as the messages of the topic.
+	SinkTopic = "topic"
+
+	// TopicFormatJSON writes the record as a JSON object.
+	TopicFormatJSON = "json"
+	// TopicFormatMsgpack writes the record as a msgpack map.
+	TopicFormatMsgpack = "msgpack"
+	// TopicFormatRow writes the JSON object of the columns, as the record would be written to the table.
+	TopicFormatRow = "row"
+
+	TopicCodecRaw  = "raw"
+	TopicCodecGzip = "gzip"
+	TopicCodecZstd = "zstd"
+)
+
+const (
+	// WriteModeBulkUpsert writes the rows by BulkUpsert.
+	WriteModeBulkUpsert = "bulk_upsert"
+	// WriteModeQuery runs the YQL statement of WriteQuery with the rows as the $rows parameter.
+	WriteModeQuery = "query"
+
+	// WriteQueryTxSerializable runs the statement in the serializable read-write transaction.
+	WriteQueryTxSerializable = "serializable"
+	// WriteQueryTxNone runs the statement without the explicit transaction.
+	WriteQueryTxNone = "none"
+
+	// BulkUpsertFormatRows passes the rows to BulkUpsert as the list of the structs.
+	BulkUpsertFormatRows = "rows"
+	// BulkUpsertFormatArrow passes each portion as the Apache Arrow record batch, falling back to CSV
+	// for a while if the database does not accept the format.
+	BulkUpsertFormatArrow = "arrow"
+	// BulkUpsertFormatCSV passes each portion as the CSV text with the header.
+	BulkUpsertFormatCSV = "csv"
+
+	// SortRowsAuto orders the rows by the shard key ranges and the primary key for the tables having several key ranges.
+	SortRowsAuto = "auto"
+	// SortRowsOn orders the rows of all the tables, by the primary key columns.
+	SortRowsOn = "on"
+	// SortRowsOff keeps the order of the records.
+	SortRowsOff = "off"
+)
+
+const (
+	// RedactReplace replaces the match with the replacement text.
+	RedactReplace = "replace"
+	// RedactMask replaces the letters and digits of the match with '*', except the last ones.
+	RedactMask = "mask"
+	// RedactDrop removes the match from the value.
+	RedactDrop = "drop"
+
+	DefaultRedactReplacement = "[REDACTED]"
+	DefaultRedactKeep        = 4
+)
+
+const (
+	DefaultInitTimeout      = 5 * time.Second
+	DefaultExitTimeout      = 10 * time.Second
+	DefaultWriteTimeout     = 30 * time.Second
+	DefaultRetryMaxAttempts = 3
+	DefaultRetryBackoff     = 500 * time.Millisecond
+	DefaultRetryMaxBackoff  = 10 * time.Second
+	DefaultPortionMaxBytes  = 30 * 1024 * 1024
+	DefaultBatchMaxAge      = 5 * time.Second
+
+	DefaultRateLimiterTimeout = time.Second
+	DefaultBreakerOpenTimeout = 30 * time.Second
+
+	DefaultFailoverAfter    = 30 * time.Second
+	DefaultFailbackInterval = time.Minute
+
+	DefaultHeartbeatInterval = time.Minute
+)
+
+// configKey reads the parameter of the plugin instance. The input plugin replaces it,
+// as each plugin is built into a separate shared library.
+var configKey = output.FLBPluginConfigKey
+
 type credentialsDescription struct {
 	make  func(value string) (ydb.Option, error)
 	about func() string
@@ -169,21 +368,130 @@ func parseParamCredentialsStaticValue(value string) (user, password, endpoint st
 	return
 }
 
+// Endpoint is a database to write to, with its connection settings.
+type Endpoint struct {
+	ConnectionURL     string
+	Certificates      string
+	CredentialsOption ydb.Option
+}
+
 type Config struct {
 	ConnectionURL     string
 	Certificates      string
 	CredentialsOption ydb.Option
+	Sink              string
 	TablePath         string
 	Columns           map[string]string
 	LogLevel          zerolog.Level
+	WriteTimeout      time.Duration
+	RetryMaxAttempts  int
+	RetryBackoff      time.Duration
+	RetryMaxBackoff   time.Duration
+	FallbackPath      string
+
+	MaxConcurrentUpserts         int
+	MaxConcurrentUpsertsPerFlush int
+	UpsertQueueTimeout           time.Duration
+
+	PortionMaxBytes int
+	PortionMaxRows  int
+
+	BatchMaxRows   int
+	BatchMaxBytes  int
+	BatchMaxAge    time.Duration
+	BatchAck       string
+	BatchSpoolPath string
+
+	RateLimitRows  int
+	RateLimitBytes int
+	MetricsListen  string
+
+	RateLimiterCoordinationNode string
+	RateLimiterResource         string
+	RateLimiterUnit             string
+	RateLimiterAction           string
+	RateLimiterTimeout          time.Duration
+
+	BreakerFailureThreshold int
+	BreakerOpenTimeout      time.Duration
+
+	InitTimeout time.Duration
+	LazyInit    bool
+	ExitTimeout time.Duration
+
+	Failover         []Endpoint
+	FailoverAfter    time.Duration
+	FailbackInterval time.Duration
+
+	Mirror          *Endpoint
+	MirrorTablePath string
+	MirrorPolicy    string
+
+	AgentID           string
+	SequenceStatePath string
+	HeartbeatTable    string
+	HeartbeatInterval time.Duration
+
+	CanaryWrite  bool
+	CanaryTable  string
+	CanaryDelete bool
+
+	MaxValueBytes   int
+	OversizedPolicy map[string]string // {fieldName : policy}
+
+	ColumnCodecs map[string]codec.Spec // {columnName : codec}
+	CodecPrefix  bool
+
+	EncryptColumns    []string
+	EncryptionKeyFile string
+
+	RedactionRules []RedactionRule
+
+	TopicPath       string
+	TopicFormat     string
+	TopicMessageKey string
+	TopicCodec      string // chosen by the SDK if empty
+	TopicProducerID string
+
+	WriteMode        string
+	WriteQuery       string
+	WriteQueryTxMode string
+	BulkUpsertFormat string
+	SortRows         string
+
+	PseudonymizeColumns     []string
+	PseudonymizationKeyFile string
+}
+
+// RedactionRule masks the matches of a built-in detector or a regular expression in the string values.
+type RedactionRule struct {
+	Name        string   `json:"name"`
+	Detector    string   `json:"detector"` // email, card, ipv4, ipv6 or bearer
+	Pattern     string   `json:"pattern"`
+	Fields      []string `json:"fields"` // top level fields or dot separated paths, all the values if empty
+	Action      string   `json:"action"`
+	Replacement string   `json:"replacement"`
+	Keep        *int     `json:"keep"` // letters and digits left unmasked at the end by the mask action
 }
 
-func ydbCredentials(plugin unsafe.Pointer) (c ydb.Option, err error) {
+// Endpoints returns the primary database followed by the secondary ones, in the order of preference.
+func (cfg *Config) Endpoints() []Endpoint {
+	return append([]Endpoint{{
+		ConnectionURL:     cfg.ConnectionURL,
+		Certificates:      cfg.Certificates,
+		CredentialsOption: cfg.CredentialsOption,
+	}}, cfg.Failover...)
+}
+
+var errNoCredentials = errors.New("no credentials")
+
+// ydbCredentials reads the credentials parameters having the prefix.
+func ydbCredentials(plugin unsafe.Pointer, prefix string) (c ydb.Option, err error) {
 	creds := make(map[string]ydb.Option, len(credentialsChooser))
 	for paramName, description := range credentialsChooser {
-		value := output.FLBPluginConfigKey(plugin, paramName)
+		value := configKey(plugin, prefix+paramName)
 		if value != "" {
-			creds[paramName], err = description.make(value)
+			creds[prefix+paramName], err = description.make(value)
 			if err != nil {
 				return nil, fmt.Errorf("failed to create credentials: %w. %s", err, description.about())
 			}
@@ -191,10 +499,10 @@ func ydbCredentials(plugin unsafe.Pointer) (c ydb.Option, err error) {
 	}
 	switch len(creds) {
 	case 0:
-		return nil, fmt.Errorf("require one of credentials params: %v",
+		return nil, fmt.Errorf("%w, require one of credentials params: %v", errNoCredentials,
 			func() (params []string) {
 				for paramName := range credentialsChooser {
-					params = append(params, paramName)
+					params = append(params, prefix+paramName)
 				}
 				sort.Strings(params)
 
@@ -224,7 +532,25 @@ func ydbCredentials(plugin unsafe.Pointer) (c ydb.Option, err error) {
 }
 
 func ydbColumns(plugin unsafe.Pointer) (columns map[string]string, _ error) {
-	columnsValue := output.FLBPluginConfigKey(plugin, ParamColumns)
+	columns, err := readColumns(plugin)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, has := columns[KeyTimestamp]; !has {
+		return nil, fmt.Errorf("no required column '%s'", KeyTimestamp)
+	}
+
+	if _, has := columns[KeyInput]; !has {
+		return nil, fmt.Errorf("no required column '%s'", KeyInput)
+	}
+
+	return columns, nil
+}
+
+// readColumns reads the JSON mapping of the fields to the columns, given inline or as a file.
+func readColumns(plugin unsafe.Pointer) (columns map[string]string, _ error) {
+	columnsValue := configKey(plugin, ParamColumns)
 
 	if isFile(columnsValue) {
 		b, err := os.ReadFile(columnsValue)
@@ -239,58 +565,831 @@ func ydbColumns(plugin unsafe.Pointer) (columns map[string]string, _ error) {
 		return nil, fmt.Errorf("failed to decode columns JSON: %w", err)
 	}
 
-	if _, has := columns[KeyTimestamp]; !has {
-		return nil, fmt.Errorf("no required column '%s'", KeyTimestamp)
+	return columns, nil
+}
+
+func parseInt(name, value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
 	}
 
-	if _, has := columns[KeyInput]; !has {
-		return nil, fmt.Errorf("no required column '%s'", KeyInput)
+	v, err := strconv.Atoi(value)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("value of parameter '%s' must be a non-negative integer, got '%s'", name, value)
+	}
+
+	return v, nil
+}
+
+func parseDuration(name, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	v, err := time.ParseDuration(value)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("value of parameter '%s' must be a non-negative duration like '1s' or '500ms', got '%s'",
+			name, value)
+	}
+
+	return v, nil
+}
+
+// parsePositiveDuration parses the duration which cannot be zero, such as a timeout.
+func parsePositiveDuration(name, value string, defaultValue time.Duration) (time.Duration, error) {
+	v, err := parseDuration(name, value, defaultValue)
+	if err == nil && v == 0 {
+		return 0, fmt.Errorf("value of parameter '%s' must be a positive duration like '1s' or '500ms', got '%s'",
+			name, value)
+	}
+
+	return v, err
+}
+
+func parseBool(name, value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+
+	v, err := strconv.ParseBool(strings.ToLower(value))
+	if err != nil {
+		switch strings.ToLower(value) {
+		case "on", "yes":
+			return true, nil
+		case "off", "no":
+			return false, nil
+		}
+
+		return false, fmt.Errorf("value of parameter '%s' must be a boolean like 'true' or 'false', got '%s'",
+			name, value)
+	}
+
+	return v, nil
+}
+
+func boolParam(plugin unsafe.Pointer, name string) (bool, error) {
+	return parseBool(name, configKey(plugin, name))
+}
+
+func intParam(plugin unsafe.Pointer, name string, defaultValue int) (int, error) {
+	return parseInt(name, configKey(plugin, name), defaultValue)
+}
+
+func durationParam(plugin unsafe.Pointer, name string, defaultValue time.Duration) (time.Duration, error) {
+	return parseDuration(name, configKey(plugin, name), defaultValue)
+}
+
+func positiveDurationParam(plugin unsafe.Pointer, name string, defaultValue time.Duration) (time.Duration, error) {
+	return parsePositiveDuration(name, configKey(plugin, name), defaultValue)
+}
+
+func readBatchConfig(plugin unsafe.Pointer, cfg *Config) (err error) {
+	if cfg.BatchMaxRows, err = intParam(plugin, ParamBatchMaxRows, 0); err != nil {
+		return err
+	}
+	if cfg.BatchMaxBytes, err = intParam(plugin, ParamBatchMaxBytes, 0); err != nil {
+		return err
+	}
+	if cfg.BatchMaxAge, err = durationParam(plugin, ParamBatchMaxAge, 0); err != nil {
+		return err
+	}
+	if cfg.BatchMaxRows == 0 && cfg.BatchMaxBytes == 0 && cfg.BatchMaxAge == 0 {
+		return nil
+	}
+	if cfg.BatchMaxAge == 0 {
+		cfg.BatchMaxAge = DefaultBatchMaxAge
+	}
+
+	cfg.BatchAck = strings.ToLower(configKey(plugin, ParamBatchAck))
+	switch cfg.BatchAck {
+	case "":
+		cfg.BatchAck = BatchAckWrite
+	case BatchAckWrite:
+	case BatchAckBuffer:
+		cfg.BatchSpoolPath = configKey(plugin, ParamBatchSpoolPath)
+		if cfg.BatchSpoolPath == "" {
+			return fmt.Errorf("parameter '%s' is required for '%s %s'", ParamBatchSpoolPath, ParamBatchAck, BatchAckBuffer)
+		}
+	default:
+		return fmt.Errorf("value of parameter '%s' must be one of '%s' or '%s', got '%s'",
+			ParamBatchAck, BatchAckWrite, BatchAckBuffer, cfg.BatchAck)
+	}
+
+	return nil
+}
+
+// readEndpoint reads the certificates and credentials parameters having the prefix.
+// The ones of the primary database are used unless they are given.
+func readEndpoint(plugin unsafe.Pointer, prefix, connectionURL string, cfg *Config) (Endpoint, error) {
+	endpoint := Endpoint{
+		ConnectionURL:     connectionURL,
+		Certificates:      configKey(plugin, prefix+ParamCertificatesString),
+		CredentialsOption: cfg.CredentialsOption,
+	}
+	if endpoint.Certificates == "" {
+		endpoint.Certificates = cfg.Certificates
+	}
+
+	creds, err := ydbCredentials(plugin, prefix)
+	switch {
+	case err == nil:
+		endpoint.CredentialsOption = creds
+	case !errors.Is(err, errNoCredentials):
+		return endpoint, fmt.Errorf("invalid credentials of '%s': %w", prefix+ParamConnectionURL, err)
+	}
+
+	return endpoint, nil
+}
+
+// readFailoverConfig reads the numbered secondary databases until the first missing connection URL.
+// The secondary database uses the credentials and certificates of the primary one unless they are given.
+func readFailoverConfig(plugin unsafe.Pointer, cfg *Config) (err error) {
+	for n := 1; n <= MaxFailoverEndpoints; n++ {
+		prefix := ParamFailoverPrefix + strconv.Itoa(n)
+		connectionURL := configKey(plugin, prefix+ParamConnectionURL)
+		if connectionURL == "" {
+			break
+		}
+
+		endpoint, err := readEndpoint(plugin, prefix, connectionURL, cfg)
+		if err != nil {
+			return err
+		}
+		cfg.Failover = append(cfg.Failover, endpoint)
+	}
+	if len(cfg.Failover) == 0 {
+		return nil
+	}
+
+	if cfg.FailoverAfter, err = durationParam(plugin, ParamFailoverAfter, DefaultFailoverAfter); err != nil {
+		return err
+	}
+	cfg.FailbackInterval, err = durationParam(plugin, ParamFailbackInterval, DefaultFailbackInterval)
+
+	return err
+}
+
+func readMirrorConfig(plugin unsafe.Pointer, cfg *Config) error {
+	connectionURL := configKey(plugin, ParamMirrorConnectionURL)
+	if connectionURL == "" {
+		return nil
+	}
+
+	endpoint, err := readEndpoint(plugin, ParamMirrorPrefix, connectionURL, cfg)
+	if err != nil {
+		return err
+	}
+	cfg.Mirror = &endpoint
+
+	cfg.MirrorTablePath = configKey(plugin, ParamMirrorTablePath)
+	if cfg.MirrorTablePath == "" {
+		cfg.MirrorTablePath = cfg.TablePath
+	}
+
+	cfg.MirrorPolicy = strings.ToLower(configKey(plugin, ParamMirrorPolicy))
+	switch cfg.MirrorPolicy {
+	case "":
+		cfg.MirrorPolicy = MirrorPolicyPrimary
+	case MirrorPolicyPrimary, MirrorPolicyBoth:
+	default:
+		return fmt.Errorf("value of parameter '%s' must be one of '%s' or '%s', got '%s'",
+			ParamMirrorPolicy, MirrorPolicyPrimary, MirrorPolicyBoth, cfg.MirrorPolicy)
+	}
+
+	return nil
+}
+
+// readSequenceConfig reads the agent identity, and the state of the sequence numbers
+// required for the '.seq' pseudo-field or the heartbeat.
+func readSequenceConfig(plugin unsafe.Pointer, cfg *Config) (err error) {
+	cfg.AgentID = configKey(plugin, ParamAgentID)
+	if cfg.AgentID == "" {
+		if cfg.AgentID, err = os.Hostname(); err != nil {
+			return fmt.Errorf("failed to get hostname for parameter '%s': %w", ParamAgentID, err)
+		}
+	}
+
+	cfg.SequenceStatePath = configKey(plugin, ParamSequenceStatePath)
+	cfg.HeartbeatTable = configKey(plugin, ParamHeartbeatTable)
+
+	_, seqUsed := cfg.Columns[KeySeq]
+	if (seqUsed || cfg.HeartbeatTable != "") && cfg.SequenceStatePath == "" {
+		return fmt.Errorf("parameter '%s' is required for the '%s' column or '%s'", ParamSequenceStatePath,
+			KeySeq, ParamHeartbeatTable)
+	}
+
+	cfg.HeartbeatInterval, err = durationParam(plugin, ParamHeartbeatInterval, DefaultHeartbeatInterval)
+
+	return err
+}
+
+// parseOversizedPolicy parses the comma separated list of 'field=policy' pairs.
+func parseOversizedPolicy(value string) (map[string]string, error) {
+	policies := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		field, policy, found := strings.Cut(pair, "=")
+		field, policy = strings.TrimSpace(field), strings.ToLower(strings.TrimSpace(policy))
+		if !found || field == "" {
+			return nil, fmt.Errorf("value of parameter '%s' must be a list of 'field=policy' pairs, got '%s'",
+				ParamOversizedPolicy, pair)
+		}
+		switch policy {
+		case OversizedTruncate, OversizedReject, OversizedSplit:
+		default:
+			return nil, fmt.Errorf("policy of field '%s' in parameter '%s' must be one of '%s', '%s' or '%s', got '%s'",
+				field, ParamOversizedPolicy, OversizedTruncate, OversizedReject, OversizedSplit, policy)
+		}
+		policies[field] = policy
+	}
+
+	return policies, nil
+}
+
+func readOversizedConfig(plugin unsafe.Pointer, cfg *Config) (err error) {
+	if cfg.MaxValueBytes, err = intParam(plugin, ParamMaxValueBytes, 0); err != nil {
+		return err
+	}
+	if cfg.MaxValueBytes == 0 {
+		return nil
+	}
+
+	if cfg.OversizedPolicy, err = parseOversizedPolicy(configKey(plugin, ParamOversizedPolicy)); err != nil {
+		return err
+	}
+	for _, policy := range cfg.OversizedPolicy {
+		if _, has := cfg.Columns[KeyChunkIndex]; policy == OversizedSplit && !has {
+			return fmt.Errorf("column '%s' is required for the '%s' policy, so the rows of the parts are not overwritten",
+				KeyChunkIndex, OversizedSplit)
+		}
+	}
+
+	return nil
+}
+
+// parseColumnCodecs parses the comma separated list of 'column=codec[:level]' pairs.
+func parseColumnCodecs(value string) (map[string]codec.Spec, error) {
+	codecs := make(map[string]codec.Spec)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		column, spec, found := strings.Cut(pair, "=")
+		column = strings.TrimSpace(column)
+		if !found || column == "" {
+			return nil, fmt.Errorf("value of parameter '%s' must be a list of 'column=codec' pairs, got '%s'",
+				ParamColumnCodecs, pair)
+		}
+		c, err := codec.ParseSpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("codec of column '%s' in parameter '%s': %w", column, ParamColumnCodecs, err)
+		}
+		if c.Name != codec.None {
+			codecs[column] = c
+		}
+	}
+
+	return codecs, nil
+}
+
+func readCodecConfig(plugin unsafe.Pointer, cfg *Config) (err error) {
+	if cfg.ColumnCodecs, err = parseColumnCodecs(configKey(plugin, ParamColumnCodecs)); err != nil {
+		return err
+	}
+	for column := range cfg.ColumnCodecs {
+		if !cfg.mapped(column) {
+			return fmt.Errorf("column '%s' of parameter '%s' is not mapped in '%s'", column, ParamColumnCodecs,
+				ParamColumns)
+		}
+	}
+	if cfg.CodecPrefix, err = boolParam(plugin, ParamCodecPrefix); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// mapped reports whether any field is mapped to the column.
+func (cfg *Config) mapped(column string) bool {
+	for _, c := range cfg.Columns {
+		if c == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mappedColumns reads the comma separated list of the columns, each of them must be mapped in Columns.
+func mappedColumns(plugin unsafe.Pointer, name string, cfg *Config) (columns []string, _ error) {
+	for _, column := range strings.Split(configKey(plugin, name), ",") {
+		if column = strings.TrimSpace(column); column == "" {
+			continue
+		}
+		if !cfg.mapped(column) {
+			return nil, fmt.Errorf("column '%s' of parameter '%s' is not mapped in '%s'", column, name, ParamColumns)
+		}
+		columns = append(columns, column)
 	}
 
 	return columns, nil
 }
 
+func readEncryptionConfig(plugin unsafe.Pointer, cfg *Config) (err error) {
+	if cfg.EncryptColumns, err = mappedColumns(plugin, ParamEncryptColumns, cfg); err != nil {
+		return err
+	}
+	if len(cfg.EncryptColumns) == 0 {
+		return nil
+	}
+
+	cfg.EncryptionKeyFile = configKey(plugin, ParamEncryptionKeyFile)
+	if cfg.EncryptionKeyFile == "" {
+		return fmt.Errorf("parameter '%s' is required for '%s'", ParamEncryptionKeyFile, ParamEncryptColumns)
+	}
+
+	return nil
+}
+
+func readPseudonymizationConfig(plugin unsafe.Pointer, cfg *Config) (err error) {
+	if cfg.PseudonymizeColumns, err = mappedColumns(plugin, ParamPseudonymizeColumns, cfg); err != nil {
+		return err
+	}
+	_, keyIDUsed := cfg.Columns[KeyPseudonymKey]
+	if len(cfg.PseudonymizeColumns) == 0 && !keyIDUsed {
+		return nil
+	}
+
+	cfg.PseudonymizationKeyFile = configKey(plugin, ParamPseudonymizationKeyFile)
+	if cfg.PseudonymizationKeyFile == "" {
+		return fmt.Errorf("parameter '%s' is required for '%s'", ParamPseudonymizationKeyFile,
+			ParamPseudonymizeColumns)
+	}
+
+	return nil
+}
+
+func readTopicConfig(plugin unsafe.Pointer, cfg *Config) error {
+	if cfg.Sink != SinkTopic {
+		return nil
+	}
+
+	cfg.TopicPath = configKey(plugin, ParamTopicPath)
+	if cfg.TopicPath == "" {
+		return fmt.Errorf("parameter '%s' is required for the '%s' sink", ParamTopicPath, SinkTopic)
+	}
+	if err := checkTopicColumns(cfg); err != nil {
+		return err
+	}
+	if err := checkTopicParams(func(name string) string { return configKey(plugin, name) }); err != nil {
+		return err
+	}
+
+	cfg.TopicFormat = strings.ToLower(configKey(plugin, ParamTopicFormat))
+	switch cfg.TopicFormat {
+	case "":
+		cfg.TopicFormat = TopicFormatJSON
+	case TopicFormatJSON, TopicFormatMsgpack:
+	case TopicFormatRow:
+		if len(cfg.Columns) == 0 {
+			return fmt.Errorf("parameter '%s' is required for the '%s' format", ParamColumns, TopicFormatRow)
+		}
+	default:
+		return fmt.Errorf("value of parameter '%s' must be one of '%s', '%s' or '%s', got '%s'",
+			ParamTopicFormat, TopicFormatJSON, TopicFormatMsgpack, TopicFormatRow, cfg.TopicFormat)
+	}
+
+	cfg.TopicCodec = strings.ToLower(configKey(plugin, ParamTopicCodec))
+	switch cfg.TopicCodec {
+	case "", TopicCodecRaw, TopicCodecGzip, TopicCodecZstd:
+	default:
+		return fmt.Errorf("value of parameter '%s' must be one of '%s', '%s' or '%s', got '%s'",
+			ParamTopicCodec, TopicCodecRaw, TopicCodecGzip, TopicCodecZstd, cfg.TopicCodec)
+	}
+
+	cfg.TopicMessageKey = configKey(plugin, ParamTopicMessageKey)
+	cfg.TopicProducerID = configKey(plugin, ParamTopicProducerID)
+	if cfg.TopicProducerID == "" {
+		cfg.TopicProducerID = cfg.AgentID
+	}
+
+	return nil
+}
+
+// checkTopicColumns rejects the options of the table columns, which the topic sink does not apply,
+// so the values are not written to the topic in clear or untruncated.
+func checkTopicColumns(cfg *Config) error {
+	for _, option := range []struct {
+		param string
+		set   bool
+	}{
+		{ParamMaxValueBytes, cfg.MaxValueBytes > 0},
+		{ParamColumnCodecs, len(cfg.ColumnCodecs) > 0},
+		{ParamEncryptColumns, len(cfg.EncryptColumns) > 0},
+		{ParamPseudonymizeColumns, len(cfg.PseudonymizeColumns) > 0},
+	} {
+		if option.set {
+			return fmt.Errorf("parameter '%s' is not supported by the '%s' sink", option.param, SinkTopic)
+		}
+	}
+	if _, has := cfg.Columns[KeyPseudonymKey]; has {
+		return fmt.Errorf("column '%s' is not supported by the '%s' sink", KeyPseudonymKey, SinkTopic)
+	}
+
+	return nil
+}
+
+// topicTableParams are the parameters of the table sink, which the topic sink does not apply.
+var topicTableParams = []string{
+	ParamWriteMode, ParamWriteQuery, ParamWriteQueryTxMode, ParamBulkUpsertFormat, ParamSortRows,
+	ParamPortionMaxBytes, ParamPortionMaxRows,
+	ParamBatchMaxRows, ParamBatchMaxBytes, ParamBatchMaxAge, ParamBatchAck, ParamBatchSpoolPath,
+	ParamFallbackPath, ParamMaxConcurrentUpserts, ParamMaxConcurrentUpsertsPerFlush, ParamUpsertQueueTimeout,
+	ParamRateLimitRows, ParamRateLimitBytes, ParamRateLimiterCoordinationNode, ParamRateLimiterResource,
+	ParamBreakerFailureThreshold, ParamBreakerOpenTimeout, ParamLazyInit,
+	ParamFailoverPrefix + "1" + ParamConnectionURL, ParamMirrorConnectionURL,
+	ParamHeartbeatTable, ParamCanaryWrite, ParamOversizedPolicy,
+}
+
+// checkTopicParams rejects the parameters of the table sink, so they are not ignored silently
+// with the topic sink.
+func checkTopicParams(value func(name string) string) error {
+	for _, param := range topicTableParams {
+		if value(param) != "" {
+			return fmt.Errorf("parameter '%s' is not supported by the '%s' sink", param, SinkTopic)
+		}
+	}
+
+	return nil
+}
+
+func readWriteModeConfig(plugin unsafe.Pointer, cfg *Config) error {
+	cfg.WriteMode = strings.ToLower(configKey(plugin, ParamWriteMode))
+	switch cfg.WriteMode {
+	case "":
+		cfg.WriteMode = WriteModeBulkUpsert
+	case WriteModeBulkUpsert:
+	case WriteModeQuery:
+		cfg.WriteQuery = configKey(plugin, ParamWriteQuery)
+		if cfg.WriteQuery == "" {
+			return fmt.Errorf("parameter '%s' is required for the '%s' write mode", ParamWriteQuery, WriteModeQuery)
+		}
+		if isFile(cfg.WriteQuery) {
+			b, err := os.ReadFile(cfg.WriteQuery)
+			if err != nil {
+				return fmt.Errorf("failed to read file '%s': %w", cfg.WriteQuery, err)
+			}
+			cfg.WriteQuery = string(b)
+		}
+		if !strings.Contains(cfg.WriteQuery, "$rows") {
+			return fmt.Errorf("query of parameter '%s' must use the $rows parameter", ParamWriteQuery)
+		}
+
+		cfg.WriteQueryTxMode = strings.ToLower(configKey(plugin, ParamWriteQueryTxMode))
+		switch cfg.WriteQueryTxMode {
+		case "":
+			cfg.WriteQueryTxMode = WriteQueryTxSerializable
+		case WriteQueryTxSerializable, WriteQueryTxNone:
+		default:
+			return fmt.Errorf("value of parameter '%s' must be one of '%s' or '%s', got '%s'",
+				ParamWriteQueryTxMode, WriteQueryTxSerializable, WriteQueryTxNone, cfg.WriteQueryTxMode)
+		}
+	default:
+		return fmt.Errorf("value of parameter '%s' must be one of '%s' or '%s', got '%s'",
+			ParamWriteMode, WriteModeBulkUpsert, WriteModeQuery, cfg.WriteMode)
+	}
+
+	cfg.BulkUpsertFormat = strings.ToLower(configKey(plugin, ParamBulkUpsertFormat))
+	switch cfg.BulkUpsertFormat {
+	case "":
+		cfg.BulkUpsertFormat = BulkUpsertFormatRows
+	case BulkUpsertFormatRows:
+	case BulkUpsertFormatArrow, BulkUpsertFormatCSV:
+		if cfg.WriteMode != WriteModeBulkUpsert {
+			return fmt.Errorf("parameter '%s' requires the '%s' write mode", ParamBulkUpsertFormat, WriteModeBulkUpsert)
+		}
+	default:
+		return fmt.Errorf("value of parameter '%s' must be one of '%s', '%s' or '%s', got '%s'",
+			ParamBulkUpsertFormat, BulkUpsertFormatRows, BulkUpsertFormatArrow, BulkUpsertFormatCSV, cfg.BulkUpsertFormat)
+	}
+
+	cfg.SortRows = strings.ToLower(configKey(plugin, ParamSortRows))
+	switch cfg.SortRows {
+	case "":
+		cfg.SortRows = SortRowsAuto
+	case SortRowsAuto, SortRowsOn, SortRowsOff:
+	default:
+		return fmt.Errorf("value of parameter '%s' must be one of '%s', '%s' or '%s', got '%s'",
+			ParamSortRows, SortRowsAuto, SortRowsOn, SortRowsOff, cfg.SortRows)
+	}
+
+	return nil
+}
+
+// parseRedactionRules decodes the JSON list of the redaction rules and fills the defaults.
+func parseRedactionRules(value string) ([]RedactionRule, error) {
+	var rules []RedactionRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("failed to decode redaction rules JSON: %w", err)
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		if (rule.Detector == "") == (rule.Pattern == "") {
+			return nil, fmt.Errorf("redaction rule %d must have either 'detector' or 'pattern'", i+1)
+		}
+		if rule.Name == "" {
+			rule.Name = rule.Detector
+			if rule.Name == "" {
+				rule.Name = fmt.Sprintf("rule%d", i+1)
+			}
+		}
+
+		rule.Action = strings.ToLower(rule.Action)
+		switch rule.Action {
+		case "":
+			rule.Action = RedactReplace
+		case RedactReplace, RedactMask, RedactDrop:
+		default:
+			return nil, fmt.Errorf("action of redaction rule '%s' must be one of '%s', '%s' or '%s', got '%s'",
+				rule.Name, RedactReplace, RedactMask, RedactDrop, rule.Action)
+		}
+		if rule.Action == RedactReplace && rule.Replacement == "" {
+			rule.Replacement = DefaultRedactReplacement
+		}
+		if rule.Keep == nil {
+			keep := DefaultRedactKeep
+			rule.Keep = &keep
+		} else if *rule.Keep < 0 {
+			return nil, fmt.Errorf("'keep' of redaction rule '%s' must be non-negative, got %d", rule.Name, *rule.Keep)
+		}
+	}
+
+	return rules, nil
+}
+
+func readRedactionConfig(plugin unsafe.Pointer, cfg *Config) (err error) {
+	value := configKey(plugin, ParamRedactionRules)
+	if value == "" {
+		return nil
+	}
+
+	if isFile(value) {
+		b, err := os.ReadFile(value)
+		if err != nil {
+			return fmt.Errorf("failed to read file '%s': %w", value, err)
+		}
+		value = string(b)
+	}
+
+	cfg.RedactionRules, err = parseRedactionRules(value)
+
+	return err
+}
+
+func readRateLimiterConfig(plugin unsafe.Pointer, cfg *Config) (err error) {
+	cfg.RateLimiterResource = configKey(plugin, ParamRateLimiterResource)
+	if cfg.RateLimiterResource == "" {
+		return nil
+	}
+
+	cfg.RateLimiterCoordinationNode = configKey(plugin, ParamRateLimiterCoordinationNode)
+	if cfg.RateLimiterCoordinationNode == "" {
+		return fmt.Errorf("parameter '%s' is required for '%s'", ParamRateLimiterCoordinationNode,
+			ParamRateLimiterResource)
+	}
+
+	cfg.RateLimiterUnit = strings.ToLower(configKey(plugin, ParamRateLimiterUnit))
+	switch cfg.RateLimiterUnit {
+	case "":
+		cfg.RateLimiterUnit = RateLimiterUnitRows
+	case RateLimiterUnitRows, RateLimiterUnitBytes:
+	default:
+		return fmt.Errorf("value of parameter '%s' must be one of '%s' or '%s', got '%s'",
+			ParamRateLimiterUnit, RateLimiterUnitRows, RateLimiterUnitBytes, cfg.RateLimiterUnit)
+	}
+
+	cfg.RateLimiterAction = strings.ToLower(configKey(plugin, ParamRateLimiterAction))
+	switch cfg.RateLimiterAction {
+	case "":
+		cfg.RateLimiterAction = RateLimiterActionWait
+	case RateLimiterActionWait, RateLimiterActionRetry:
+	case RateLimiterActionSpool:
+		if cfg.FallbackPath == "" {
+			return fmt.Errorf("parameter '%s' is required for '%s %s'", ParamFallbackPath, ParamRateLimiterAction,
+				RateLimiterActionSpool)
+		}
+	default:
+		return fmt.Errorf("value of parameter '%s' must be one of '%s', '%s' or '%s', got '%s'",
+			ParamRateLimiterAction, RateLimiterActionWait, RateLimiterActionRetry, RateLimiterActionSpool,
+			cfg.RateLimiterAction)
+	}
+
+	// each acquire request waits for the units up to the timeout, so the waiting does not spin on a zero one
+	cfg.RateLimiterTimeout, err = positiveDurationParam(plugin, ParamRateLimiterTimeout, DefaultRateLimiterTimeout)
+
+	return err
+}
+
 func ReadConfigFromPlugin(plugin unsafe.Pointer) (cfg Config, _ error) {
 	// Connection string
-	connectionURL := output.FLBPluginConfigKey(plugin, ParamConnectionURL)
+	connectionURL := configKey(plugin, ParamConnectionURL)
 	if connectionURL == "" {
 		return cfg, fmt.Errorf("not provided parameter '%s'", ParamConnectionURL)
 	}
 	cfg.ConnectionURL = connectionURL
 
 	// Connection string
-	certificates := output.FLBPluginConfigKey(plugin, ParamCertificatesString)
+	certificates := configKey(plugin, ParamCertificatesString)
 	if certificates != "" {
 		cfg.Certificates = certificates
 	}
 
+	// Sink
+	cfg.Sink = strings.ToLower(configKey(plugin, ParamSink))
+	switch cfg.Sink {
+	case "":
+		cfg.Sink = SinkTable
+	case SinkTable, SinkTopic:
+	default:
+		return cfg, fmt.Errorf("value of parameter '%s' must be one of '%s' or '%s', got '%s'",
+			ParamSink, SinkTable, SinkTopic, cfg.Sink)
+	}
+
 	// Table path
-	tablePath := output.FLBPluginConfigKey(plugin, ParamTablePath)
-	if tablePath == "" {
+	tablePath := configKey(plugin, ParamTablePath)
+	if tablePath == "" && cfg.Sink == SinkTable {
 		return cfg, fmt.Errorf("not provided parameter '%s'", ParamTablePath)
 	}
 	cfg.TablePath = tablePath
 
-	// Table columns
-	columns, err := ydbColumns(plugin)
-	if err != nil {
-		return cfg, fmt.Errorf("no columns: %w", err)
+	// Table columns, the topic messages are shaped by them only in the row format
+	columns := make(map[string]string)
+	if cfg.Sink == SinkTable || configKey(plugin, ParamColumns) != "" {
+		var err error
+		if columns, err = ydbColumns(plugin); err != nil {
+			return cfg, fmt.Errorf("no columns: %w", err)
+		}
 	}
 	cfg.Columns = columns
 
 	// credentials
-	creds, err := ydbCredentials(plugin)
+	creds, err := ydbCredentials(plugin, "")
 	if err != nil {
 		return cfg, errors.New("required valid credentials")
 	}
 	cfg.CredentialsOption = creds
 
 	// log level
-	if lvl, err := zerolog.ParseLevel(output.FLBPluginConfigKey(plugin, ParamLogLevel)); err != nil {
+	if lvl, err := zerolog.ParseLevel(configKey(plugin, ParamLogLevel)); err != nil {
 		cfg.LogLevel = zerolog.InfoLevel
 	} else {
 		cfg.LogLevel = lvl
 	}
 
+	// secondary databases
+	if err = readFailoverConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// mirror database
+	if err = readMirrorConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// oversized values
+	if err = readOversizedConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// compression of the Bytes columns
+	if err = readCodecConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// encryption of the Bytes columns
+	if err = readEncryptionConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// pseudonymization of the identifiers
+	if err = readPseudonymizationConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// redaction of the personal data
+	if err = readRedactionConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// agent identity and sequence numbers
+	if err = readSequenceConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// write mode of the table sink
+	if err = readWriteModeConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// topic sink
+	if err = readTopicConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// initialization
+	if cfg.InitTimeout, err = positiveDurationParam(plugin, ParamInitTimeout, DefaultInitTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.LazyInit, err = boolParam(plugin, ParamLazyInit); err != nil {
+		return cfg, err
+	}
+	if cfg.ExitTimeout, err = durationParam(plugin, ParamExitTimeout, DefaultExitTimeout); err != nil {
+		return cfg, err
+	}
+
+	// startup self-test
+	if cfg.CanaryWrite, err = boolParam(plugin, ParamCanaryWrite); err != nil {
+		return cfg, err
+	}
+	cfg.CanaryTable = configKey(plugin, ParamCanaryTable)
+	if cfg.CanaryDelete, err = boolParam(plugin, ParamCanaryDelete); err != nil {
+		return cfg, err
+	}
+
+	// write retries
+	if cfg.WriteTimeout, err = durationParam(plugin, ParamWriteTimeout, DefaultWriteTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.RetryMaxAttempts, err = intParam(plugin, ParamRetryMaxAttempts, DefaultRetryMaxAttempts); err != nil {
+		return cfg, err
+	}
+	if cfg.RetryBackoff, err = durationParam(plugin, ParamRetryBackoff, DefaultRetryBackoff); err != nil {
+		return cfg, err
+	}
+	if cfg.RetryMaxBackoff, err = durationParam(plugin, ParamRetryMaxBackoff, DefaultRetryMaxBackoff); err != nil {
+		return cfg, err
+	}
+
+	// fallback for the portions which could not be written
+	cfg.FallbackPath = configKey(plugin, ParamFallbackPath)
+
+	// write concurrency
+	if cfg.MaxConcurrentUpserts, err = intParam(plugin, ParamMaxConcurrentUpserts, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxConcurrentUpsertsPerFlush, err = intParam(plugin, ParamMaxConcurrentUpsertsPerFlush, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.UpsertQueueTimeout, err = durationParam(plugin, ParamUpsertQueueTimeout, 0); err != nil {
+		return cfg, err
+	}
+
+	// portion limits
+	if cfg.PortionMaxBytes, err = intParam(plugin, ParamPortionMaxBytes, DefaultPortionMaxBytes); err != nil {
+		return cfg, err
+	}
+	if cfg.PortionMaxBytes == 0 {
+		cfg.PortionMaxBytes = DefaultPortionMaxBytes
+	}
+	if cfg.PortionMaxRows, err = intParam(plugin, ParamPortionMaxRows, 0); err != nil {
+		return cfg, err
+	}
+
+	// batching of the consecutive flushes
+	if err = readBatchConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// client-side rate limits
+	if cfg.RateLimitRows, err = intParam(plugin, ParamRateLimitRows, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.RateLimitBytes, err = intParam(plugin, ParamRateLimitBytes, 0); err != nil {
+		return cfg, err
+	}
+
+	// cluster-wide quota
+	if err = readRateLimiterConfig(plugin, &cfg); err != nil {
+		return cfg, err
+	}
+
+	// circuit breaker
+	if cfg.BreakerFailureThreshold, err = intParam(plugin, ParamBreakerFailureThreshold, 0); err != nil {
+		return cfg, err
+	}
+	if cfg.BreakerOpenTimeout, err = durationParam(plugin, ParamBreakerOpenTimeout, DefaultBreakerOpenTimeout); err != nil {
+		return cfg, err
+	}
+
+	// metrics
+	cfg.MetricsListen = configKey(plugin, ParamMetricsListen)
+
 	return cfg, nil
 }
@@ -2,8 +2,11 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/ydb-platform/fluent-bit-ydb/pkg/codec"
 )
 
 func Test_parseParamCredentialsStaticValue(t *testing.T) {
@@ -49,3 +52,165 @@ func Test_parseParamCredentialsStaticValue(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseDuration(t *testing.T) {
+	for _, tt := range []struct {
+		value    string
+		expected time.Duration
+		err      bool
+	}{
+		{value: "", expected: time.Minute},
+		{value: "500ms", expected: 500 * time.Millisecond},
+		{value: "0s", expected: 0},
+		{value: "-1s", err: true},
+		{value: "5", err: true},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			v, err := parseDuration("Param", tt.value, time.Minute)
+			if tt.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.expected, v)
+			}
+		})
+	}
+}
+
+func Test_parsePositiveDuration(t *testing.T) {
+	v, err := parsePositiveDuration("Param", "", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, v)
+
+	v, err = parsePositiveDuration("Param", "500ms", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 500*time.Millisecond, v)
+
+	_, err = parsePositiveDuration("Param", "0s", time.Minute)
+	require.ErrorContains(t, err, "must be a positive duration")
+	_, err = parsePositiveDuration("Param", "-1s", time.Minute)
+	require.Error(t, err)
+}
+
+func Test_parseInt(t *testing.T) {
+	for _, tt := range []struct {
+		value    string
+		expected int
+		err      bool
+	}{
+		{value: "", expected: 3},
+		{value: "10", expected: 10},
+		{value: "-1", err: true},
+		{value: "ten", err: true},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			v, err := parseInt("Param", tt.value, 3)
+			if tt.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.expected, v)
+			}
+		})
+	}
+}
+
+func Test_parseBool(t *testing.T) {
+	for _, tt := range []struct {
+		value    string
+		expected bool
+		err      bool
+	}{
+		{value: "", expected: false},
+		{value: "true", expected: true},
+		{value: "On", expected: true},
+		{value: "off", expected: false},
+		{value: "0", expected: false},
+		{value: "maybe", err: true},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			v, err := parseBool("Param", tt.value)
+			if tt.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.expected, v)
+			}
+		})
+	}
+}
+
+func Test_parseOversizedPolicy(t *testing.T) {
+	policies, err := parseOversizedPolicy("log=split, stack = Truncate,*=reject")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"log": OversizedSplit, "stack": OversizedTruncate, "*": OversizedReject}, policies)
+
+	_, err = parseOversizedPolicy("log")
+	require.Error(t, err)
+
+	_, err = parseOversizedPolicy("log=drop")
+	require.Error(t, err)
+}
+
+func Test_parseColumnCodecs(t *testing.T) {
+	codecs, err := parseColumnCodecs("message=zstd:3, raw = snappy,stack=none")
+	require.NoError(t, err)
+	require.Equal(t, map[string]codec.Spec{
+		"message": {Name: codec.Zstd, Level: 3},
+		"raw":     {Name: codec.Snappy},
+	}, codecs)
+
+	_, err = parseColumnCodecs("message")
+	require.Error(t, err)
+
+	_, err = parseColumnCodecs("message=brotli")
+	require.Error(t, err)
+}
+
+func Test_checkTopicColumns(t *testing.T) {
+	require.NoError(t, checkTopicColumns(&Config{Columns: map[string]string{KeySeq: "seq", KeyHash: "hash"}}))
+
+	for _, cfg := range []*Config{
+		{MaxValueBytes: 1024},
+		{ColumnCodecs: map[string]codec.Spec{"message": {Name: codec.Zstd}}},
+		{EncryptColumns: []string{"message"}},
+		{PseudonymizeColumns: []string{"user_id"}},
+		{Columns: map[string]string{KeyPseudonymKey: "key_id"}},
+	} {
+		require.Error(t, checkTopicColumns(cfg))
+	}
+}
+
+func Test_checkTopicParams(t *testing.T) {
+	params := map[string]string{ParamTopicPath: "logs", ParamTopicFormat: TopicFormatRow, ParamColumns: "{}"}
+	value := func(name string) string { return params[name] }
+	require.NoError(t, checkTopicParams(value))
+
+	for _, param := range []string{ParamWriteMode, ParamBulkUpsertFormat, ParamBatchMaxRows, ParamSortRows,
+		"Failover1ConnectionURL"} {
+		params[param] = "on"
+		require.ErrorContains(t, checkTopicParams(value), "parameter '"+param+"' is not supported", param)
+		delete(params, param)
+	}
+}
+
+func Test_parseRedactionRules(t *testing.T) {
+	rules, err := parseRedactionRules(`[
+		{"detector": "email", "action": "mask", "keep": 0},
+		{"name": "session", "pattern": "sid=\\w+", "fields": ["message"]}
+	]`)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	require.Equal(t, "email", rules[0].Name)
+	require.Equal(t, RedactMask, rules[0].Action)
+	require.Equal(t, 0, *rules[0].Keep)
+	require.Equal(t, RedactReplace, rules[1].Action)
+	require.Equal(t, DefaultRedactReplacement, rules[1].Replacement)
+	require.Equal(t, DefaultRedactKeep, *rules[1].Keep)
+
+	_, err = parseRedactionRules(`[{"detector": "email", "pattern": "@"}]`)
+	require.Error(t, err)
+
+	_, err = parseRedactionRules(`[{"detector": "email", "action": "hash"}]`)
+	require.Error(t, err)
+}
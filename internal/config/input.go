@@ -0,0 +1,173 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/fluent/fluent-bit-go/input"
+	"github.com/rs/zerolog"
+)
+
+const (
+	ParamConsumer             = "Consumer"
+	ParamReadBatchMaxMessages = "ReadBatchMaxMessages"
+	ParamReadBatchMaxRows     = "ReadBatchMaxRows"
+	ParamReadTimeout          = "ReadTimeout"
+	ParamMetadataKey          = "MetadataKey"
+	ParamCursorColumn         = "CursorColumn"
+	ParamCursorStatePath      = "CursorStatePath"
+)
+
+const (
+	DefaultReadBatchMaxMessages = 1000
+	DefaultReadBatchMaxRows     = 1000
+	DefaultReadTimeout          = time.Second
+	DefaultTableReadTimeout     = 10 * time.Second
+	DefaultMetadataKey          = "_ydb"
+)
+
+// InputSettings are the settings shared by the input plugins.
+type InputSettings struct {
+	Endpoint
+
+	LogLevel      zerolog.Level
+	InitTimeout   time.Duration
+	ExitTimeout   time.Duration
+	MetricsListen string
+}
+
+// InputConfig is the configuration of the in_ydb_topic input plugin.
+type InputConfig struct {
+	InputSettings
+
+	Topics               []string // topics or changefeeds, relative to the database
+	Consumer             string
+	Format               string // format of the message payloads: json or msgpack
+	ReadBatchMaxMessages int
+	ReadTimeout          time.Duration // the longest wait for the messages in a collect callback
+	MetadataKey          string        // field of the record with the topic, partition and offset of the message
+}
+
+// TableInputConfig is the configuration of the in_ydb_table input plugin.
+type TableInputConfig struct {
+	InputSettings
+
+	TablePath        string
+	Columns          map[string]string // {field : column}, all the columns are read under their names if empty
+	CursorColumn     string
+	CursorStatePath  string
+	ReadBatchMaxRows int
+	ReadTimeout      time.Duration // timeout of the query reading a page of the rows
+}
+
+// ReadInputConfigFromPlugin reads the configuration of the in_ydb_topic plugin instance.
+func ReadInputConfigFromPlugin(plugin unsafe.Pointer) (cfg InputConfig, err error) {
+	if err = readInputSettings(plugin, &cfg.InputSettings); err != nil {
+		return cfg, err
+	}
+
+	for _, topic := range strings.Split(configKey(plugin, ParamTopicPath), ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			cfg.Topics = append(cfg.Topics, topic)
+		}
+	}
+	if len(cfg.Topics) == 0 {
+		return cfg, fmt.Errorf("not provided parameter '%s'", ParamTopicPath)
+	}
+	if cfg.Consumer = configKey(plugin, ParamConsumer); cfg.Consumer == "" {
+		return cfg, fmt.Errorf("not provided parameter '%s'", ParamConsumer)
+	}
+
+	cfg.Format = strings.ToLower(configKey(plugin, ParamTopicFormat))
+	switch cfg.Format {
+	case "":
+		cfg.Format = TopicFormatJSON
+	case TopicFormatJSON, TopicFormatMsgpack:
+	default:
+		return cfg, fmt.Errorf("value of parameter '%s' must be one of '%s' or '%s', got '%s'",
+			ParamTopicFormat, TopicFormatJSON, TopicFormatMsgpack, cfg.Format)
+	}
+
+	if cfg.ReadBatchMaxMessages, err = intParam(plugin, ParamReadBatchMaxMessages,
+		DefaultReadBatchMaxMessages); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadBatchMaxMessages <= 0 {
+		cfg.ReadBatchMaxMessages = DefaultReadBatchMaxMessages
+	}
+	if cfg.ReadTimeout, err = durationParam(plugin, ParamReadTimeout, DefaultReadTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.MetadataKey = configKey(plugin, ParamMetadataKey); cfg.MetadataKey == "" {
+		cfg.MetadataKey = DefaultMetadataKey
+	}
+
+	return cfg, nil
+}
+
+// ReadTableInputConfigFromPlugin reads the configuration of the in_ydb_table plugin instance.
+func ReadTableInputConfigFromPlugin(plugin unsafe.Pointer) (cfg TableInputConfig, err error) {
+	if err = readInputSettings(plugin, &cfg.InputSettings); err != nil {
+		return cfg, err
+	}
+
+	if cfg.TablePath = configKey(plugin, ParamTablePath); cfg.TablePath == "" {
+		return cfg, fmt.Errorf("not provided parameter '%s'", ParamTablePath)
+	}
+	if configKey(plugin, ParamColumns) != "" {
+		if cfg.Columns, err = readColumns(plugin); err != nil {
+			return cfg, fmt.Errorf("no columns: %w", err)
+		}
+	}
+	if cfg.CursorColumn = configKey(plugin, ParamCursorColumn); cfg.CursorColumn == "" {
+		return cfg, fmt.Errorf("not provided parameter '%s'", ParamCursorColumn)
+	}
+	if cfg.CursorStatePath = configKey(plugin, ParamCursorStatePath); cfg.CursorStatePath == "" {
+		return cfg, fmt.Errorf("not provided parameter '%s'", ParamCursorStatePath)
+	}
+
+	if cfg.ReadBatchMaxRows, err = intParam(plugin, ParamReadBatchMaxRows, DefaultReadBatchMaxRows); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadBatchMaxRows <= 0 {
+		cfg.ReadBatchMaxRows = DefaultReadBatchMaxRows
+	}
+	if cfg.ReadTimeout, err = durationParam(plugin, ParamReadTimeout, DefaultTableReadTimeout); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// readInputSettings reads the connection and the common settings. The input plugins are built into separate
+// shared libraries, so the parameters are read by the input API.
+func readInputSettings(plugin unsafe.Pointer, settings *InputSettings) (err error) {
+	configKey = input.FLBPluginConfigKey
+
+	settings.ConnectionURL = configKey(plugin, ParamConnectionURL)
+	if settings.ConnectionURL == "" {
+		return fmt.Errorf("not provided parameter '%s'", ParamConnectionURL)
+	}
+	settings.Certificates = configKey(plugin, ParamCertificatesString)
+	if settings.CredentialsOption, err = ydbCredentials(plugin, ""); err != nil {
+		return errors.New("required valid credentials")
+	}
+
+	if lvl, err := zerolog.ParseLevel(configKey(plugin, ParamLogLevel)); err != nil {
+		settings.LogLevel = zerolog.InfoLevel
+	} else {
+		settings.LogLevel = lvl
+	}
+	if settings.InitTimeout, err = positiveDurationParam(plugin, ParamInitTimeout, DefaultInitTimeout); err != nil {
+		return err
+	}
+	if settings.ExitTimeout, err = durationParam(plugin, ParamExitTimeout, DefaultExitTimeout); err != nil {
+		return err
+	}
+	settings.MetricsListen = configKey(plugin, ParamMetricsListen)
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+)
+
+// Gauge is a metric which value can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Counter is a metric which value only grows.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+type family struct {
+	kind   string
+	help   string
+	series map[string]func() string // {labels : value}
+}
+
+var (
+	mu       sync.Mutex
+	families = make(map[string]*family)
+	listen   string
+)
+
+func register(kind, name, help string, labels []string, value func() string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f, has := families[name]
+	if !has {
+		f = &family{kind: kind, help: help, series: make(map[string]func() string)}
+		families[name] = f
+	}
+	f.series[formatLabels(labels)] = value
+}
+
+// NewGauge registers the gauge with the labels given as name and value pairs.
+// Registering the same name and labels again replaces the previous gauge.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{}
+	register("gauge", name, help, labels, func() string {
+		return fmt.Sprintf("%g", g.Value())
+	})
+
+	return g
+}
+
+// NewCounter registers the counter with the labels given as name and value pairs.
+// Registering the same name and labels again replaces the previous counter.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{}
+	register("counter", name, help, labels, func() string {
+		return fmt.Sprintf("%d", c.Value())
+	})
+
+	return c
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Write writes all the registered metrics in the Prometheus text format.
+func Write(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind)
+
+		series := make([]string, 0, len(f.series))
+		for labels := range f.series {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+
+		for _, labels := range series {
+			fmt.Fprintf(w, "%s%s %s\n", name, labels, f.series[labels]())
+		}
+	}
+}
+
+func handler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	Write(w)
+}
+
+// Serve starts the HTTP server exposing the metrics at the '/metrics' path.
+// The server is shared by all the plugin instances, so it is started once per process.
+func Serve(addr string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if listen != "" {
+		if listen != addr {
+			log.Warn(fmt.Sprintf("metrics are already served on '%s', ignoring '%s'", listen, addr))
+		}
+
+		return nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen metrics address '%s': %w", addr, err)
+	}
+	listen = addr
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handler)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error(fmt.Sprintf("metrics server failed: %v", err))
+		}
+	}()
+
+	return nil
+}
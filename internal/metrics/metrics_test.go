@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	NewGauge("test_rate", "Test rate.", "table", "logs").Set(1.5)
+	c := NewCounter("test_total", "Test total.")
+	c.Add(2)
+	c.Inc()
+
+	var b strings.Builder
+	Write(&b)
+
+	require.Contains(t, b.String(), "# HELP test_rate Test rate.\n# TYPE test_rate gauge\ntest_rate{table=\"logs\"} 1.5\n")
+	require.Contains(t, b.String(), "# TYPE test_total counter\ntest_total 3\n")
+}
@@ -8,4 +8,9 @@ type Event struct {
 	Timestamp time.Time
 	Metadata  string
 	Message   map[string]interface{}
+	Seq       uint64 // number of the event among the ones of the same tag sent by the agent, zero if not assigned
+
+	// position of the event among the ones produced by splitting the oversized values, zero count if not split
+	ChunkIndex int
+	ChunkCount int
 }
@@ -0,0 +1,109 @@
+package source
+
+import (
+	"fmt"
+	"time"
+	"unsafe" //nolint:gocritic
+
+	"github.com/fluent/fluent-bit-go/input"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
+)
+
+// Reader reads the records of an input plugin.
+type Reader interface {
+	// Collect returns the msgpack encoded records, or nil if there are none.
+	Collect() ([]byte, error)
+	// Accepted stores the position of the records collected before, which Fluent Bit appended.
+	Accepted() error
+	Exit(timeout time.Duration) error
+}
+
+// Plugin handles the callbacks of an input plugin with its reader. The input API of Fluent Bit
+// has no plugin context, so the plugin library keeps a single Plugin, and a single instance
+// of the plugin is supported. The records are copied to the C memory by the library.
+type Plugin struct {
+	Name        string
+	Description string
+	Records     string // what the records are read from, for the logs: "messages" or "rows"
+	Position    string // how the position of the accepted records is stored, for the logs
+
+	// Configure reads the configuration of the plugin instance.
+	Configure func(plugin unsafe.Pointer) (*config.InputSettings, error)
+	// NewReader creates the reader of the configured instance.
+	NewReader func() (Reader, error)
+
+	settings *config.InputSettings
+	reader   Reader
+}
+
+func (p *Plugin) Register(def unsafe.Pointer) int {
+	return input.FLBPluginRegister(def, p.Name, p.Description)
+}
+
+func (p *Plugin) Init(plugin unsafe.Pointer) int {
+	var err error
+	if p.settings, err = p.Configure(plugin); err != nil {
+		log.Error(fmt.Sprintf("failed read config: %v", err))
+
+		return input.FLB_ERROR
+	}
+
+	log.SetLevel(p.settings.LogLevel)
+
+	if p.settings.MetricsListen != "" {
+		if err := metrics.Serve(p.settings.MetricsListen); err != nil {
+			log.Error(fmt.Sprintf("failed serve metrics: %v", err))
+
+			return input.FLB_ERROR
+		}
+	}
+
+	// the reader which failed to start is kept, so its connection is closed on exit
+	if p.reader, err = p.NewReader(); err != nil {
+		log.Error(fmt.Sprintf("failed create %s: %v", p.Description, err))
+
+		return input.FLB_ERROR
+	}
+
+	return input.FLB_OK
+}
+
+// Collect returns the records to pass to Fluent Bit and the result code of the input callback.
+func (p *Plugin) Collect() ([]byte, int) {
+	records, err := p.reader.Collect()
+	if err != nil {
+		log.Error(fmt.Sprintf("read %s failed: %v", p.Records, err))
+
+		return nil, input.FLB_RETRY
+	}
+
+	return records, input.FLB_OK
+}
+
+// Cleanup is called after Fluent Bit appends the records of the input callback,
+// so the position of the records is stored here.
+func (p *Plugin) Cleanup() int {
+	if err := p.reader.Accepted(); err != nil {
+		log.Error(fmt.Sprintf("%s failed: %v", p.Position, err))
+
+		return input.FLB_ERROR
+	}
+
+	return input.FLB_OK
+}
+
+func (p *Plugin) Exit() int {
+	if p.reader == nil {
+		return input.FLB_OK
+	}
+	if err := p.reader.Exit(p.settings.ExitTimeout); err != nil {
+		log.Error(fmt.Errorf("exit failed: %w", err).Error())
+
+		return input.FLB_ERROR
+	}
+
+	return input.FLB_OK
+}
@@ -0,0 +1,103 @@
+package source
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"unsafe" //nolint:gocritic
+
+	"github.com/fluent/fluent-bit-go/input"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+)
+
+// recordsReader returns the queued results of the collects, and counts the accepted ones.
+type recordsReader struct {
+	records   [][]byte
+	err       error
+	acceptErr error
+	accepted  int
+	exited    time.Duration
+}
+
+func (r *recordsReader) Collect() ([]byte, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.records) == 0 {
+		return nil, nil
+	}
+	records := r.records[0]
+	r.records = r.records[1:]
+
+	return records, nil
+}
+
+func (r *recordsReader) Accepted() error {
+	if r.acceptErr != nil {
+		return r.acceptErr
+	}
+	r.accepted++
+
+	return nil
+}
+
+func (r *recordsReader) Exit(timeout time.Duration) error {
+	r.exited = timeout
+
+	return nil
+}
+
+func testPlugin(reader *recordsReader, configErr, readerErr error) *Plugin {
+	return &Plugin{
+		Name:        "ydb_test",
+		Description: "YDB test reader",
+		Records:     "rows",
+		Position:    "store position",
+		Configure: func(unsafe.Pointer) (*config.InputSettings, error) {
+			return &config.InputSettings{ExitTimeout: time.Second}, configErr
+		},
+		NewReader: func() (Reader, error) {
+			return reader, readerErr
+		},
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	reader := &recordsReader{records: [][]byte{[]byte("records")}}
+	p := testPlugin(reader, nil, nil)
+	require.Equal(t, input.FLB_OK, p.Init(nil))
+
+	records, code := p.Collect()
+	require.Equal(t, input.FLB_OK, code)
+	require.Equal(t, []byte("records"), records)
+	require.Equal(t, input.FLB_OK, p.Cleanup())
+	require.Equal(t, 1, reader.accepted)
+
+	records, code = p.Collect()
+	require.Equal(t, input.FLB_OK, code)
+	require.Nil(t, records)
+
+	reader.err = errors.New("read failed")
+	_, code = p.Collect()
+	require.Equal(t, input.FLB_RETRY, code)
+	reader.acceptErr = errors.New("commit failed")
+	require.Equal(t, input.FLB_ERROR, p.Cleanup())
+
+	require.Equal(t, input.FLB_OK, p.Exit())
+	require.Equal(t, time.Second, reader.exited)
+}
+
+func TestPluginInitFailure(t *testing.T) {
+	p := testPlugin(&recordsReader{}, errors.New("no parameter"), nil)
+	require.Equal(t, input.FLB_ERROR, p.Init(nil))
+	require.Equal(t, input.FLB_OK, p.Exit(), "no reader to stop")
+
+	// the reader which failed to start is stopped on exit
+	reader := &recordsReader{}
+	p = testPlugin(reader, nil, errors.New("no table"))
+	require.Equal(t, input.FLB_ERROR, p.Init(nil))
+	require.Equal(t, input.FLB_OK, p.Exit())
+	require.Equal(t, time.Second, reader.exited)
+}
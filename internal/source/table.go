@@ -0,0 +1,610 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/input"
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/query"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/storage"
+)
+
+// TableReader tails the table: it reads the rows in the order of the cursor column, page by page,
+// starting after the last row read. The cursor column is the first column of the primary key, and the other
+// primary key columns order the rows having the same cursor value, so they are neither skipped nor read twice. The position is stored
+// into the state file only after Fluent Bit accepts the records.
+type TableReader struct {
+	cfg      *config.TableInputConfig
+	ctx      context.Context // canceled on exit
+	stop     context.CancelFunc
+	db       *ydb.Driver
+	fullPath string
+	mapping  recordMapping
+	columns  []string      // selected columns
+	key      []keyColumn   // the primary key columns, the cursor column first
+	first    string        // query of the first page
+	next     string        // query of the page after the position
+	position []interface{} // key of the last read row, nil before the first row
+	stored   bool          // the position is stored into the state file
+	encoder  *input.FLBEncoder
+
+	rows *metrics.Counter
+}
+
+type keyColumn struct {
+	name  string
+	t     types.Type
+	index int // index in the selected columns
+}
+
+// recordMapping reverses the Columns mapping of the output plugin: the columns are read back
+// into the fields of the record.
+type recordMapping struct {
+	fields    map[string]string // {column : field}, every column is read under its name if nil
+	timestamp string            // column of the record timestamp
+	others    string            // JSON column which object fields are added to the record
+}
+
+// cursorState is the content of the state file.
+type cursorState struct {
+	Table    string            `json:"table"`
+	Columns  []string          `json:"columns"`
+	Position []json.RawMessage `json:"position"`
+}
+
+func NewTableReader(cfg *config.TableInputConfig) (*TableReader, error) {
+	ctx, stop := context.WithCancel(context.Background())
+	r := &TableReader{
+		cfg:     cfg,
+		ctx:     ctx,
+		stop:    stop,
+		mapping: newRecordMapping(cfg.Columns),
+		encoder: input.NewEncoder(),
+		rows: metrics.NewCounter("fluentbit_ydb_input_rows_total",
+			"Number of the rows read from the table.", "table", cfg.TablePath),
+	}
+
+	initCtx, cancel := context.WithTimeout(ctx, cfg.InitTimeout)
+	defer cancel()
+
+	var err error
+	if r.db, err = storage.OpenDriver(initCtx, cfg.Endpoint); err != nil {
+		return r, fmt.Errorf("failed to connect: %w", err)
+	}
+	r.fullPath = path.Join(r.db.Name(), cfg.TablePath)
+
+	var desc options.Description
+	err = r.db.Table().Do(initCtx, func(ctx context.Context, session table.Session) (err error) {
+		desc, err = session.DescribeTable(ctx, r.fullPath)
+
+		return err
+	}, table.WithIdempotent())
+	if err != nil {
+		return r, fmt.Errorf("failed to describe table `%s`: %w", r.fullPath, err)
+	}
+	if r.columns, r.key, err = r.mapping.layout(desc, cfg.CursorColumn); err != nil {
+		return r, fmt.Errorf("table `%s`: %w", r.fullPath, err)
+	}
+	r.first = pageQuery(r.fullPath, r.columns, r.key, false)
+	r.next = pageQuery(r.fullPath, r.columns, r.key, true)
+
+	if r.position, err = r.load(); err != nil {
+		return r, err
+	}
+	r.stored = true
+
+	return r, nil
+}
+
+func newRecordMapping(columns map[string]string) recordMapping {
+	if len(columns) == 0 {
+		return recordMapping{}
+	}
+
+	fields := make([]string, 0, len(columns))
+	for field := range columns {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	m := recordMapping{fields: make(map[string]string, len(columns))}
+	for _, field := range fields {
+		column := columns[field]
+		switch {
+		case field == config.KeyTimestamp:
+			m.timestamp = column
+		case field == config.KeyOthers:
+			m.others = column
+		case strings.HasPrefix(field, "."):
+			// the other pseudo-fields are filled by the output plugin and are not the record fields
+		default:
+			if _, has := m.fields[column]; !has {
+				m.fields[column] = field
+			}
+		}
+	}
+
+	return m
+}
+
+// layout returns the columns to select: the mapped ones, or all the columns of the table, and the key columns.
+// The cursor column must lead the primary key, so the pages are read by the key ranges.
+func (m recordMapping) layout(desc options.Description, cursor string) (columns []string, key []keyColumn, _ error) {
+	columnTypes := make(map[string]types.Type, len(desc.Columns))
+	for _, column := range desc.Columns {
+		columnTypes[column.Name] = column.Type
+		if m.fields == nil {
+			columns = append(columns, column.Name)
+		}
+	}
+
+	if m.fields != nil {
+		for column := range m.fields {
+			columns = append(columns, column)
+		}
+		for _, column := range []string{m.timestamp, m.others} {
+			if column != "" && !slices.Contains(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+		sort.Strings(columns)
+	}
+	for _, column := range columns {
+		if _, has := columnTypes[column]; !has {
+			return nil, nil, fmt.Errorf("no column '%s'", column)
+		}
+	}
+
+	if _, has := columnTypes[cursor]; !has {
+		return nil, nil, fmt.Errorf("no cursor column '%s'", cursor)
+	}
+	if len(desc.PrimaryKey) == 0 || desc.PrimaryKey[0] != cursor {
+		// otherwise each page query scans and sorts the whole table
+		return nil, nil, fmt.Errorf("cursor column '%s' must be the first column of the primary key", cursor)
+	}
+
+	for i, name := range desc.PrimaryKey {
+		t := columnTypes[name]
+		if _, err := keyParam(t, nil); errors.Is(err, errUnsupportedKey) {
+			return nil, nil, fmt.Errorf("key column '%s': %w", name, err)
+		}
+		// NULL is neither equal to nor greater than the position, so the rows after a NULL
+		// in the key would be skipped, and the reading would stop at such a row
+		if optional, _ := types.IsOptional(t); optional && i > 0 {
+			return nil, nil, fmt.Errorf("key column '%s' must be NOT NULL", name)
+		}
+		index := slices.Index(columns, name)
+		if index < 0 {
+			index = len(columns)
+			columns = append(columns, name)
+		}
+		key = append(key, keyColumn{name: name, t: t, index: index})
+	}
+
+	return columns, key, nil
+}
+
+// pageQuery returns the query of a page of the rows in the order of the key. The page after the position
+// is selected by the condition `(k0, k1, ...) > ($k0, $k1, ...)`, expanded into the column comparisons.
+func pageQuery(fullPath string, columns []string, key []keyColumn, after bool) string {
+	var q strings.Builder
+	if after {
+		for i, k := range key {
+			fmt.Fprintf(&q, "DECLARE $k%d AS %s;\n", i, innerType(k.t).Yql())
+		}
+	}
+	q.WriteString("DECLARE $limit AS Uint64;\n")
+	fmt.Fprintf(&q, "SELECT `%s` FROM `%s`\n", strings.Join(columns, "`, `"), fullPath)
+
+	if after {
+		condition := ""
+		for i := len(key) - 1; i >= 0; i-- {
+			greater := fmt.Sprintf("`%s` > $k%d", key[i].name, i)
+			if condition == "" {
+				condition = greater
+			} else {
+				condition = fmt.Sprintf("%s OR (`%s` = $k%d AND (%s))", greater, key[i].name, i, condition)
+			}
+		}
+		q.WriteString("WHERE " + condition + "\n")
+	} else {
+		fmt.Fprintf(&q, "WHERE `%s` IS NOT NULL\n", key[0].name)
+	}
+
+	names := make([]string, 0, len(key))
+	for _, k := range key {
+		names = append(names, k.name)
+	}
+	fmt.Fprintf(&q, "ORDER BY `%s`\nLIMIT $limit;", strings.Join(names, "`, `"))
+
+	return q.String()
+}
+
+// Collect reads the next page of the rows and returns the msgpack encoded records.
+// It returns nil if there are no new rows.
+func (r *TableReader) Collect() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, r.cfg.ReadTimeout)
+	defer cancel()
+
+	text := r.first
+	params := ydb.ParamsBuilder().Param("$limit").Uint64(uint64(r.cfg.ReadBatchMaxRows))
+	if r.position != nil {
+		text = r.next
+		for i, k := range r.key {
+			v, err := keyParam(k.t, r.position[i])
+			if err != nil {
+				return nil, fmt.Errorf("key column '%s': %w", k.name, err)
+			}
+			params = params.Param(fmt.Sprintf("$k%d", i)).Any(v)
+		}
+	}
+
+	rs, err := r.db.Query().QueryResultSet(ctx, text,
+		query.WithParameters(params.Build()),
+		query.WithTxControl(query.SnapshotReadOnlyTxControl()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rows of `%s`: %w", r.fullPath, err)
+	}
+	defer func() {
+		_ = rs.Close(ctx)
+	}()
+
+	values := make([]types.Value, len(r.columns))
+	dst := make([]interface{}, len(values))
+	for i := range values {
+		dst[i] = &values[i]
+	}
+
+	var (
+		buf      bytes.Buffer
+		position []interface{}
+		n        uint64
+	)
+	for {
+		row, err := rs.NextRow(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			err = row.Scan(dst...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rows of `%s`: %w", r.fullPath, err)
+		}
+
+		cells := make([]interface{}, len(values))
+		for i, v := range values {
+			if cells[i], err = cellValue(v); err != nil {
+				return nil, fmt.Errorf("column '%s': %w", r.columns[i], err)
+			}
+		}
+
+		timestamp, record := r.mapping.record(r.columns, cells)
+		packed, err := r.encoder.Encode([]interface{}{input.FLBTime{Time: timestamp}, record})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode row: %w", err)
+		}
+		buf.Write(packed)
+
+		position = make([]interface{}, len(r.key))
+		for i, k := range r.key {
+			position[i] = cells[k.index]
+		}
+		n++
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	r.rows.Add(n)
+	r.position, r.stored = position, false
+
+	return buf.Bytes(), nil
+}
+
+// Accepted stores the position of the rows which records were accepted by Fluent Bit.
+func (r *TableReader) Accepted() error {
+	if r.stored {
+		return nil
+	}
+	if err := r.store(); err != nil {
+		return err
+	}
+	r.stored = true
+
+	return nil
+}
+
+// record converts the cells of the row to the record fields. The NULL cells are omitted.
+func (m recordMapping) record(columns []string, cells []interface{}) (time.Time, map[string]interface{}) {
+	timestamp := time.Now()
+	record := make(map[string]interface{}, len(columns))
+
+	if i := slices.Index(columns, m.others); m.others != "" && i >= 0 {
+		var others map[string]interface{}
+		switch v := cells[i].(type) {
+		case string:
+			_ = json.Unmarshal([]byte(v), &others)
+		case []byte:
+			_ = json.Unmarshal(v, &others)
+		}
+		for field, v := range others {
+			record[field] = v
+		}
+	}
+
+	for i, column := range columns {
+		cell := cells[i]
+		if cell == nil {
+			continue
+		}
+		if column == m.timestamp {
+			if t, ok := cell.(time.Time); ok {
+				timestamp = t
+			}
+		}
+
+		field := column
+		if m.fields != nil {
+			if field = m.fields[column]; field == "" {
+				continue
+			}
+		}
+		record[field] = fieldValue(cell)
+	}
+
+	return timestamp, record
+}
+
+// fieldValue converts the cell to the value which Fluent Bit outputs handle.
+func fieldValue(cell interface{}) interface{} {
+	switch v := cell.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+// cellValue returns the Go value of the cell, nil for NULL.
+func cellValue(v types.Value) (interface{}, error) {
+	var cell driver.Value
+	err := types.CastTo(v, &cell)
+	if err == nil {
+		return cell, nil
+	}
+
+	// JSON, YSON, DyNumber and the timezone types are read as the strings
+	var s *string
+	if types.CastTo(v, &s) == nil {
+		if s == nil {
+			return nil, nil
+		}
+
+		return *s, nil
+	}
+
+	if d, decimalErr := types.ToDecimal(v); decimalErr == nil {
+		return d.String(), nil
+	}
+
+	return nil, err
+}
+
+var errUnsupportedKey = errors.New("unsupported type, must be a date, time, integer or string")
+
+// keyParam converts the value of the key column to the query parameter.
+func keyParam(t types.Type, v interface{}) (types.Value, error) {
+	yql := innerType(t).Yql()
+	if !slices.Contains(keyTypes, yql) {
+		return nil, fmt.Errorf("%w, got %s", errUnsupportedKey, yql)
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return nil, errors.New("NULL value")
+	case time.Time:
+		switch yql {
+		case "Timestamp":
+			return types.TimestampValueFromTime(v), nil
+		case "Datetime":
+			return types.DatetimeValueFromTime(v), nil
+		case "Date":
+			return types.DateValueFromTime(v), nil
+		}
+	case string:
+		if yql == "Utf8" {
+			return types.TextValue(v), nil
+		}
+	case []byte:
+		if yql == "String" {
+			return types.BytesValue(v), nil
+		}
+	default:
+		integer := reflect.ValueOf(v)
+		switch {
+		case strings.HasPrefix(yql, "Int") && integer.CanInt():
+			return intValue(yql, integer.Int()), nil
+		case strings.HasPrefix(yql, "Uint") && integer.CanUint():
+			return uintValue(yql, integer.Uint()), nil
+		}
+	}
+
+	return nil, fmt.Errorf("value %v of type %T does not match %s", v, v, yql)
+}
+
+func innerType(t types.Type) types.Type {
+	if optional, inner := types.IsOptional(t); optional {
+		return inner
+	}
+
+	return t
+}
+
+var keyTypes = []string{"Timestamp", "Datetime", "Date", "Utf8", "String",
+	"Int8", "Int16", "Int32", "Int64", "Uint8", "Uint16", "Uint32", "Uint64"}
+
+func intValue(yql string, v int64) types.Value {
+	switch yql {
+	case "Int8":
+		return types.Int8Value(int8(v))
+	case "Int16":
+		return types.Int16Value(int16(v))
+	case "Int32":
+		return types.Int32Value(int32(v))
+	default:
+		return types.Int64Value(v)
+	}
+}
+
+func uintValue(yql string, v uint64) types.Value {
+	switch yql {
+	case "Uint8":
+		return types.Uint8Value(uint8(v))
+	case "Uint16":
+		return types.Uint16Value(uint16(v))
+	case "Uint32":
+		return types.Uint32Value(uint32(v))
+	default:
+		return types.Uint64Value(v)
+	}
+}
+
+// load reads the position from the state file. The position of another table or key is an error,
+// so the table is not read from an unrelated position.
+func (r *TableReader) load() ([]interface{}, error) {
+	data, err := os.ReadFile(r.cfg.CursorStatePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err = os.MkdirAll(filepath.Dir(r.cfg.CursorStatePath), 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create directory of cursor state '%s': %w", r.cfg.CursorStatePath, err)
+		}
+
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read cursor state '%s': %w", r.cfg.CursorStatePath, err)
+	}
+
+	var state cursorState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode cursor state '%s': %w", r.cfg.CursorStatePath, err)
+	}
+
+	return decodePosition(state, r.cfg.TablePath, r.key)
+}
+
+func decodePosition(state cursorState, tablePath string, key []keyColumn) ([]interface{}, error) {
+	names := make([]string, 0, len(key))
+	for _, k := range key {
+		names = append(names, k.name)
+	}
+	if state.Table != tablePath || !slices.Equal(state.Columns, names) || len(state.Position) != len(key) {
+		return nil, fmt.Errorf("cursor state of table '%s' by (%s) does not match table '%s' by (%s), "+
+			"remove the state file to read the table from the start",
+			state.Table, strings.Join(state.Columns, ", "), tablePath, strings.Join(names, ", "))
+	}
+
+	position := make([]interface{}, len(key))
+	for i, k := range key {
+		var err error
+		switch yql := innerType(k.t).Yql(); {
+		case yql == "Timestamp" || yql == "Datetime" || yql == "Date":
+			var t time.Time
+			err = json.Unmarshal(state.Position[i], &t)
+			position[i] = t
+		case yql == "Utf8":
+			var s string
+			err = json.Unmarshal(state.Position[i], &s)
+			position[i] = s
+		case yql == "String":
+			var b []byte
+			err = json.Unmarshal(state.Position[i], &b)
+			position[i] = b
+		case strings.HasPrefix(yql, "Int"):
+			var n int64
+			err = json.Unmarshal(state.Position[i], &n)
+			position[i] = n
+		default:
+			var n uint64
+			err = json.Unmarshal(state.Position[i], &n)
+			position[i] = n
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode position of column '%s': %w", k.name, err)
+		}
+	}
+
+	return position, nil
+}
+
+// store writes the position into a temporary file, which replaces the state file after it is synced to disk.
+func (r *TableReader) store() error {
+	state := cursorState{Table: r.cfg.TablePath}
+	for i, k := range r.key {
+		v, err := json.Marshal(r.position[i])
+		if err != nil {
+			return err
+		}
+		state.Columns = append(state.Columns, k.name)
+		state.Position = append(state.Position, v)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := r.cfg.CursorStatePath + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to write cursor state: %w", err)
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write cursor state: %w", err)
+	}
+
+	return os.Rename(tmp, r.cfg.CursorStatePath)
+}
+
+// Exit stops reading, the position of the records not accepted by Fluent Bit is not stored.
+func (r *TableReader) Exit(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	r.stop()
+	if r.db != nil {
+		if err := r.db.Close(ctx); err != nil {
+			return fmt.Errorf("failed to close connection: %w", err)
+		}
+	}
+
+	return nil
+}
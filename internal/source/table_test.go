@@ -0,0 +1,200 @@
+package source
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+)
+
+func testDescription() options.Description {
+	return options.Description{
+		Columns: []options.Column{
+			{Name: "timestamp", Type: types.TypeTimestamp},
+			{Name: "input", Type: types.TypeText},
+			{Name: "hash", Type: types.TypeUint64},
+			{Name: "message", Type: types.Optional(types.TypeBytes)},
+			{Name: "others", Type: types.Optional(types.TypeJSON)},
+			{Name: "updated_at", Type: types.Optional(types.TypeTimestamp)},
+		},
+		PrimaryKey: []string{"timestamp", "input", "hash"},
+	}
+}
+
+func TestLayout(t *testing.T) {
+	m := newRecordMapping(map[string]string{
+		config.KeyTimestamp: "timestamp",
+		config.KeyInput:     "input",
+		config.KeyOthers:    "others",
+		config.KeySeq:       "seq",
+		"log":               "message",
+	})
+	require.Equal(t, map[string]string{"message": "log"}, m.fields)
+
+	columns, key, err := m.layout(testDescription(), "timestamp")
+	require.NoError(t, err)
+	require.Equal(t, []string{"message", "others", "timestamp", "input", "hash"}, columns)
+	require.Len(t, key, 3)
+	require.Equal(t, keyColumn{name: "timestamp", t: types.TypeTimestamp, index: 2}, key[0])
+	require.Equal(t, "input", key[1].name)
+	require.Equal(t, 3, key[1].index)
+	require.Equal(t, 4, key[2].index)
+
+	columns, key, err = recordMapping{}.layout(testDescription(), "timestamp")
+	require.NoError(t, err)
+	require.Len(t, columns, 6)
+	require.Len(t, key, 3)
+
+	_, _, err = m.layout(testDescription(), "created_at")
+	require.Error(t, err)
+
+	// the pages by a column out of the primary key prefix would scan the whole table
+	_, _, err = m.layout(testDescription(), "updated_at")
+	require.ErrorContains(t, err, "first column of the primary key")
+	_, _, err = m.layout(testDescription(), "input")
+	require.Error(t, err)
+
+	desc := testDescription()
+	desc.PrimaryKey = []string{"others", "hash"}
+	_, _, err = m.layout(desc, "others")
+	require.ErrorIs(t, err, errUnsupportedKey)
+
+	// the NULL cursor rows are not read, but a NULL in the rest of the key would stop the reading
+	desc = testDescription()
+	desc.PrimaryKey = []string{"updated_at", "input"}
+	_, key, err = m.layout(desc, "updated_at")
+	require.NoError(t, err)
+	require.Len(t, key, 2)
+	desc.PrimaryKey = []string{"timestamp", "updated_at"}
+	_, _, err = m.layout(desc, "timestamp")
+	require.ErrorContains(t, err, "key column 'updated_at' must be NOT NULL")
+}
+
+func TestPageQuery(t *testing.T) {
+	key := []keyColumn{
+		{name: "updated_at", t: types.Optional(types.TypeTimestamp)},
+		{name: "id", t: types.TypeUint64},
+	}
+
+	require.Equal(t, "DECLARE $limit AS Uint64;\n"+
+		"SELECT `id`, `updated_at` FROM `/local/events`\n"+
+		"WHERE `updated_at` IS NOT NULL\n"+
+		"ORDER BY `updated_at`, `id`\n"+
+		"LIMIT $limit;", pageQuery("/local/events", []string{"id", "updated_at"}, key, false))
+
+	require.Equal(t, "DECLARE $k0 AS Timestamp;\nDECLARE $k1 AS Uint64;\nDECLARE $limit AS Uint64;\n"+
+		"SELECT `id`, `updated_at` FROM `/local/events`\n"+
+		"WHERE `updated_at` > $k0 OR (`updated_at` = $k0 AND (`id` > $k1))\n"+
+		"ORDER BY `updated_at`, `id`\n"+
+		"LIMIT $limit;", pageQuery("/local/events", []string{"id", "updated_at"}, key, true))
+}
+
+func TestRecordMapping(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	m := newRecordMapping(map[string]string{
+		config.KeyTimestamp: "timestamp",
+		config.KeyOthers:    "others",
+		"log":               "message",
+		"created":           "created_at",
+	})
+
+	timestamp, record := m.record(
+		[]string{"created_at", "message", "others", "timestamp", "hash"},
+		[]interface{}{ts, []byte("started"), `{"host": "app-1", "log": "ignored"}`, ts, uint64(7)},
+	)
+	require.Equal(t, ts, timestamp)
+	require.Equal(t, map[string]interface{}{
+		"created": "2024-05-01T10:00:00Z",
+		"log":     []byte("started"),
+		"host":    "app-1",
+	}, record)
+
+	// without the mapping every column is a field, NULL cells are omitted
+	_, record = recordMapping{}.record([]string{"id", "message"}, []interface{}{uint64(1), nil})
+	require.Equal(t, map[string]interface{}{"id": uint64(1)}, record)
+}
+
+func TestKeyParam(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	v, err := keyParam(types.Optional(types.TypeTimestamp), ts)
+	require.NoError(t, err)
+	require.Equal(t, types.TimestampValueFromTime(ts), v)
+
+	v, err = keyParam(types.TypeInt32, int32(-5))
+	require.NoError(t, err)
+	require.Equal(t, types.Int32Value(-5), v)
+
+	v, err = keyParam(types.TypeUint64, uint64(5))
+	require.NoError(t, err)
+	require.Equal(t, types.Uint64Value(5), v)
+
+	_, err = keyParam(types.TypeUint64, nil)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errUnsupportedKey)
+	_, err = keyParam(types.TypeText, uint64(5))
+	require.Error(t, err)
+	_, err = keyParam(types.TypeInterval, time.Second)
+	require.ErrorIs(t, err, errUnsupportedKey)
+}
+
+func TestCellValue(t *testing.T) {
+	cell, err := cellValue(types.OptionalValue(types.JSONValue(`{"a": 1}`)))
+	require.NoError(t, err)
+	require.Equal(t, `{"a": 1}`, cell)
+
+	cell, err = cellValue(types.NullValue(types.TypeJSON))
+	require.NoError(t, err)
+	require.Nil(t, cell)
+
+	cell, err = cellValue(types.NullValue(types.TypeUint64))
+	require.NoError(t, err)
+	require.Nil(t, cell)
+
+	cell, err = cellValue(types.TextValue("abc"))
+	require.NoError(t, err)
+	require.Equal(t, "abc", cell)
+
+	cell, err = cellValue(types.OptionalValue(types.Uint64Value(7)))
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), cell)
+
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	cell, err = cellValue(types.TimestampValueFromTime(ts))
+	require.NoError(t, err)
+	require.True(t, ts.Equal(cell.(time.Time)))
+}
+
+func TestPosition(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 123456000, time.UTC)
+	key := []keyColumn{
+		{name: "updated_at", t: types.Optional(types.TypeTimestamp)},
+		{name: "input", t: types.TypeText},
+		{name: "id", t: types.TypeInt32},
+	}
+
+	state := cursorState{Table: "events", Columns: []string{"updated_at", "input", "id"}}
+	for _, v := range []interface{}{ts, "app", int32(-3)} {
+		raw, err := json.Marshal(v)
+		require.NoError(t, err)
+		state.Position = append(state.Position, raw)
+	}
+
+	position, err := decodePosition(state, "events", key)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{ts, "app", int64(-3)}, position)
+	for i, k := range key {
+		_, err = keyParam(k.t, position[i])
+		require.NoError(t, err)
+	}
+
+	_, err = decodePosition(state, "logs", key)
+	require.Error(t, err)
+	_, err = decodePosition(state, "events", key[:2])
+	require.Error(t, err)
+}
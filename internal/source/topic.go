@@ -0,0 +1,315 @@
+// Package source reads the records of the Fluent Bit input plugins from YDB.
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/input"
+	"github.com/klauspost/compress/zstd"
+	ugorji "github.com/ugorji/go/codec"
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/storage"
+)
+
+// TopicReader reads the messages of the topics or the changefeeds with the consumer, and decodes them
+// to the Fluent Bit records. The offsets are committed only after Fluent Bit accepts the records,
+// so the messages are delivered at least once.
+type TopicReader struct {
+	cfg     *config.InputConfig
+	ctx     context.Context // canceled on exit
+	stop    context.CancelFunc
+	db      *ydb.Driver
+	reader  messageReader
+	start   func(ctx context.Context) (messageReader, error) // starts the reader from the committed offsets
+	msgpack *ugorji.MsgpackHandle
+	encoder *input.FLBEncoder
+	pending []*topicreader.Batch // read batches waiting for Fluent Bit to accept their records
+
+	messages *metrics.Counter
+	invalid  *metrics.Counter
+}
+
+// messageReader is the part of the topic reader of the SDK used by TopicReader.
+type messageReader interface {
+	ReadMessagesBatch(ctx context.Context, opts ...topicreader.ReadBatchOption) (*topicreader.Batch, error)
+	Commit(ctx context.Context, obj topicreader.CommitRangeGetter) error
+	Close(ctx context.Context) error
+}
+
+// messageMeta is the position of the message, added to the record under the metadata key.
+type messageMeta struct {
+	topic      string
+	partition  int64
+	offset     int64
+	producerID string
+	seqNo      int64
+	metadata   map[string][]byte
+}
+
+func NewTopicReader(cfg *config.InputConfig) (*TopicReader, error) {
+	ctx, stop := context.WithCancel(context.Background())
+	r := &TopicReader{
+		cfg:     cfg,
+		ctx:     ctx,
+		stop:    stop,
+		msgpack: &ugorji.MsgpackHandle{},
+		encoder: input.NewEncoder(),
+		messages: metrics.NewCounter("fluentbit_ydb_input_messages_total",
+			"Number of the messages read from the topics.", "consumer", cfg.Consumer),
+		invalid: metrics.NewCounter("fluentbit_ydb_input_invalid_messages_total",
+			"Number of the messages which payload could not be decoded.", "consumer", cfg.Consumer),
+	}
+	r.msgpack.RawToString = true
+
+	initCtx, cancel := context.WithTimeout(ctx, cfg.InitTimeout)
+	defer cancel()
+
+	var err error
+	if r.db, err = storage.OpenDriver(initCtx, cfg.Endpoint); err != nil {
+		return r, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	r.start = r.startReader
+	if r.reader, err = r.start(initCtx); err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+func (r *TopicReader) startReader(ctx context.Context) (messageReader, error) {
+	selectors := make(topicoptions.ReadSelectors, 0, len(r.cfg.Topics))
+	for _, topic := range r.cfg.Topics {
+		selectors = append(selectors, topicoptions.ReadSelector{Path: topic})
+	}
+	reader, err := r.db.Topic().StartReader(r.cfg.Consumer, selectors,
+		topicoptions.WithReaderBatchMaxCount(r.cfg.ReadBatchMaxMessages),
+		topicoptions.WithAddDecoder(topictypes.CodecZstd, func(in io.Reader) (io.Reader, error) {
+			d, err := zstd.NewReader(in)
+			if err != nil {
+				return nil, err
+			}
+
+			return d.IOReadCloser(), nil
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start reader of consumer '%s': %w", r.cfg.Consumer, err)
+	}
+	if err = reader.WaitInit(ctx); err != nil {
+		_ = reader.Close(ctx)
+
+		return nil, fmt.Errorf("failed to start reader of consumer '%s': %w", r.cfg.Consumer, err)
+	}
+
+	return reader, nil
+}
+
+// Collect reads the next batch of the messages, waiting for them up to the read timeout, and returns
+// the msgpack encoded records. It returns nil if there are no messages. After a failure the reader
+// is restarted, so the messages of the failed batch are read again.
+func (r *TopicReader) Collect() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, r.cfg.ReadTimeout)
+	defer cancel()
+
+	batch, err := r.reader.ReadMessagesBatch(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && r.ctx.Err() == nil {
+			return nil, nil
+		}
+
+		return nil, r.restart(fmt.Errorf("failed to read messages: %w", err))
+	}
+
+	data, err := r.encode(batch)
+	if err != nil {
+		return nil, r.restart(err)
+	}
+	r.messages.Add(uint64(len(batch.Messages)))
+	r.pending = append(r.pending, batch)
+
+	return data, nil
+}
+
+// restart replaces the reader after the batch which records are not passed to Fluent Bit. Committing
+// the following batches would skip its messages, so the pending batches are dropped, and the new reader
+// continues from the committed offsets. If the restart fails, the next collect restarts the reader again.
+func (r *TopicReader) restart(cause error) error {
+	if r.ctx.Err() != nil {
+		return cause
+	}
+	log.Warn(fmt.Sprintf("restarting reader of consumer '%s' after failure: %v", r.cfg.Consumer, cause))
+
+	ctx, cancel := context.WithTimeout(r.ctx, r.cfg.InitTimeout)
+	defer cancel()
+
+	r.pending = nil
+	_ = r.reader.Close(ctx)
+	reader, err := r.start(ctx)
+	if err != nil {
+		return errors.Join(cause, err)
+	}
+	r.reader = reader
+
+	return cause
+}
+
+// encode returns the msgpack encoded records of the messages of the batch.
+func (r *TopicReader) encode(batch *topicreader.Batch) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, m := range batch.Messages {
+		data, err := io.ReadAll(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message %d of partition %d of '%s': %w",
+				m.Offset, m.PartitionID(), m.Topic(), err)
+		}
+
+		timestamp := m.CreatedAt
+		if timestamp.IsZero() {
+			timestamp = m.WrittenAt
+		}
+		record := r.record(data, messageMeta{
+			topic:      m.Topic(),
+			partition:  m.PartitionID(),
+			offset:     m.Offset,
+			producerID: m.ProducerID,
+			seqNo:      m.SeqNo,
+			metadata:   m.Metadata,
+		})
+		packed, err := r.encoder.Encode([]interface{}{input.FLBTime{Time: timestamp}, record})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode message %d of partition %d of '%s': %w",
+				m.Offset, m.PartitionID(), m.Topic(), err)
+		}
+		buf.Write(packed)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Accepted commits the offsets of the batches which records were accepted by Fluent Bit.
+func (r *TopicReader) Accepted() error {
+	for len(r.pending) > 0 {
+		if err := r.reader.Commit(r.ctx, r.pending[0]); err != nil {
+			return fmt.Errorf("failed to commit offsets: %w", err)
+		}
+		r.pending = r.pending[1:]
+	}
+
+	return nil
+}
+
+// record decodes the payload to the record fields. The payloads which are not the objects of the format
+// are passed as the 'message' field.
+func (r *TopicReader) record(data []byte, meta messageMeta) map[string]interface{} {
+	record, err := r.decode(data)
+	if err != nil {
+		r.invalid.Inc()
+		log.Debug(fmt.Sprintf("message %d of partition %d of '%s' is not a %s object: %v",
+			meta.offset, meta.partition, meta.topic, r.cfg.Format, err))
+		record = map[string]interface{}{"message": data}
+	}
+
+	position := map[string]interface{}{
+		"topic":       meta.topic,
+		"partition":   meta.partition,
+		"offset":      meta.offset,
+		"producer_id": meta.producerID,
+		"seq_no":      meta.seqNo,
+	}
+	if len(meta.metadata) > 0 {
+		metadata := make(map[string]interface{}, len(meta.metadata))
+		for k, v := range meta.metadata {
+			metadata[k] = string(v)
+		}
+		position["metadata"] = metadata
+	}
+	record[r.cfg.MetadataKey] = position
+
+	return record
+}
+
+func (r *TopicReader) decode(data []byte) (map[string]interface{}, error) {
+	var record map[string]interface{}
+	if r.cfg.Format == config.TopicFormatMsgpack {
+		if err := ugorji.NewDecoderBytes(data, r.msgpack).Decode(&record); err != nil {
+			return nil, err
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&record); err != nil {
+			return nil, err
+		}
+		for k, v := range record {
+			record[k] = jsonValue(v)
+		}
+	}
+	if record == nil {
+		return nil, errors.New("null payload")
+	}
+
+	return record, nil
+}
+
+// jsonValue converts the JSON numbers to the integers if they are, and to the floats otherwise.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+
+		return f
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = jsonValue(item)
+		}
+
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonValue(item)
+		}
+
+		return v
+	default:
+		return v
+	}
+}
+
+// Exit stops reading, the offsets of the records not accepted by Fluent Bit are not committed.
+func (r *TopicReader) Exit(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	r.stop()
+	var errs []error
+	if r.reader != nil {
+		if err := r.reader.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close reader: %w", err))
+		}
+	}
+	if r.db != nil {
+		if err := r.db.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close connection: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
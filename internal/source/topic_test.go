@@ -0,0 +1,168 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/input"
+	"github.com/stretchr/testify/require"
+	ugorji "github.com/ugorji/go/codec"
+	"github.com/ydb-platform/ydb-go-sdk/v3/testutil"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicreader"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
+)
+
+func testReader(format string) *TopicReader {
+	r := &TopicReader{
+		cfg:     &config.InputConfig{Format: format, MetadataKey: config.DefaultMetadataKey},
+		msgpack: &ugorji.MsgpackHandle{},
+		invalid: metrics.NewCounter("test_invalid_messages_total", "", "format", format),
+	}
+	r.msgpack.RawToString = true
+
+	return r
+}
+
+func TestRecordJSON(t *testing.T) {
+	r := testReader(config.TopicFormatJSON)
+	meta := messageMeta{
+		topic:      "logs",
+		partition:  2,
+		offset:     10,
+		producerID: "agent-1",
+		seqNo:      5,
+		metadata:   map[string][]byte{"tag": []byte("app")},
+	}
+
+	record := r.record([]byte(`{"level": "info", "code": 200, "ratio": 0.5, "nested": {"n": [1, 2.5]}}`), meta)
+	require.Equal(t, "info", record["level"])
+	require.Equal(t, int64(200), record["code"])
+	require.InDelta(t, 0.5, record["ratio"], 0)
+	require.Equal(t, map[string]interface{}{"n": []interface{}{int64(1), 2.5}}, record["nested"])
+	require.Equal(t, map[string]interface{}{
+		"topic":       "logs",
+		"partition":   int64(2),
+		"offset":      int64(10),
+		"producer_id": "agent-1",
+		"seq_no":      int64(5),
+		"metadata":    map[string]interface{}{"tag": "app"},
+	}, record[config.DefaultMetadataKey])
+	require.Zero(t, r.invalid.Value())
+}
+
+func TestRecordMsgpack(t *testing.T) {
+	r := testReader(config.TopicFormatMsgpack)
+
+	var data []byte
+	require.NoError(t, ugorji.NewEncoderBytes(&data, &ugorji.MsgpackHandle{}).Encode(map[string]interface{}{
+		"message": "started",
+		"pid":     42,
+	}))
+
+	record := r.record(data, messageMeta{topic: "logs"})
+	require.Equal(t, "started", record["message"])
+	require.EqualValues(t, 42, record["pid"])
+	require.NotContains(t, record[config.DefaultMetadataKey], "metadata")
+}
+
+func TestRecordInvalid(t *testing.T) {
+	r := testReader(config.TopicFormatJSON)
+
+	for _, data := range []string{"plain text", "null", "[1, 2]"} {
+		record := r.record([]byte(data), messageMeta{topic: "logs"})
+		require.Equal(t, []byte(data), record["message"])
+		require.Contains(t, record, config.DefaultMetadataKey)
+	}
+	require.Equal(t, uint64(3), r.invalid.Value())
+}
+
+// fakeReader returns the queued batches and errors, and records the committed batches.
+type fakeReader struct {
+	reads     []interface{} // *topicreader.Batch or error
+	commitErr error
+	committed []*topicreader.Batch
+	closed    bool
+}
+
+func (f *fakeReader) ReadMessagesBatch(ctx context.Context, _ ...topicreader.ReadBatchOption) (
+	*topicreader.Batch, error,
+) {
+	if f.closed {
+		return nil, errors.New("reader is closed")
+	}
+	if len(f.reads) == 0 {
+		<-ctx.Done()
+
+		return nil, ctx.Err()
+	}
+	read := f.reads[0]
+	f.reads = f.reads[1:]
+	if err, ok := read.(error); ok {
+		return nil, err
+	}
+
+	return read.(*topicreader.Batch), nil
+}
+
+func (f *fakeReader) Commit(_ context.Context, obj topicreader.CommitRangeGetter) error {
+	if f.commitErr != nil {
+		return f.commitErr
+	}
+	f.committed = append(f.committed, obj.(*topicreader.Batch))
+
+	return nil
+}
+
+func (f *fakeReader) Close(context.Context) error {
+	f.closed = true
+
+	return nil
+}
+
+func testBatch(offset int64) *topicreader.Batch {
+	return &topicreader.Batch{Messages: []*topicreader.Message{
+		testutil.NewTopicReaderMessageBuilder().Topic("logs").Offset(offset).
+			DataAndUncompressedSize([]byte(`{"level": "info"}`)).Build(),
+	}}
+}
+
+func TestCollectRestart(t *testing.T) {
+	first, second := testBatch(1), testBatch(2)
+	old := &fakeReader{reads: []interface{}{first, errors.New("session is lost")}}
+	restarted := &fakeReader{reads: []interface{}{second}}
+
+	r := testReader(config.TopicFormatJSON)
+	r.ctx = context.Background()
+	r.cfg.ReadTimeout = time.Second
+	r.cfg.InitTimeout = time.Second
+	r.encoder = input.NewEncoder()
+	r.messages = metrics.NewCounter("test_messages_total", "", "test", "restart")
+	r.reader = old
+	r.start = func(context.Context) (messageReader, error) {
+		return restarted, nil
+	}
+
+	data, err := r.Collect()
+	require.NoError(t, err)
+	require.NotEmpty(t, data)
+	old.commitErr = errors.New("commit failed")
+	require.Error(t, r.Accepted())
+
+	// the batch is not passed to Fluent Bit, so the reader is restarted from the committed offsets
+	_, err = r.Collect()
+	require.Error(t, err)
+	require.True(t, old.closed)
+	require.Empty(t, r.pending)
+
+	data, err = r.Collect()
+	require.NoError(t, err)
+	require.NotEmpty(t, data)
+	require.NoError(t, r.Accepted())
+	require.Equal(t, []*topicreader.Batch{second}, restarted.committed)
+	require.Empty(t, old.committed)
+	require.Equal(t, uint64(2), r.messages.Value())
+}
@@ -0,0 +1,320 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+// batch accumulates the converted rows of several flushes.
+type batch struct {
+	target  *target       // the rows are written to the target
+	mapping *fieldMapping // the rows are converted with the mapping
+	events  []*model.Event
+	rows    []row
+	sizes   []int
+	bytes   int
+	created time.Time
+	waiters []chan error // flushes waiting for the batch to be written (ack after write)
+	spooled []string     // spool files holding the events of the batch (ack on buffer)
+}
+
+func (b *batch) append(events []*model.Event, rows []row, sizes []int) {
+	b.events = append(b.events, events...)
+	b.rows = append(b.rows, rows...)
+	b.sizes = append(b.sizes, sizes...)
+	for _, size := range sizes {
+		b.bytes += bytesValueSize(size)
+	}
+}
+
+// batcher merges the rows of consecutive flushes and writes them when the batch reaches
+// the rows, bytes or age threshold.
+//
+// Without the spool each flush is acknowledged after the batch containing it is written, so a batch
+// merges only the flushes running concurrently: with a single worker of Fluent Bit it holds one flush.
+// With the spool the flushed events are stored to disk first, and the flush is acknowledged
+// immediately. The spool files are removed after the batch is written, the files which were
+// left by failed writes or by the previous run are loaded back into the following batches.
+type batcher struct {
+	mu      sync.Mutex
+	current *batch
+	timer   *time.Timer
+	orphans []string // spool files which are not in memory
+	closed  bool     // the rows are written without batching on shutdown
+
+	maxRows  int
+	maxBytes int
+	maxAge   time.Duration
+	spool    *fileFallback
+
+	convert func(t *target, events []*model.Event) (*fieldMapping, []row, []int, error)
+	write   func(t *target, mapping *fieldMapping, events []*model.Event, rows []row, sizes []int) error
+	active  func() *target
+}
+
+func newBatcher(
+	maxRows, maxBytes int, maxAge time.Duration, spool *fileFallback,
+	active func() *target,
+	convert func(t *target, events []*model.Event) (*fieldMapping, []row, []int, error),
+	write func(t *target, mapping *fieldMapping, events []*model.Event, rows []row, sizes []int) error,
+) (*batcher, error) {
+	b := &batcher{
+		current:  &batch{},
+		maxRows:  maxRows,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		spool:    spool,
+		active:   active,
+		convert:  convert,
+		write:    write,
+	}
+
+	if spool != nil {
+		orphans, err := spool.list()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list batch spool: %w", err)
+		}
+		if len(orphans) > 0 {
+			log.Info(fmt.Sprintf("found %d batch spool files of the previous run", len(orphans)))
+		}
+		b.orphans = orphans
+		b.reload()
+	}
+
+	return b, nil
+}
+
+// add puts the rows of the flush, converted with the mapping of the target, into the current batch.
+// The batch holding the rows for another target or mapping is written first.
+func (b *batcher) add(t *target, mapping *fieldMapping, events []*model.Event, rows []row, sizes []int) error {
+	var (
+		spooled string
+		done    chan error
+	)
+	if b.spool != nil {
+		name, err := b.spool.write(events)
+		if err != nil {
+			return fmt.Errorf("failed to spool batched events: %w", err)
+		}
+		spooled = name
+	} else {
+		done = make(chan error, 1)
+	}
+
+	b.mu.Lock()
+	previous := b.switchTo(t, mapping)
+	current := b.current
+	b.start(current)
+	current.append(events, rows, sizes)
+	if done != nil {
+		current.waiters = append(current.waiters, done)
+	}
+	if spooled != "" {
+		current.spooled = append(current.spooled, spooled)
+	}
+	full := b.closed || b.isFull(current)
+	if full {
+		b.detach()
+	}
+	b.mu.Unlock()
+
+	if previous != nil {
+		b.flush(previous)
+	}
+	if full {
+		b.flush(current)
+	}
+
+	if done == nil {
+		return nil
+	}
+
+	return <-done
+}
+
+// switchTo makes the current batch to hold the rows for the target converted with the mapping.
+// It returns the detached batch with the rows for another target or mapping, which should be written.
+// Must be called with the lock held.
+func (b *batcher) switchTo(t *target, mapping *fieldMapping) *batch {
+	var previous *batch
+	if current := b.current; len(current.rows) > 0 && (current.target != t || current.mapping != mapping) {
+		previous = current
+		b.detach()
+	}
+	b.current.target, b.current.mapping = t, mapping
+
+	return previous
+}
+
+// start arms the age threshold when the first rows come into the batch. Must be called with the lock held.
+func (b *batcher) start(current *batch) {
+	if len(current.rows) > 0 {
+		return
+	}
+
+	current.created = time.Now()
+	if b.maxAge > 0 {
+		b.timer = time.AfterFunc(b.maxAge, func() { b.flushExpired(current) })
+	}
+}
+
+func (b *batcher) isFull(current *batch) bool {
+	return (b.maxRows > 0 && len(current.rows) >= b.maxRows) ||
+		(b.maxBytes > 0 && current.bytes >= b.maxBytes)
+}
+
+// detach replaces the current batch with an empty one. Must be called with the lock held.
+func (b *batcher) detach() {
+	b.current = &batch{}
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+func (b *batcher) flushExpired(expired *batch) {
+	b.mu.Lock()
+	if b.current != expired {
+		b.mu.Unlock()
+
+		return
+	}
+	b.detach()
+	b.mu.Unlock()
+
+	b.flush(expired)
+}
+
+// close writes the current batch regardless of the thresholds, and makes the following
+// flushes to be written immediately, so none of them waits for a batch on shutdown.
+func (b *batcher) close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+
+	return b.flushAll()
+}
+
+// flushAll writes the current batch regardless of the thresholds.
+func (b *batcher) flushAll() error {
+	b.mu.Lock()
+	current := b.current
+	b.detach()
+	b.mu.Unlock()
+
+	if len(current.rows) == 0 {
+		return nil
+	}
+
+	return b.flush(current)
+}
+
+func (b *batcher) flush(current *batch) error {
+	log.Debug(fmt.Sprintf("writing batch of %d rows (%d bytes), collected in %s",
+		len(current.rows), current.bytes, time.Since(current.created)))
+
+	err := b.write(current.target, current.mapping, current.events, current.rows, current.sizes)
+	for _, done := range current.waiters {
+		done <- err
+	}
+
+	if b.spool == nil {
+		return err
+	}
+
+	if err != nil {
+		log.Error(fmt.Sprintf("failed to write batch of %d rows, keeping %d spool files: %v",
+			len(current.rows), len(current.spooled), err))
+		b.mu.Lock()
+		b.orphans = append(b.orphans, current.spooled...)
+		b.mu.Unlock()
+
+		return err
+	}
+
+	for _, name := range current.spooled {
+		if removeErr := b.spool.remove(name); removeErr != nil {
+			log.Warn(fmt.Sprintf("failed to remove batch spool file: %v", removeErr))
+		}
+	}
+
+	b.reload()
+
+	return nil
+}
+
+// reload puts the events of the orphaned spool files into the current batch, oldest first,
+// until the batch reaches the rows or bytes threshold. The rest is reloaded after the following writes.
+// The files which cannot be loaded are moved aside, so they are not loaded again, and are kept
+// for the manual recovery. If a file cannot be moved, it is loaded again after the next write.
+func (b *batcher) reload() {
+	for {
+		b.mu.Lock()
+		if len(b.orphans) == 0 || (len(b.current.rows) > 0 && b.isFull(b.current)) {
+			b.mu.Unlock()
+
+			return
+		}
+		name := b.orphans[0]
+		b.orphans = b.orphans[1:]
+		b.mu.Unlock()
+
+		err := b.load(name)
+		if err == nil {
+			continue
+		}
+		failed, moveErr := b.spool.quarantine(name)
+		if moveErr == nil {
+			log.Error(fmt.Sprintf("failed to reload batch spool file '%s', moved it to '%s': %v", name, failed, err))
+
+			continue
+		}
+		log.Error(fmt.Sprintf("failed to reload batch spool file '%s', retrying after the next write: %v",
+			name, errors.Join(err, moveErr)))
+		b.mu.Lock()
+		b.orphans = append(b.orphans, name)
+		b.mu.Unlock()
+
+		return
+	}
+}
+
+// load puts the events of the spool file into the current batch.
+func (b *batcher) load(name string) error {
+	events, err := b.spool.load(name)
+	if err != nil {
+		return err
+	}
+	t := b.active()
+	mapping, rows, sizes, err := b.convert(t, events)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	previous := b.switchTo(t, mapping)
+	current := b.current
+	b.start(current)
+	current.append(events, rows, sizes)
+	current.spooled = append(current.spooled, name)
+	b.mu.Unlock()
+
+	if previous != nil {
+		b.flush(previous)
+	}
+
+	return nil
+}
+
+// orphanCount returns the number of spool files which are not written yet.
+func (b *batcher) orphanCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.orphans)
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+type batchWrites struct {
+	mu      sync.Mutex
+	batches [][]*model.Event
+	err     error
+}
+
+func (w *batchWrites) write(_ *target, _ *fieldMapping, events []*model.Event, _ []row, _ []int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.batches = append(w.batches, events)
+
+	return w.err
+}
+
+func (w *batchWrites) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.batches)
+}
+
+func convertEvents(events []*model.Event) ([]row, []int, error) {
+	rows := make([]row, len(events))
+	sizes := make([]int, len(events))
+	for i, event := range events {
+		rows[i] = row{value: types.TextValue(event.Metadata)}
+		sizes[i] = len(event.Metadata)
+	}
+
+	return rows, sizes, nil
+}
+
+func noTarget() *target {
+	return nil
+}
+
+func convertFor(_ *target, events []*model.Event) (*fieldMapping, []row, []int, error) {
+	rows, sizes, err := convertEvents(events)
+
+	return nil, rows, sizes, err
+}
+
+func addEvents(t *testing.T, b *batcher, tags ...string) error {
+	t.Helper()
+
+	events := make([]*model.Event, len(tags))
+	for i, tag := range tags {
+		events[i] = &model.Event{Metadata: tag, Message: map[string]interface{}{}}
+	}
+	rows, sizes, err := convertEvents(events)
+	require.NoError(t, err)
+
+	return b.add(nil, nil, events, rows, sizes)
+}
+
+func TestBatcherAckAfterWrite(t *testing.T) {
+	writes := &batchWrites{}
+	b, err := newBatcher(3, 0, time.Hour, nil, noTarget, convertFor, writes.write)
+	require.NoError(t, err)
+
+	var (
+		wg     sync.WaitGroup
+		addErr error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		addErr = addEvents(t, b, "a", "b")
+	}()
+
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		return len(b.current.rows) == 2
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 0, writes.count())
+
+	require.NoError(t, addEvents(t, b, "c"))
+	wg.Wait()
+	require.NoError(t, addErr)
+
+	require.Equal(t, 1, writes.count())
+	require.Len(t, writes.batches[0], 3)
+}
+
+func TestBatcherMaxAge(t *testing.T) {
+	writes := &batchWrites{err: errors.New("unavailable")}
+	b, err := newBatcher(0, 0, 10*time.Millisecond, nil, noTarget, convertFor, writes.write)
+	require.NoError(t, err)
+
+	require.Error(t, addEvents(t, b, "a"))
+	require.Equal(t, 1, writes.count())
+}
+
+func TestBatcherSpool(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := newFileFallback(dir)
+	require.NoError(t, err)
+
+	writes := &batchWrites{err: errors.New("unavailable")}
+	b, err := newBatcher(0, 0, time.Hour, spool, noTarget, convertFor, writes.write)
+	require.NoError(t, err)
+
+	require.NoError(t, addEvents(t, b, "a", "b"))
+	require.Equal(t, 0, writes.count())
+	require.Error(t, b.flushAll())
+	require.Equal(t, 1, b.orphanCount())
+
+	// the next run loads the events left in the spool
+	writes = &batchWrites{}
+	b, err = newBatcher(0, 0, time.Hour, spool, noTarget, convertFor, writes.write)
+	require.NoError(t, err)
+	require.NoError(t, b.flushAll())
+	require.Equal(t, 1, writes.count())
+	require.Len(t, writes.batches[0], 2)
+	require.Equal(t, "b", writes.batches[0][1].Metadata)
+
+	names, err := spool.list()
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestBatcherReloadAll(t *testing.T) {
+	spool, err := newFileFallback(t.TempDir())
+	require.NoError(t, err)
+	for _, tag := range []string{"a", "b", "c"} {
+		_, err = spool.write([]*model.Event{{Metadata: tag, Message: map[string]interface{}{}}})
+		require.NoError(t, err)
+	}
+
+	// the orphans are loaded up to the rows threshold
+	writes := &batchWrites{}
+	b, err := newBatcher(2, 0, time.Hour, spool, noTarget, convertFor, writes.write)
+	require.NoError(t, err)
+	require.Equal(t, 1, b.orphanCount())
+
+	// the write of the full batch loads the rest
+	require.NoError(t, addEvents(t, b, "d"))
+	require.Equal(t, 1, writes.count())
+	require.Len(t, writes.batches[0], 3)
+	require.Equal(t, 0, b.orphanCount())
+
+	require.NoError(t, b.flushAll())
+	require.Equal(t, 2, writes.count())
+	require.Len(t, writes.batches[1], 1)
+	require.Equal(t, "c", writes.batches[1][0].Metadata)
+}
+
+func TestBatcherReloadFailure(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := newFileFallback(dir)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1-1.jsonl"), []byte("{broken"), 0o600))
+	_, err = spool.write([]*model.Event{{Metadata: "a", Message: map[string]interface{}{}}})
+	require.NoError(t, err)
+
+	// the broken file is moved aside, and the next one is loaded
+	writes := &batchWrites{}
+	b, err := newBatcher(0, 0, time.Hour, spool, noTarget, convertFor, writes.write)
+	require.NoError(t, err)
+	require.Equal(t, 0, b.orphanCount())
+	require.FileExists(t, filepath.Join(dir, "1-1.jsonl.failed"))
+
+	require.NoError(t, b.flushAll())
+	require.Equal(t, 1, writes.count())
+	require.Equal(t, "a", writes.batches[0][0].Metadata)
+
+	names, err := spool.list()
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestBatcherMappingChange(t *testing.T) {
+	writes := &batchWrites{}
+	b, err := newBatcher(10, 0, time.Hour, nil, noTarget, convertFor, writes.write)
+	require.NoError(t, err)
+
+	var (
+		active = &target{}
+		old    = testMapping()
+		fresh  = testMapping("message")
+		added  = make(chan error, 1)
+		events = []*model.Event{{Metadata: "a", Message: map[string]interface{}{}}}
+	)
+	rows, _, err := convertEvents(events)
+	require.NoError(t, err)
+
+	go func() { added <- b.add(active, old, events, rows, []int{1}) }()
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		return len(b.current.rows) == 1
+	}, time.Second, time.Millisecond)
+
+	// the rows converted with the refreshed mapping are not written with the old one
+	go func() { _ = b.add(active, fresh, events, rows, []int{1}) }()
+	require.NoError(t, <-added)
+	require.Equal(t, 1, writes.count())
+
+	b.mu.Lock()
+	require.Same(t, fresh, b.current.mapping)
+	b.mu.Unlock()
+	require.NoError(t, b.flushAll())
+}
+
+func TestBatcherClose(t *testing.T) {
+	writes := &batchWrites{}
+	b, err := newBatcher(100, 0, time.Hour, nil, noTarget, convertFor, writes.write)
+	require.NoError(t, err)
+
+	require.NoError(t, b.close())
+	require.Equal(t, 0, writes.count())
+
+	// after close the flushes are written without waiting for the batch
+	require.NoError(t, addEvents(t, b, "a"))
+	require.Equal(t, 1, writes.count())
+}
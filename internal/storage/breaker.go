@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
+)
+
+// ErrCircuitOpen is returned without trying to write while YDB is considered unavailable.
+var ErrCircuitOpen = fmt.Errorf("circuit breaker is open: %w", ErrRetryLater)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// breaker stops the writes after a series of consecutive retryable failures, so the flushes fail
+// fast during the outage instead of waiting for the timeouts. After the open timeout a single
+// probe flush is let through: its success closes the breaker, its failure opens it again.
+type breaker struct {
+	mu          sync.Mutex
+	state       breakerState
+	failures    int
+	threshold   int
+	openTimeout time.Duration
+	openedAt    time.Time
+	probing     bool
+
+	stateGauge *metrics.Gauge
+}
+
+// newBreaker returns nil if the threshold is not configured.
+func newBreaker(threshold int, openTimeout time.Duration, table string) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+
+	return &breaker{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		stateGauge: metrics.NewGauge("fluentbit_ydb_circuit_breaker_state",
+			"State of the circuit breaker: 0 - closed, 1 - open, 2 - half-open.", "table", table),
+	}
+}
+
+// allow reports whether the write may be sent to YDB.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+
+		return true
+	default:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+
+		return true
+	}
+}
+
+// record accounts the result of the write sent to YDB.
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if isLocalError(err) {
+		// the probe has not reached YDB, let the next write probe it
+		b.probing = false
+
+		return
+	}
+
+	if !IsRetryable(err) {
+		// YDB has answered, so it is available
+		b.failures = 0
+		b.probing = false
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen:
+		b.probing = false
+		b.open()
+	case b.state == breakerClosed && b.failures >= b.threshold:
+		b.open()
+	}
+}
+
+// reset closes the breaker after the writes are switched to another database.
+func (b *breaker) reset() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != breakerClosed {
+		b.setState(breakerClosed)
+	}
+}
+
+// open must be called with the lock held.
+func (b *breaker) open() {
+	b.openedAt = time.Now()
+	b.setState(breakerOpen)
+}
+
+// setState must be called with the lock held.
+func (b *breaker) setState(state breakerState) {
+	if state == breakerClosed {
+		log.Info(fmt.Sprintf("circuit breaker is %s (was %s), YDB has answered", state, b.state))
+	} else {
+		log.Warn(fmt.Sprintf("circuit breaker is %s (was %s) after %d consecutive failures", state, b.state, b.failures))
+	}
+	b.state = state
+	b.stateGauge.Set(float64(state))
+}
+
+// isLocalError reports whether the write was not sent to YDB because of the plugin's own limits.
+func isLocalError(err error) bool {
+	return errors.Is(err, ErrQueueTimeout) ||
+		errors.Is(err, ErrQuotaExceeded) ||
+		errors.Is(err, errQuotaSpool) ||
+		errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, ErrShuttingDown)
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	unavailable := fmt.Errorf("unavailable: %w", ErrRetryLater)
+	b := newBreaker(2, time.Hour, "test")
+
+	b.record(unavailable)
+	require.True(t, b.allow())
+	b.record(ErrQueueTimeout)
+	require.True(t, b.allow())
+
+	b.record(unavailable)
+	require.Equal(t, breakerOpen, b.state)
+	require.False(t, b.allow())
+
+	// a single probe after the open timeout
+	b.openedAt = time.Now().Add(-time.Hour)
+	require.True(t, b.allow())
+	require.False(t, b.allow())
+	require.Equal(t, breakerHalfOpen, b.state)
+
+	b.record(unavailable)
+	require.Equal(t, breakerOpen, b.state)
+	require.False(t, b.allow())
+
+	b.openedAt = time.Now().Add(-time.Hour)
+	require.True(t, b.allow())
+	b.record(errors.New("bad request"))
+	require.Equal(t, breakerClosed, b.state)
+	require.True(t, b.allow())
+	require.InDelta(t, 0, b.stateGauge.Value(), 0)
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newBreaker(0, time.Hour, "test")
+
+	require.Nil(t, b)
+	b.record(ErrRetryLater)
+	require.True(t, b.allow())
+}
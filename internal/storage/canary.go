@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ydb-platform/ydb-go-genproto/protos/Ydb"
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	grpcCodes "google.golang.org/grpc/codes"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+// canaryTag is the input stream name of the canary record.
+const canaryTag = "fluent-bit-ydb.canary"
+
+// canary converts a synthetic record and writes it to the table, so the permission problems
+// and the mismatches of the column types are reported at startup instead of the first flush.
+func (s *YDB) canary(ctx context.Context, t *target) error {
+	tablePath := t.table
+	mapping := t.mapping.load()
+	if s.cfg.CanaryTable != "" {
+		tablePath = s.cfg.CanaryTable
+
+		var err error
+		if mapping, err = s.resolveFieldMapping(ctx, t.db, tablePath); err != nil {
+			return fmt.Errorf("canary table does not match the columns mapping: %w", err)
+		}
+	}
+	fullPath := path.Join(t.db.Name(), tablePath)
+
+	events := []*model.Event{{
+		Timestamp: time.Now(),
+		Metadata:  canaryTag,
+		Message:   map[string]interface{}{},
+	}}
+	rows, _, err := s.convertRows(mapping, events)
+	if err != nil {
+		return fmt.Errorf("canary record cannot be converted to the row of table '%s', "+
+			"check the types of the mapped columns: %w", fullPath, err)
+	}
+
+	writeCtx, cancel := context.WithTimeout(ctx, s.cfg.WriteTimeout)
+	defer cancel()
+
+	if err = s.writeList(writeCtx, t, fullPath, mapping, rows); err != nil {
+		return fmt.Errorf("canary write to table '%s' failed, %s: %w", fullPath, diagnose(err), err)
+	}
+	log.Info(fmt.Sprintf("canary record is written to table '%s'", fullPath))
+
+	if !s.cfg.CanaryDelete {
+		return nil
+	}
+
+	if mapping.layout != nil {
+		// the rows to delete are passed as the list of the structs
+		if rows, _, err = s.convertRows(&fieldMapping{columns: mapping.columns}, events); err != nil {
+			return fmt.Errorf("failed to delete canary record from table '%s': %w", fullPath, err)
+		}
+	}
+	if err = deleteRows(writeCtx, t.db, fullPath, structList(rows)); err != nil {
+		return fmt.Errorf("failed to delete canary record from table '%s', %s: %w", fullPath, diagnose(err), err)
+	}
+
+	return nil
+}
+
+// diagnose explains the probable cause of the write failure.
+func diagnose(err error) string {
+	if op := ydb.OperationError(err); op != nil {
+		return diagnoseStatus(Ydb.StatusIds_StatusCode(op.Code()))
+	}
+	if ydb.IsTransportError(err, grpcCodes.PermissionDenied, grpcCodes.Unauthenticated) {
+		return diagnoseStatus(Ydb.StatusIds_UNAUTHORIZED)
+	}
+
+	return diagnoseStatus(Ydb.StatusIds_STATUS_CODE_UNSPECIFIED)
+}
+
+// diagnoseStatus explains the probable cause of the operation failed with the status.
+func diagnoseStatus(status Ydb.StatusIds_StatusCode) string {
+	switch status {
+	case Ydb.StatusIds_UNAUTHORIZED:
+		return "check that the credentials have the permission to modify the table rows"
+	case Ydb.StatusIds_SCHEME_ERROR, Ydb.StatusIds_BAD_REQUEST:
+		return "check that the table schema matches the columns mapping, including the NOT NULL columns"
+	case Ydb.StatusIds_NOT_FOUND:
+		return "check that the table exists"
+	default:
+		return "check that the database is available"
+	}
+}
+
+// deleteRows deletes the rows by the primary key of the table.
+func deleteRows(ctx context.Context, db *ydb.Driver, fullPath string, rows types.Value) error {
+	return db.Table().Do(ctx, func(ctx context.Context, session table.Session) error {
+		desc, err := session.DescribeTable(ctx, fullPath)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = session.Execute(ctx, table.DefaultTxControl(), deleteQuery(fullPath, rows.Type(), desc.PrimaryKey),
+			table.NewQueryParameters(table.ValueParam("$rows", rows)))
+
+		return err
+	}, table.WithIdempotent())
+}
+
+// deleteQuery returns the query deleting the rows of the list type by the primary key.
+func deleteQuery(fullPath string, rowsType types.Type, primaryKey []string) string {
+	return fmt.Sprintf("DECLARE $rows AS %s;\nDELETE FROM `%s` ON SELECT %s FROM AS_TABLE($rows);",
+		rowsType.Yql(), fullPath, "`"+strings.Join(primaryKey, "`, `")+"`")
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-genproto/protos/Ydb"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	grpcCodes "google.golang.org/grpc/codes"
+	grpcStatus "google.golang.org/grpc/status"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+func TestDiagnose(t *testing.T) {
+	permission := "check that the credentials have the permission to modify the table rows"
+
+	require.Equal(t, permission, diagnoseStatus(Ydb.StatusIds_UNAUTHORIZED))
+	require.Equal(t, "check that the table schema matches the columns mapping, including the NOT NULL columns",
+		diagnoseStatus(Ydb.StatusIds_SCHEME_ERROR))
+	require.Equal(t, diagnoseStatus(Ydb.StatusIds_SCHEME_ERROR), diagnoseStatus(Ydb.StatusIds_BAD_REQUEST))
+	require.Equal(t, "check that the table exists", diagnoseStatus(Ydb.StatusIds_NOT_FOUND))
+	require.Equal(t, "check that the database is available", diagnoseStatus(Ydb.StatusIds_UNAVAILABLE))
+
+	denied := fmt.Errorf("bulk upsert: %w", grpcStatus.Error(grpcCodes.PermissionDenied, "access denied"))
+	require.Equal(t, permission, diagnose(denied))
+	require.Equal(t, permission, diagnose(grpcStatus.Error(grpcCodes.Unauthenticated, "no token")))
+	require.Equal(t, "check that the database is available",
+		diagnose(grpcStatus.Error(grpcCodes.Unavailable, "connection refused")))
+	require.Equal(t, "check that the database is available", diagnose(errors.New("timeout")))
+}
+
+func TestDeleteQuery(t *testing.T) {
+	s := &YDB{}
+	rows, _, err := s.convertRows(testMapping("message"), []*model.Event{{
+		Timestamp: time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC),
+		Metadata:  canaryTag,
+		Message:   map[string]interface{}{},
+	}})
+	require.NoError(t, err)
+
+	list := structList(rows)
+	require.Equal(t, types.List(types.Struct(
+		types.StructField("input", types.TypeText),
+		types.StructField("message", types.Optional(types.TypeText)),
+		types.StructField("timestamp", types.TypeTimestamp),
+	)), list.Type())
+
+	require.Equal(t, "DECLARE $rows AS List<Struct<'input':Utf8,'message':Optional<Utf8>,'timestamp':Timestamp>>;\n"+
+		"DELETE FROM `/local/logs` ON SELECT `timestamp`, `input` FROM AS_TABLE($rows);",
+		deleteQuery("/local/logs", list.Type(), []string{"timestamp", "input"}))
+}
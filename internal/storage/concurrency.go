@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+)
+
+// ErrQueueTimeout is returned when a portion waits too long for a free BulkUpsert slot.
+var ErrQueueTimeout = fmt.Errorf("timeout waiting for a free BulkUpsert slot: %w", ErrRetryLater)
+
+// The BulkUpsert slots are shared by all the plugin instances and Fluent Bit workers of the process.
+var (
+	upsertSlotsMu   sync.Mutex
+	upsertSlots     *semaphore.Weighted
+	upsertSlotsSize int
+)
+
+// sharedUpsertSlots returns the process-wide semaphore limiting the concurrent BulkUpsert calls.
+// The limit is defined by the first instance configuring it, nil means no limit.
+func sharedUpsertSlots(size int) *semaphore.Weighted {
+	if size <= 0 {
+		return nil
+	}
+
+	upsertSlotsMu.Lock()
+	defer upsertSlotsMu.Unlock()
+
+	if upsertSlots == nil {
+		upsertSlots = semaphore.NewWeighted(int64(size))
+		upsertSlotsSize = size
+	} else if upsertSlotsSize != size {
+		log.Warn(fmt.Sprintf("global BulkUpsert concurrency is already limited to %d, ignoring limit %d",
+			upsertSlotsSize, size))
+	}
+
+	return upsertSlots
+}
+
+// queueContext limits the time to wait for the write, zero timeout means no limit.
+func queueContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+
+	return context.WithCancel(parent)
+}
+
+// acquireUpsertSlot waits for a free BulkUpsert slot until the context is done.
+// The returned function releases the slot.
+func acquireUpsertSlot(ctx context.Context, slots *semaphore.Weighted) (func(), error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	if err := slots.Acquire(ctx, 1); err != nil {
+		return nil, ErrQueueTimeout
+	}
+
+	return func() { slots.Release(1) }, nil
+}
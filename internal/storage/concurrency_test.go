@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/semaphore"
+)
+
+func TestAcquireUpsertSlotTimeout(t *testing.T) {
+	slots := semaphore.NewWeighted(1)
+
+	ctx, cancel := queueContext(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	release, err := acquireUpsertSlot(ctx, slots)
+	require.NoError(t, err)
+
+	_, err = acquireUpsertSlot(ctx, slots)
+	require.ErrorIs(t, err, ErrQueueTimeout)
+	require.True(t, IsRetryable(err))
+
+	release()
+
+	release, err = acquireUpsertSlot(context.Background(), slots)
+	require.NoError(t, err)
+	release()
+}
+
+func TestAcquireUpsertSlotUnlimited(t *testing.T) {
+	release, err := acquireUpsertSlot(context.Background(), nil)
+	require.NoError(t, err)
+	release()
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/pkg/codec"
+	"github.com/ydb-platform/fluent-bit-ydb/pkg/fieldcrypt"
+)
+
+// columnEncoder transforms the values of a Bytes column before they are written. The value is compressed
+// first, as the encrypted values do not compress, and then encrypted.
+type columnEncoder struct {
+	codec   *codec.Encoder      // nil if the column is not compressed
+	keyring *fieldcrypt.Keyring // nil if the column is not encrypted
+}
+
+// newColumnEncoders creates the encoders of the compressed and the encrypted columns.
+func newColumnEncoders(cfg *config.Config) (map[string]*columnEncoder, error) {
+	encoders := make(map[string]*columnEncoder)
+	get := func(column string) *columnEncoder {
+		if encoders[column] == nil {
+			encoders[column] = &columnEncoder{}
+		}
+
+		return encoders[column]
+	}
+
+	for column, spec := range cfg.ColumnCodecs {
+		enc, err := codec.NewEncoder(spec, cfg.CodecPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create codec of column '%s': %w", column, err)
+		}
+		get(column).codec = enc
+	}
+
+	if len(cfg.EncryptColumns) > 0 {
+		keyring, err := fieldcrypt.LoadKeyring(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if keyring.Active() == "" {
+			return nil, fmt.Errorf("no active key in key file '%s'", cfg.EncryptionKeyFile)
+		}
+		for _, column := range cfg.EncryptColumns {
+			get(column).keyring = keyring
+		}
+	}
+
+	return encoders, nil
+}
+
+func (e *columnEncoder) encode(v []byte) (_ []byte, err error) {
+	if e == nil {
+		return v, nil
+	}
+
+	if e.codec != nil {
+		if v, err = e.codec.Encode(v); err != nil {
+			return nil, fmt.Errorf("failed to compress value with codec '%s': %w", e.codec.Spec(), err)
+		}
+	}
+	if e.keyring != nil {
+		if v, err = e.keyring.Encrypt(v); err != nil {
+			return nil, fmt.Errorf("failed to encrypt value: %w", err)
+		}
+	}
+
+	return v, nil
+}
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
+)
+
+// target is a database the rows may be written to: the primary one or one of the secondary ones.
+// The connection is opened when the target is used for the first time and kept until exit.
+type target struct {
+	endpoint config.Endpoint
+	table    string
+	name     string // connection URL without credentials, for logs and metrics
+	db       *ydb.Driver
+	mapping  mappingHolder
+	quota    *quota
+	active   *metrics.Gauge // of the primary and the secondary databases
+	// csvFallbackUntil is the time (in Unix nanoseconds) until which the portions are sent as CSV,
+	// after the database rejected the format of the Arrow payload
+	csvFallbackUntil atomic.Int64
+
+	// the limits of the writes, the ones which are nil are not applied
+	sizer    *portionSizer
+	throttle *throttle
+	breaker  *breaker
+}
+
+func newTarget(endpoint config.Endpoint, table string) *target {
+	name := endpoint.ConnectionURL
+	if u, err := url.Parse(endpoint.ConnectionURL); err == nil && u.Host != "" {
+		name = u.Host + u.Path
+	}
+
+	return &target{
+		endpoint: endpoint,
+		table:    table,
+		name:     name,
+	}
+}
+
+// openTarget connects to the database if it is not connected yet, and resolves the table schema.
+func (s *YDB) openTarget(ctx context.Context, t *target) (finalErr error) {
+	if t.db != nil {
+		mapping, err := s.resolveFieldMapping(ctx, t.db, t.table)
+		if err != nil {
+			return err
+		}
+		t.mapping.store(mapping)
+
+		return nil
+	}
+
+	db, err := OpenDriver(ctx, t.endpoint)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if finalErr != nil {
+			_ = db.Close(context.Background())
+		}
+	}()
+
+	mapping, err := s.resolveFieldMapping(ctx, db, t.table)
+	if err != nil {
+		return err
+	}
+
+	// the cluster-wide quota is not applied to the mirror
+	var q *quota
+	if s.mirror == nil || t != s.mirror.target {
+		if q, err = newQuota(ctx, db, s.cfg); err != nil {
+			return err
+		}
+	}
+
+	t.mapping.resolve = func(ctx context.Context) (*fieldMapping, error) {
+		return s.resolveFieldMapping(ctx, db, t.table)
+	}
+	t.mapping.store(mapping)
+	t.quota = q
+	t.db = db
+
+	return nil
+}
+
+// openActive opens the target the writes are switched to, and checks its heartbeat table,
+// so the heartbeat is not lost after the switch.
+func (s *YDB) openActive(ctx context.Context, t *target) error {
+	if err := s.openTarget(ctx, t); err != nil {
+		return err
+	}
+	if s.cfg.HeartbeatTable != "" {
+		return s.describeHeartbeatTable(ctx, t.db)
+	}
+
+	return nil
+}
+
+// OpenDriver opens the connection to the database of the endpoint.
+func OpenDriver(ctx context.Context, endpoint config.Endpoint) (*ydb.Driver, error) {
+	opts := []ydb.Option{endpoint.CredentialsOption}
+	if endpoint.Certificates != "" {
+		_, err := os.Stat(endpoint.Certificates)
+		if err == nil {
+			opts = append(opts, ydb.WithCertificatesFromFile(endpoint.Certificates))
+		} else {
+			opts = append(opts, ydb.WithCertificatesFromPem([]byte(endpoint.Certificates)))
+		}
+	}
+
+	return ydb.Open(ctx, endpoint.ConnectionURL, opts...)
+}
+
+// target returns the database the rows are written to.
+func (s *YDB) target() *target {
+	return s.active.Load()
+}
+
+// activate makes the rows to be written to the target.
+func (s *YDB) activate(t *target) {
+	previous := s.active.Swap(t)
+	for _, other := range s.targets {
+		if other == t {
+			other.active.Set(1)
+		} else {
+			other.active.Set(0)
+		}
+	}
+
+	if previous != nil && previous != t {
+		log.Warn(fmt.Sprintf("switched writes from '%s' to '%s'", previous.name, t.name))
+		t.breaker.reset()
+	}
+}
+
+// failover decides when to switch to the next database: after the writes to the active one
+// have been failing with retryable errors for the configured time.
+type failover struct {
+	mu           sync.Mutex
+	after        time.Duration
+	failingSince time.Time
+	switching    bool
+}
+
+// record accounts the result of the write to the active database, and reports whether
+// the switch to the next database should start.
+func (f *failover) record(err error) bool {
+	if f == nil {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		// the write has not reached YDB, but the failures are going on
+	case isLocalError(err):
+		return false
+	case !IsRetryable(err):
+		// YDB has answered, so it is available
+		f.failingSince = time.Time{}
+
+		return false
+	case f.failingSince.IsZero():
+		f.failingSince = time.Now()
+	}
+
+	if f.switching || f.failingSince.IsZero() || time.Since(f.failingSince) < f.after {
+		return false
+	}
+	f.switching = true
+
+	return true
+}
+
+// done starts counting the failures anew after the switch attempt.
+func (f *failover) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.switching = false
+	f.failingSince = time.Time{}
+}
+
+// recordFailover accounts the result of the write to the target, and switches to the next
+// database in background if the target has been failing long enough.
+func (s *YDB) recordFailover(t *target, err error) {
+	if t != s.target() || !s.failover.record(err) {
+		return
+	}
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		defer s.failover.done()
+
+		s.switchMu.Lock()
+		defer s.switchMu.Unlock()
+
+		s.switchFrom(t)
+	}()
+}
+
+// switchFrom activates the first available database following the failing one, in the configured order.
+func (s *YDB) switchFrom(failing *target) {
+	log.Warn(fmt.Sprintf("writes to '%s' are failing for %s, switching to the next database",
+		failing.name, s.cfg.FailoverAfter))
+
+	start := 0
+	for i, t := range s.targets {
+		if t == failing {
+			start = i + 1
+		}
+	}
+
+	for i := range len(s.targets) - 1 {
+		t := s.targets[(start+i)%len(s.targets)]
+
+		ctx, cancel := context.WithTimeout(s.ctx, s.cfg.InitTimeout)
+		err := s.openActive(ctx, t)
+		cancel()
+		if err == nil {
+			s.activate(t)
+
+			return
+		}
+		log.Warn(fmt.Sprintf("database '%s' is not available: %v", t.name, err))
+	}
+
+	log.Error(fmt.Sprintf("no database is available, keeping writes to '%s'", failing.name))
+}
+
+// failbackLoop periodically checks the primary database while the rows are written to a secondary one,
+// and switches the writes back when the primary is available.
+func (s *YDB) failbackLoop() {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(s.cfg.FailbackInterval)
+	defer ticker.Stop()
+
+	primary := s.targets[0]
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.switchMu.Lock()
+		if s.target() != primary {
+			ctx, cancel := context.WithTimeout(s.ctx, s.cfg.InitTimeout)
+			if err := s.openActive(ctx, primary); err != nil {
+				log.Debug(fmt.Sprintf("primary database '%s' is still not available: %v", primary.name, err))
+			} else {
+				s.activate(primary)
+			}
+			cancel()
+		}
+		s.switchMu.Unlock()
+	}
+}
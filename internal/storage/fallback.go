@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+// fallback takes over the events which could not be written to YDB.
+type fallback interface {
+	Store(events []*model.Event) error
+}
+
+// fileFallback spools the events into the JSON lines files of the configured directory.
+// Each call produces a separate file, which appears atomically after it is synced to disk.
+type fileFallback struct {
+	dir string
+	seq atomic.Uint64
+}
+
+func newFileFallback(dir string) (*fileFallback, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create fallback directory '%s': %w", dir, err)
+	}
+
+	return &fileFallback{dir: dir}, nil
+}
+
+type fallbackRecord struct {
+	Timestamp  time.Time              `json:"timestamp"`
+	Tag        string                 `json:"tag"`
+	Record     map[string]interface{} `json:"record"`
+	Seq        uint64                 `json:"seq,omitempty"`
+	ChunkIndex int                    `json:"chunk_index,omitempty"`
+	ChunkCount int                    `json:"chunk_count,omitempty"`
+}
+
+func (f *fileFallback) Store(events []*model.Event) error {
+	_, err := f.write(events)
+
+	return err
+}
+
+// write stores the events into a new file and returns its name.
+func (f *fileFallback) write(events []*model.Event) (string, error) {
+	name := filepath.Join(f.dir, fmt.Sprintf("%d-%d.jsonl", time.Now().UnixNano(), f.seq.Add(1)))
+
+	file, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o640)
+	if err != nil {
+		return "", fmt.Errorf("failed to create fallback file: %w", err)
+	}
+
+	if err = writeFallbackRecords(file, events); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(name + ".tmp")
+
+		return "", fmt.Errorf("failed to write fallback file: %w", err)
+	}
+
+	return name, os.Rename(name+".tmp", name)
+}
+
+// list returns the names of the stored files, oldest first.
+func (f *fileFallback) list() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(f.dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return filepath.Base(names[i]) < filepath.Base(names[j])
+	})
+
+	return names, nil
+}
+
+// load reads the events from the stored file.
+func (f *fileFallback) load(name string) ([]*model.Event, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []*model.Event
+	dec := json.NewDecoder(file)
+	dec.UseNumber()
+	for dec.More() {
+		var record fallbackRecord
+		if err := dec.Decode(&record); err != nil {
+			return nil, fmt.Errorf("failed to read fallback file '%s': %w", name, err)
+		}
+
+		message := make(map[string]interface{}, len(record.Record))
+		for k, v := range record.Record {
+			message[k] = convertJSONMaps(v)
+		}
+		events = append(events, &model.Event{
+			Timestamp:  record.Timestamp,
+			Metadata:   record.Tag,
+			Message:    message,
+			Seq:        record.Seq,
+			ChunkIndex: record.ChunkIndex,
+			ChunkCount: record.ChunkCount,
+		})
+	}
+
+	return events, nil
+}
+
+func (f *fileFallback) remove(name string) error {
+	return os.Remove(name)
+}
+
+// quarantine renames the file which cannot be loaded, so it is not listed any more, and returns its new name.
+func (f *fileFallback) quarantine(name string) (string, error) {
+	failed := name + ".failed"
+	if err := os.Rename(name, failed); err != nil {
+		return "", fmt.Errorf("failed to move fallback file: %w", err)
+	}
+
+	return failed, nil
+}
+
+// convertJSONMaps converts the decoded JSON objects and numbers to the maps and the numbers produced
+// by the Fluent Bit decoder, so the reloaded events are converted to the same rows.
+func convertJSONMaps(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u
+		}
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+
+		return f
+	case map[string]interface{}:
+		out := make(map[interface{}]interface{}, len(v))
+		for key, value := range v {
+			out[key] = convertJSONMaps(value)
+		}
+
+		return out
+	case []interface{}:
+		for i := range v {
+			v[i] = convertJSONMaps(v[i])
+		}
+
+		return v
+	default:
+		return v
+	}
+}
+
+func writeFallbackRecords(file *os.File, events []*model.Event) error {
+	enc := json.NewEncoder(file)
+	for _, event := range events {
+		message := make(map[interface{}]interface{}, len(event.Message))
+		for k, v := range event.Message {
+			message[k] = v
+		}
+
+		if err := enc.Encode(fallbackRecord{
+			Timestamp:  event.Timestamp,
+			Tag:        event.Metadata,
+			Record:     convertByteFieldsToString(message),
+			Seq:        event.Seq,
+			ChunkIndex: event.ChunkIndex,
+			ChunkCount: event.ChunkCount,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
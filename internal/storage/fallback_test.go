@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+func TestFileFallbackStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+
+	f, err := newFileFallback(dir)
+	require.NoError(t, err)
+
+	ts := time.Date(2024, 5, 2, 12, 36, 13, 0, time.UTC)
+	require.NoError(t, f.Store([]*model.Event{
+		{Timestamp: ts, Metadata: "syslog", Message: map[string]interface{}{"log": []byte("first")}},
+		{Timestamp: ts, Metadata: "syslog", Message: map[string]interface{}{"log": []byte("second")}, Seq: 7},
+	}))
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.True(t, strings.HasSuffix(files[0].Name(), ".jsonl"))
+
+	data, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	var record fallbackRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	require.Equal(t, ts, record.Timestamp)
+	require.Equal(t, "syslog", record.Tag)
+	require.Equal(t, map[string]interface{}{"log": "second"}, record.Record)
+	require.Equal(t, uint64(7), record.Seq)
+
+	events, err := f.load(filepath.Join(dir, files[0].Name()))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Zero(t, events[0].Seq)
+	require.Equal(t, uint64(7), events[1].Seq)
+}
+
+func TestFileFallbackNumbers(t *testing.T) {
+	f, err := newFileFallback(t.TempDir())
+	require.NoError(t, err)
+
+	message := map[string]interface{}{
+		"bytes":  uint64(18446744073709551615),
+		"offset": int64(-5),
+		"ratio":  0.25,
+		"nested": map[interface{}]interface{}{"code": uint64(200), "list": []interface{}{uint64(1), 1.5}},
+	}
+	name, err := f.write([]*model.Event{{Timestamp: time.Now(), Metadata: "app", Message: message}})
+	require.NoError(t, err)
+
+	events, err := f.load(name)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, message, events[0].Message)
+
+	// the reloaded value is written to the Uint64 column as it was before the spooling
+	v, _, err := type2Type(types.Optional(types.TypeUint64), events[0].Message["bytes"], nil)
+	require.NoError(t, err)
+	require.Equal(t, types.OptionalValue(types.Uint64Value(18446744073709551615)), v)
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+)
+
+// Columns of the heartbeat table.
+const (
+	heartbeatAgentIDColumn   = "agent_id"
+	heartbeatTagColumn       = "tag"
+	heartbeatSeqColumn       = "seq"
+	heartbeatTimestampColumn = "timestamp"
+)
+
+// heartbeatLoop periodically records the last sequence number of the written records of each tag
+// into the heartbeat table, so the records lost after the last one in the logs table are detected as well.
+func (s *YDB) heartbeatLoop() {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(s.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.heartbeat(s.ctx); err != nil {
+			log.Warn(fmt.Sprintf("failed to write heartbeat: %v", err))
+		}
+	}
+}
+
+func (s *YDB) heartbeat(ctx context.Context) error {
+	last := s.seq.lastWritten()
+	if len(last) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.WriteTimeout)
+	defer cancel()
+
+	t := s.target()
+
+	return t.db.Table().BulkUpsert(ctx,
+		path.Join(t.db.Name(), s.cfg.HeartbeatTable),
+		table.BulkUpsertDataRows(heartbeatRows(s.cfg.AgentID, last, time.Now())),
+	)
+}
+
+// heartbeatRows returns the rows of the heartbeat table with the last numbers of the tags, ordered by tag.
+func heartbeatRows(agentID string, last map[string]uint64, now time.Time) types.Value {
+	tags := make([]string, 0, len(last))
+	for tag := range last {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+
+	rows := make([]types.Value, 0, len(last))
+	for _, tag := range tags {
+		rows = append(rows, types.StructValue(
+			types.StructFieldValue(heartbeatAgentIDColumn, types.TextValue(agentID)),
+			types.StructFieldValue(heartbeatTagColumn, types.TextValue(tag)),
+			types.StructFieldValue(heartbeatSeqColumn, types.Uint64Value(last[tag])),
+			types.StructFieldValue(heartbeatTimestampColumn, types.TimestampValueFromTime(now)),
+		))
+	}
+
+	return types.ListValue(rows...)
+}
+
+// checkHeartbeatTable reports the columns of the heartbeat table which are missing or have another type.
+func checkHeartbeatTable(desc options.Description) error {
+	want := map[string]types.Type{
+		heartbeatAgentIDColumn:   types.TypeText,
+		heartbeatTagColumn:       types.TypeText,
+		heartbeatSeqColumn:       types.TypeUint64,
+		heartbeatTimestampColumn: types.TypeTimestamp,
+	}
+
+	var errs []error
+	for _, column := range desc.Columns {
+		t, has := want[column.Name]
+		if !has {
+			continue
+		}
+		delete(want, column.Name)
+		if _, columnType := convertTypeIfOptional(column.Type); !types.Equal(columnType, t) {
+			errs = append(errs, fmt.Errorf("column '%s' must be %s, got %s", column.Name, t.Yql(), column.Type.Yql()))
+		}
+	}
+	missing := make([]string, 0, len(want))
+	for name := range want {
+		missing = append(missing, name)
+	}
+	slices.Sort(missing)
+	for _, name := range missing {
+		errs = append(errs, fmt.Errorf("column '%s' of type %s is missing", name, want[name].Yql()))
+	}
+
+	return errors.Join(errs...)
+}
+
+// describeHeartbeatTable checks the columns of the heartbeat table of the database.
+func (s *YDB) describeHeartbeatTable(ctx context.Context, db *ydb.Driver) error {
+	fullPath := path.Join(db.Name(), s.cfg.HeartbeatTable)
+
+	return db.Table().Do(ctx, func(ctx context.Context, session table.Session) error {
+		desc, err := session.DescribeTable(ctx, fullPath)
+		if err != nil {
+			return fmt.Errorf("failed to describe heartbeat table `%s`: %w", fullPath, err)
+		}
+		if err = checkHeartbeatTable(desc); err != nil {
+			return fmt.Errorf("heartbeat table `%s` does not match: %w", fullPath, err)
+		}
+
+		return nil
+	}, table.WithIdempotent())
+}
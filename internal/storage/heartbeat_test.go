@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+)
+
+func TestHeartbeatRows(t *testing.T) {
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+
+	row := func(tag string, seq uint64) types.Value {
+		return types.StructValue(
+			types.StructFieldValue("agent_id", types.TextValue("agent-1")),
+			types.StructFieldValue("tag", types.TextValue(tag)),
+			types.StructFieldValue("seq", types.Uint64Value(seq)),
+			types.StructFieldValue("timestamp", types.TimestampValueFromTime(now)),
+		)
+	}
+
+	require.Equal(t, types.ListValue(row("app", 7), row("syslog", 3)),
+		heartbeatRows("agent-1", map[string]uint64{"syslog": 3, "app": 7}, now))
+}
+
+func TestCheckHeartbeatTable(t *testing.T) {
+	require.NoError(t, checkHeartbeatTable(options.Description{Columns: []options.Column{
+		{Name: "agent_id", Type: types.TypeText},
+		{Name: "tag", Type: types.TypeText},
+		{Name: "seq", Type: types.Optional(types.TypeUint64)},
+		{Name: "timestamp", Type: types.Optional(types.TypeTimestamp)},
+		{Name: "host", Type: types.Optional(types.TypeText)},
+	}}))
+
+	err := checkHeartbeatTable(options.Description{Columns: []options.Column{
+		{Name: "agent_id", Type: types.TypeText},
+		{Name: "tag", Type: types.TypeText},
+		{Name: "seq", Type: types.Optional(types.TypeInt64)},
+	}})
+	require.ErrorContains(t, err, "column 'seq' must be Uint64, got Optional<Int64>")
+	require.ErrorContains(t, err, "column 'timestamp' of type Timestamp is missing")
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+)
+
+// fieldMapping is an immutable snapshot of the log fields to table columns mapping.
+// It is shared by the concurrent flushes and replaced as a whole when the schema changes.
+type fieldMapping struct {
+	columns map[string]options.Column // {fieldName : Column}
+	layout  *payloadLayout            // nil for the rows payload
+	sortKey map[string]int            // {columnName : position in the key the rows are ordered by}
+	bounds  [][]interface{}           // key bounds of the shards, see tableStorage
+}
+
+func (m *fieldMapping) BuildColumnUsageMap() map[string]bool {
+	u := make(map[string]bool)
+	for k := range m.columns {
+		if !strings.HasPrefix(k, ".") {
+			u[k] = true
+		}
+	}
+
+	return u
+}
+
+func (m *fieldMapping) column(name string) (options.Column, error) {
+	cref, exists := m.columns[name]
+	if !exists {
+		return cref, errors.New("field does not exist: " + name)
+	}
+
+	return cref, nil
+}
+
+// mappingHolder keeps the current mapping snapshot and refreshes it from the table description.
+type mappingHolder struct {
+	current atomic.Pointer[fieldMapping]
+	mu      sync.Mutex // makes the refreshes single-flight
+	resolve func(ctx context.Context) (*fieldMapping, error)
+}
+
+func (h *mappingHolder) load() *fieldMapping {
+	return h.current.Load()
+}
+
+func (h *mappingHolder) store(m *fieldMapping) {
+	h.current.Store(m)
+}
+
+// refresh replaces the snapshot which failed the write with the one resolved from the table description.
+// If the snapshot was already replaced by a concurrent flush, the current one is returned without
+// describing the table again.
+func (h *mappingHolder) refresh(ctx context.Context, seen *fieldMapping) (*fieldMapping, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if current := h.current.Load(); current != seen {
+		return current, nil
+	}
+
+	m, err := h.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h.current.Store(m)
+
+	return m, nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+func testMapping(fields ...string) *fieldMapping {
+	m := &fieldMapping{columns: map[string]options.Column{
+		config.KeyTimestamp: {Name: "timestamp", Type: types.TypeTimestamp},
+		config.KeyInput:     {Name: "input", Type: types.TypeText},
+	}}
+	for _, field := range fields {
+		m.columns[field] = options.Column{Name: field, Type: types.Optional(types.TypeText)}
+	}
+
+	return m
+}
+
+func TestMappingRefreshSingleFlight(t *testing.T) {
+	var (
+		resolved atomic.Int32
+		next     = testMapping("message")
+		h        = mappingHolder{resolve: func(context.Context) (*fieldMapping, error) {
+			resolved.Add(1)
+			time.Sleep(10 * time.Millisecond)
+
+			return next, nil
+		}}
+	)
+	old := testMapping()
+	h.store(old)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := h.refresh(context.Background(), old)
+			require.NoError(t, err)
+			require.Same(t, next, m)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), resolved.Load())
+	require.Same(t, next, h.load())
+}
+
+func TestConvertRowsDuringRefresh(t *testing.T) {
+	active := &target{}
+	active.mapping.store(testMapping())
+	active.mapping.resolve = func(context.Context) (*fieldMapping, error) {
+		return testMapping("message"), nil
+	}
+	s := &YDB{}
+	s.active.Store(active)
+
+	events := []*model.Event{{
+		Timestamp: time.Now(),
+		Metadata:  "tag",
+		Message:   map[string]interface{}{"message": "hello"},
+	}}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				rows, _, err := s.ConvertRows(events)
+				require.NoError(t, err)
+				require.Len(t, rows, 1)
+			}
+		}()
+	}
+	for range 10 {
+		_, err := active.mapping.refresh(context.Background(), active.mapping.load())
+		require.NoError(t, err)
+	}
+	wg.Wait()
+}
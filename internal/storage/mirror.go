@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+// mirror writes each flush to the second database along with the primary one, for example
+// during the migration between clusters. The mirror table has its own schema, so the events
+// are converted for it separately.
+type mirror struct {
+	target *target
+	policy string
+	openMu sync.Mutex // serializes the connection attempts
+
+	mu          sync.Mutex
+	behindSince time.Time // the first of the failed writes following the last successful one
+
+	rows       *metrics.Counter
+	failedRows *metrics.Counter
+	lag        *metrics.Gauge
+}
+
+func newMirror(cfg *config.Config) *mirror {
+	t := newTarget(*cfg.Mirror, cfg.MirrorTablePath)
+	t.sizer = newPortionSizer(cfg.PortionMaxBytes, cfg.PortionMaxRows)
+
+	return &mirror{
+		target: t,
+		policy: cfg.MirrorPolicy,
+		rows: metrics.NewCounter("fluentbit_ydb_mirror_rows_total",
+			"Number of the rows written to the mirror database.", "table", t.table, "target", t.name),
+		failedRows: metrics.NewCounter("fluentbit_ydb_mirror_failed_rows_total",
+			"Number of the rows which could not be written to the mirror database.", "table", t.table, "target", t.name),
+		lag: metrics.NewGauge("fluentbit_ydb_mirror_lag_seconds",
+			"Time the writes to the mirror database have been failing, zero when it is in sync.",
+			"table", t.table, "target", t.name),
+	}
+}
+
+// connect opens the connection to the mirror database unless it is already open.
+func (m *mirror) connect(ctx context.Context, s *YDB) error {
+	m.openMu.Lock()
+	defer m.openMu.Unlock()
+
+	if m.target.db != nil {
+		return nil
+	}
+
+	return s.openTarget(ctx, m.target)
+}
+
+// report accounts the result of writing the rows to the mirror database.
+func (m *mirror) report(rows, failed int) {
+	m.rows.Add(uint64(rows - failed))
+	m.failedRows.Add(uint64(failed))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if failed == 0 {
+		m.behindSince = time.Time{}
+		m.lag.Set(0)
+
+		return
+	}
+	if m.behindSince.IsZero() {
+		m.behindSince = time.Now()
+	}
+	m.lag.Set(time.Since(m.behindSince).Seconds())
+}
+
+// result decides the result of the flush according to the policy.
+func (m *mirror) result(primaryErr, mirrorErr error) error {
+	if mirrorErr == nil {
+		return primaryErr
+	}
+
+	log.Warn(fmt.Sprintf("failed to write to mirror database '%s': %v", m.target.name, mirrorErr))
+	if primaryErr == nil && m.policy == config.MirrorPolicyBoth {
+		return fmt.Errorf("failed to write to mirror database: %w", mirrorErr)
+	}
+
+	return primaryErr
+}
+
+// writeMirror converts the events for the mirror table and writes them by portions, retrying the failed ones.
+func (s *YDB) writeMirror(events []*model.Event) error {
+	m := s.mirror
+	t := m.target
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.InitTimeout)
+	err := m.connect(ctx, s)
+	cancel()
+	if err != nil {
+		m.report(len(events), len(events))
+
+		return fmt.Errorf("failed to connect: %w: %w", err, ErrRetryLater)
+	}
+
+	mapping := t.mapping.load()
+	rows, sizes, err := s.convertRows(mapping, events)
+	if err != nil {
+		m.report(len(events), len(events))
+
+		return err
+	}
+
+	failed := s.writePortions(t, events, rows, sizes)
+	if len(failed) > 0 && ydb.IsOperationErrorSchemeError(portionsError(failed)) {
+		log.Warn("Detected scheme error of mirror table, trying to resolve field mapping from table description")
+		failed = s.rewrite(t, mapping, failed)
+	}
+
+	m.report(len(events), len(portionsEvents(failed)))
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return portionsError(failed)
+}
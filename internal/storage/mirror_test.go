@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+)
+
+func testMirror(policy string) *mirror {
+	return newMirror(&config.Config{
+		Mirror:          &config.Endpoint{ConnectionURL: "grpc://localhost:2136/local"},
+		MirrorTablePath: "logs",
+		MirrorPolicy:    policy,
+		PortionMaxBytes: config.DefaultPortionMaxBytes,
+	})
+}
+
+func TestMirrorPolicy(t *testing.T) {
+	primaryErr := errors.New("primary failed")
+	mirrorErr := errors.New("mirror failed")
+
+	m := testMirror(config.MirrorPolicyPrimary)
+	require.NoError(t, m.result(nil, mirrorErr))
+	require.ErrorIs(t, m.result(primaryErr, mirrorErr), primaryErr)
+
+	m = testMirror(config.MirrorPolicyBoth)
+	require.NoError(t, m.result(nil, nil))
+	require.ErrorIs(t, m.result(nil, mirrorErr), mirrorErr)
+	require.ErrorIs(t, m.result(primaryErr, mirrorErr), primaryErr)
+}
+
+func TestMirrorLag(t *testing.T) {
+	m := testMirror(config.MirrorPolicyPrimary)
+
+	m.report(10, 2)
+	time.Sleep(10 * time.Millisecond)
+	m.report(10, 10)
+	require.GreaterOrEqual(t, m.lag.Value(), 0.01)
+	require.Equal(t, uint64(8), m.rows.Value())
+	require.Equal(t, uint64(12), m.failedRows.Value())
+
+	m.report(5, 0)
+	require.Zero(t, m.lag.Value())
+	require.Equal(t, uint64(13), m.rows.Value())
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+// truncatedMarker is appended to the truncated values.
+const truncatedMarker = "...[truncated]"
+
+// oversized applies the configured policies to the string and bytes values exceeding the limit,
+// so a single huge value does not make the whole flush to fail.
+type oversized struct {
+	maxBytes int
+	policies map[string]string // {fieldName : policy}
+}
+
+// newOversized returns nil if the limit is not configured.
+func newOversized(maxBytes int, policies map[string]string) *oversized {
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	return &oversized{maxBytes: maxBytes, policies: policies}
+}
+
+func (o *oversized) policy(field string) string {
+	if policy, has := o.policies[field]; has {
+		return policy
+	}
+	if policy, has := o.policies[config.OversizedDefaultField]; has {
+		return policy
+	}
+
+	return config.OversizedTruncate
+}
+
+// apply returns the events to be written, with the oversized values truncated or split,
+// and the events rejected by the policy.
+func (o *oversized) apply(events []*model.Event) (accepted, rejected []*model.Event) {
+	accepted = events[:0:0]
+	for _, event := range events {
+		var split map[string][]interface{} // {fieldName : parts}
+		reject := false
+		for field, value := range event.Message {
+			if valueLen(value) <= o.maxBytes {
+				continue
+			}
+
+			switch o.policy(field) {
+			case config.OversizedReject:
+				reject = true
+			case config.OversizedSplit:
+				if split == nil {
+					split = make(map[string][]interface{})
+				}
+				split[field] = splitValue(value, o.maxBytes)
+			default:
+				event = withValue(event, field, truncateValue(value, o.maxBytes))
+			}
+		}
+
+		switch {
+		case reject:
+			rejected = append(rejected, event)
+		case split != nil:
+			accepted = append(accepted, splitEvent(event, split)...)
+		default:
+			accepted = append(accepted, event)
+		}
+	}
+
+	return accepted, rejected
+}
+
+func valueLen(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	default:
+		return 0
+	}
+}
+
+// cut returns the length of the value prefix fitting into the limit, which does not break the UTF-8 characters.
+// Fluent Bit passes the strings as bytes, so the bytes values are cut the same way. The prefix is not shortened
+// by more than a character, so the binary values which are not UTF-8 are cut at the limit.
+func cut(value interface{}, limit int) int {
+	n := valueLen(value)
+	if limit >= n {
+		return n
+	}
+	for back := 0; back < utf8.UTFMax && limit-back > 0; back++ {
+		if utf8.RuneStart(byteAt(value, limit-back)) {
+			return limit - back
+		}
+	}
+	if limit < utf8.UTFMax && utf8.RuneStart(byteAt(value, 0)) {
+		// the limit is less than the first character
+		return 0
+	}
+
+	return limit
+}
+
+func byteAt(value interface{}, i int) byte {
+	switch v := value.(type) {
+	case string:
+		return v[i]
+	case []byte:
+		return v[i]
+	default:
+		return 0
+	}
+}
+
+// truncateValue cuts the value to the limit, including the marker. The limit which does not fit
+// the marker leaves the cut value without it.
+func truncateValue(value interface{}, maxBytes int) interface{} {
+	marker := truncatedMarker
+	if maxBytes <= len(marker) {
+		marker = ""
+	}
+	n := cut(value, maxBytes-len(marker))
+	switch v := value.(type) {
+	case string:
+		return v[:n] + marker
+	case []byte:
+		return append(v[:n:n], marker...)
+	default:
+		return value
+	}
+}
+
+func splitValue(value interface{}, maxBytes int) []interface{} {
+	var parts []interface{}
+	for valueLen(value) > 0 {
+		n := cut(value, maxBytes)
+		if n == 0 {
+			// the limit is less than the first character
+			n = firstRuneLen(value)
+		}
+		switch v := value.(type) {
+		case string:
+			parts, value = append(parts, v[:n]), v[n:]
+		case []byte:
+			parts, value = append(parts, v[:n]), v[n:]
+		}
+	}
+
+	return parts
+}
+
+func firstRuneLen(value interface{}) int {
+	var n int
+	switch v := value.(type) {
+	case string:
+		_, n = utf8.DecodeRuneInString(v)
+	case []byte:
+		_, n = utf8.DecodeRune(v)
+	}
+
+	return max(n, 1)
+}
+
+// withValue returns the copy of the event with the field value replaced, the original event is not modified.
+func withValue(event *model.Event, field string, value interface{}) *model.Event {
+	e := *event
+	e.Message = make(map[string]interface{}, len(event.Message))
+	for k, v := range event.Message {
+		e.Message[k] = v
+	}
+	e.Message[field] = value
+
+	return &e
+}
+
+// splitEvent makes an event for each part of the split values. The other fields are repeated in each event,
+// and the split fields are empty in the events following their last part.
+func splitEvent(event *model.Event, split map[string][]interface{}) []*model.Event {
+	count := 0
+	for _, parts := range split {
+		count = max(count, len(parts))
+	}
+
+	events := make([]*model.Event, count)
+	for i := range events {
+		e := *event
+		e.Message = make(map[string]interface{}, len(event.Message))
+		for k, v := range event.Message {
+			e.Message[k] = v
+		}
+		for field, parts := range split {
+			if i < len(parts) {
+				e.Message[field] = parts[i]
+			} else {
+				e.Message[field] = emptyLike(parts[0])
+			}
+		}
+		e.ChunkIndex, e.ChunkCount = i, count
+		events[i] = &e
+	}
+
+	return events
+}
+
+func emptyLike(value interface{}) interface{} {
+	if _, ok := value.([]byte); ok {
+		return []byte{}
+	}
+
+	return ""
+}
+
+// reject passes the events rejected by the oversized value policy to the fallback, if it is configured.
+// Otherwise the events are dropped, so they do not make the whole flush to fail.
+func (s *YDB) reject(events []*model.Event) {
+	if s.fallback != nil {
+		err := s.fallback.Store(events)
+		if err == nil {
+			s.stats.stored.Add(int64(len(events)))
+			log.Warn(fmt.Sprintf("%d events with values over %d bytes were passed to the fallback",
+				len(events), s.cfg.MaxValueBytes))
+
+			return
+		}
+		log.Error(fmt.Sprintf("failed to pass the events with oversized values to the fallback: %v", err))
+	}
+
+	s.stats.failed.Add(int64(len(events)))
+	log.Error(fmt.Sprintf("%d events with values over %d bytes were dropped", len(events), s.cfg.MaxValueBytes))
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+func TestOversizedTruncate(t *testing.T) {
+	o := newOversized(20, nil)
+	original := &model.Event{Metadata: "app", Message: map[string]interface{}{
+		"log":   strings.Repeat("я", 20),
+		"short": "ok",
+	}}
+
+	accepted, rejected := o.apply([]*model.Event{original})
+	require.Empty(t, rejected)
+	require.Len(t, accepted, 1)
+
+	log := accepted[0].Message["log"].(string) //nolint:forcetypeassert
+	require.LessOrEqual(t, len(log), 20)
+	require.True(t, strings.HasSuffix(log, truncatedMarker))
+	require.Equal(t, "яяя"+truncatedMarker, log)
+	require.Equal(t, "ok", accepted[0].Message["short"])
+	// the flushed event is not modified
+	require.Len(t, original.Message["log"], 40)
+}
+
+func TestOversizedTruncateShortLimit(t *testing.T) {
+	// the limit is shorter than the marker
+	require.Equal(t, "abcde", truncateValue(strings.Repeat("abcdef", 5), 5))
+	require.Equal(t, []byte("abc"), truncateValue([]byte("abcdef"), 3))
+	require.Equal(t, "я", truncateValue("яяя", 3))
+
+	for limit := 1; limit <= 2*len(truncatedMarker); limit++ {
+		v := truncateValue(strings.Repeat("x", 100), limit).(string) //nolint:forcetypeassert
+		require.LessOrEqual(t, len(v), limit)
+	}
+}
+
+func TestOversizedSplit(t *testing.T) {
+	o := newOversized(5, map[string]string{"log": config.OversizedSplit, "raw": config.OversizedSplit})
+	event := &model.Event{Metadata: "app", Seq: 3, Message: map[string]interface{}{
+		"log":  "абвгд",
+		"raw":  []byte("0123456789ab"),
+		"host": "h1",
+	}}
+
+	accepted, rejected := o.apply([]*model.Event{event})
+	require.Empty(t, rejected)
+	require.Len(t, accepted, 3)
+
+	var (
+		log strings.Builder
+		raw []byte
+	)
+	for i, e := range accepted {
+		require.Equal(t, i, e.ChunkIndex)
+		require.Equal(t, 3, e.ChunkCount)
+		require.Equal(t, uint64(3), e.Seq)
+		require.Equal(t, "h1", e.Message["host"])
+		log.WriteString(e.Message["log"].(string)) //nolint:forcetypeassert
+		raw = append(raw, e.Message["raw"].([]byte)...)
+	}
+	require.Equal(t, "абвгд", log.String())
+	require.Equal(t, "0123456789ab", string(raw))
+}
+
+func TestOversizedReject(t *testing.T) {
+	o := newOversized(5, map[string]string{config.OversizedDefaultField: config.OversizedReject})
+	small := &model.Event{Message: map[string]interface{}{"log": "ok"}}
+	large := &model.Event{Message: map[string]interface{}{"log": "too large"}}
+
+	accepted, rejected := o.apply([]*model.Event{small, large})
+	require.Equal(t, []*model.Event{small}, accepted)
+	require.Equal(t, []*model.Event{large}, rejected)
+}
+
+func TestOversizedMultibyteBytes(t *testing.T) {
+	// Fluent Bit passes the strings as bytes, the characters are not broken either
+	truncated := truncateValue([]byte(strings.Repeat("я", 20)), 20).([]byte) //nolint:forcetypeassert
+	require.Equal(t, "яяя"+truncatedMarker, string(truncated))
+	require.Equal(t, []byte("я"), truncateValue([]byte("яяя"), 3))
+	require.Equal(t, []byte{}, truncateValue([]byte("中文"), 2))
+
+	parts := splitValue([]byte("абвгд"), 5)
+	require.Len(t, parts, 3)
+	for _, part := range parts {
+		require.True(t, utf8.Valid(part.([]byte))) //nolint:forcetypeassert
+	}
+
+	// the limit is less than the first character
+	parts = splitValue([]byte("中文"), 2)
+	require.Equal(t, []interface{}{[]byte("中"), []byte("文")}, parts)
+	require.Equal(t, []interface{}{"中", "文"}, splitValue("中文", 2))
+
+	// the binary values which are not UTF-8 are cut at the limit
+	binary := []byte{0x80, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87}
+	require.Equal(t, 6, cut(binary, 6))
+	require.Len(t, splitValue(binary, 2), 4)
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ydb-platform/ydb-go-genproto/Ydb_Table_V1"
+	"github.com/ydb-platform/ydb-go-genproto/protos/Ydb"
+	"github.com/ydb-platform/ydb-go-genproto/protos/Ydb_Table"
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+// tableStorage is the layout of the table shards, which the order of the rows in the portions is chosen by.
+type tableStorage struct {
+	primaryKey []string
+	// bounds are the primary key values the key ranges of the shards start with, as the cells of the key columns.
+	// They are empty if the table has a single shard, or is partitioned by hash, which YDB computes internally.
+	bounds [][]interface{}
+}
+
+// describeStorage reads the key ranges of the shards, which the SDK does not expose in the table description.
+func describeStorage(ctx context.Context, db *ydb.Driver, sessionID, fullPath string) (tableStorage, error) {
+	response, err := Ydb_Table_V1.NewTableServiceClient(ydb.GRPCConn(db)).DescribeTable(ctx,
+		&Ydb_Table.DescribeTableRequest{SessionId: sessionID, Path: fullPath, IncludeShardKeyBounds: true})
+	if err != nil {
+		return tableStorage{}, fmt.Errorf("failed to describe storage of table `%s`: %w", fullPath, err)
+	}
+	if op := response.GetOperation(); op.GetStatus() != Ydb.StatusIds_SUCCESS {
+		return tableStorage{}, fmt.Errorf("failed to describe storage of table `%s`: %s %v",
+			fullPath, op.GetStatus(), op.GetIssues())
+	}
+
+	var result Ydb_Table.DescribeTableResult
+	if err = response.GetOperation().GetResult().UnmarshalTo(&result); err != nil {
+		return tableStorage{}, fmt.Errorf("failed to describe storage of table `%s`: %w", fullPath, err)
+	}
+
+	ts := tableStorage{primaryKey: result.GetPrimaryKey()}
+	for _, bound := range result.GetShardKeyBounds() {
+		cells, ok := boundCells(bound)
+		if !ok {
+			// the key has the columns of the types which are not mapped, the rows are not grouped
+			return tableStorage{primaryKey: ts.primaryKey}, nil
+		}
+		ts.bounds = append(ts.bounds, cells)
+	}
+
+	return ts, nil
+}
+
+// boundCells converts the key bound to the cells of the key columns, the bound may be a prefix of the key.
+func boundCells(bound *Ydb.TypedValue) ([]interface{}, bool) {
+	elements := bound.GetType().GetTupleType().GetElements()
+	items := bound.GetValue().GetItems()
+	if len(items) > len(elements) {
+		return nil, false
+	}
+
+	cells := make([]interface{}, 0, len(items))
+	for i, item := range items {
+		cell, ok := protoCell(elements[i], item)
+		if !ok {
+			return nil, false
+		}
+		cells = append(cells, cell)
+	}
+
+	return cells, true
+}
+
+func protoCell(t *Ydb.Type, v *Ydb.Value) (interface{}, bool) {
+	if optional := t.GetOptionalType(); optional != nil {
+		if _, null := v.GetValue().(*Ydb.Value_NullFlagValue); null {
+			return nil, true
+		}
+		if nested := v.GetNestedValue(); nested != nil {
+			v = nested
+		}
+
+		return protoCell(optional.GetItem(), v)
+	}
+
+	switch t.GetTypeId() { //nolint:exhaustive
+	case Ydb.Type_TIMESTAMP:
+		return time.UnixMicro(int64(v.GetUint64Value())).UTC(), true //nolint:gosec
+	case Ydb.Type_UINT64:
+		return v.GetUint64Value(), true
+	case Ydb.Type_UTF8, Ydb.Type_JSON:
+		return v.GetTextValue(), true
+	case Ydb.Type_STRING:
+		return v.GetBytesValue(), true
+	default:
+		return nil, false
+	}
+}
+
+// sortKey returns the positions of the mapped primary key columns in the key the rows are ordered by.
+// The key is the prefix of the primary key, so the rows of a shard key range are next to each other.
+// It returns nil if the rows are not ordered: by default only the tables having several key ranges are.
+func (ts tableStorage) sortKey(mode string, columns map[string]bool) map[string]int {
+	if mode == config.SortRowsOff || (mode == config.SortRowsAuto && len(ts.bounds) == 0) {
+		return nil
+	}
+
+	key := make(map[string]int)
+	for _, name := range ts.primaryKey {
+		if !columns[name] {
+			break
+		}
+		key[name] = len(key)
+	}
+	if len(key) == 0 {
+		return nil
+	}
+
+	return key
+}
+
+// shard returns the index of the key range the key belongs to.
+func shard(bounds [][]interface{}, key []interface{}) int {
+	return sort.Search(len(bounds), func(i int) bool {
+		return compareKeys(bounds[i], key) > 0
+	})
+}
+
+// sortRows orders the rows by their shards and keys, keeping the order of the rows with the equal keys,
+// so the latest of the records with the same primary key is still written last.
+func sortRows(events []*model.Event, rows []row, sizes []int) ([]*model.Event, []row, []int) {
+	if len(rows) < 2 || rows[0].key == nil {
+		return events, rows, sizes
+	}
+
+	order := make([]int, len(rows))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := rows[order[i]], rows[order[j]]
+		if a.shard != b.shard {
+			return a.shard < b.shard
+		}
+
+		return compareKeys(a.key, b.key) < 0
+	})
+
+	sortedEvents := make([]*model.Event, len(events))
+	sortedRows := make([]row, len(rows))
+	sortedSizes := make([]int, len(sizes))
+	for i, j := range order {
+		sortedEvents[i], sortedRows[i], sortedSizes[i] = events[j], rows[j], sizes[j]
+	}
+
+	return sortedEvents, sortedRows, sortedSizes
+}
+
+// compareKeys compares the keys by their common prefix.
+func compareKeys(a, b []interface{}) int {
+	for i := range min(len(a), len(b)) {
+		if c := compareCells(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// compareCells compares the cells of a column, NULL goes first.
+func compareCells(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	switch a := a.(type) {
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b)
+		}
+	case uint64:
+		if b, ok := b.(uint64); ok {
+			return cmp.Compare(a, b)
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+
+		return bytes.Compare([]byte(a), cellBytes(b))
+	case []byte:
+		return bytes.Compare(a, cellBytes(b))
+	}
+
+	return 0
+}
+
+func cellBytes(cell interface{}) []byte {
+	switch v := cell.(type) {
+	case string:
+		return []byte(v)
+	case []byte:
+		return v
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-genproto/protos/Ydb"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+func TestSortKey(t *testing.T) {
+	sharded := tableStorage{
+		primaryKey: []string{"input", "timestamp", "hash"},
+		bounds:     [][]interface{}{{"b"}, {"m"}},
+	}
+	mapped := map[string]bool{"timestamp": true, "input": true, "hash": true, "message": true}
+
+	require.Equal(t, map[string]int{"input": 0, "timestamp": 1, "hash": 2}, sharded.sortKey(config.SortRowsAuto, mapped))
+	// the key is the mapped prefix of the primary key
+	require.Equal(t, map[string]int{"input": 0, "timestamp": 1}, sharded.sortKey(config.SortRowsAuto,
+		map[string]bool{"timestamp": true, "input": true}))
+	require.Nil(t, sharded.sortKey(config.SortRowsOff, mapped))
+
+	// a single shard, or the shards of a hash partitioned column table
+	single := tableStorage{primaryKey: []string{"timestamp", "hash"}}
+	require.Nil(t, single.sortKey(config.SortRowsAuto, mapped))
+	require.Equal(t, map[string]int{"timestamp": 0, "hash": 1}, single.sortKey(config.SortRowsOn, mapped))
+}
+
+func TestBoundCells(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	optional := func(t *Ydb.Type) *Ydb.Type {
+		return &Ydb.Type{Type: &Ydb.Type_OptionalType{OptionalType: &Ydb.OptionalType{Item: t}}}
+	}
+	primitive := func(id Ydb.Type_PrimitiveTypeId) *Ydb.Type {
+		return &Ydb.Type{Type: &Ydb.Type_TypeId{TypeId: id}}
+	}
+	bound := &Ydb.TypedValue{
+		Type: &Ydb.Type{Type: &Ydb.Type_TupleType{TupleType: &Ydb.TupleType{Elements: []*Ydb.Type{
+			optional(primitive(Ydb.Type_UTF8)),
+			primitive(Ydb.Type_TIMESTAMP),
+			optional(primitive(Ydb.Type_UINT64)),
+		}}}},
+		Value: &Ydb.Value{Items: []*Ydb.Value{
+			{Value: &Ydb.Value_TextValue{TextValue: "app"}},
+			{Value: &Ydb.Value_Uint64Value{Uint64Value: uint64(ts.UnixMicro())}},
+			{Value: &Ydb.Value_NullFlagValue{}},
+		}},
+	}
+
+	cells, ok := boundCells(bound)
+	require.True(t, ok)
+	require.Equal(t, []interface{}{"app", ts, nil}, cells)
+
+	bound.Type.GetTupleType().Elements[2] = primitive(Ydb.Type_INT32)
+	_, ok = boundCells(bound)
+	require.False(t, ok, "the key of the types which are not mapped")
+}
+
+func TestShard(t *testing.T) {
+	bounds := [][]interface{}{{"b"}, {"m", uint64(5)}}
+	require.Equal(t, 0, shard(bounds, []interface{}{"a", uint64(9)}))
+	require.Equal(t, 1, shard(bounds, []interface{}{"b", uint64(0)}))
+	require.Equal(t, 1, shard(bounds, []interface{}{"m", uint64(4)}))
+	require.Equal(t, 2, shard(bounds, []interface{}{"m", uint64(5)}))
+	require.Equal(t, 0, shard(nil, []interface{}{"z"}))
+}
+
+func TestSplitByShard(t *testing.T) {
+	mapping := testMapping("message")
+	mapping.sortKey = map[string]int{"input": 0, "timestamp": 1}
+	mapping.bounds = [][]interface{}{{"b"}}
+
+	var events []*model.Event
+	for _, input := range []string{"b", "a", "b", "a"} {
+		events = append(events, &model.Event{Timestamp: time.Now(), Metadata: input, Message: map[string]interface{}{}})
+	}
+	rows, sizes, err := (&YDB{cfg: &config.Config{}}).convertRows(mapping, events)
+	require.NoError(t, err)
+
+	events, rows, sizes = sortRows(events, rows, sizes)
+	portions := newPortionSizer(1<<20, 0).split(events, rows, sizes, 0)
+	require.Len(t, portions, 2, "each portion is written to a single shard")
+	for i, p := range portions {
+		require.Len(t, p.rows, 2)
+		for _, r := range p.rows {
+			require.Equal(t, i, r.shard)
+		}
+	}
+}
+
+func TestSortRows(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	mapping := testMapping("message")
+	mapping.sortKey = map[string]int{"input": 0, "timestamp": 1}
+
+	var events []*model.Event
+	for i, input := range []string{"b", "a", "b", "a", "a"} {
+		events = append(events, &model.Event{
+			Timestamp: ts.Add(time.Duration(i%3) * time.Second),
+			Metadata:  input,
+			Message:   map[string]interface{}{"message": []byte{byte('0' + i)}},
+		})
+	}
+
+	s := &YDB{cfg: &config.Config{}}
+	rows, sizes, err := s.convertRows(mapping, events)
+	require.NoError(t, err)
+	require.Zero(t, rows[0].shard)
+
+	sorted, sortedRows, sortedSizes := sortRows(events, rows, sizes)
+	order := make([]string, 0, len(sorted))
+	for _, event := range sorted {
+		order = append(order, event.Metadata+string(event.Message["message"].([]byte)))
+	}
+	// by input, then by timestamp; the rows 1 and 4 have the same key and keep their order
+	require.Equal(t, []string{"a3", "a1", "a4", "b0", "b2"}, order)
+	require.Equal(t, "a", sortedRows[0].key[0])
+	require.Equal(t, ts, sortedRows[0].key[1])
+	require.Len(t, sortedSizes, len(sizes))
+
+	// the source slices are not modified
+	require.Equal(t, "b", events[0].Metadata)
+}
+
+func TestCompareCells(t *testing.T) {
+	ts := time.Now()
+	require.Equal(t, -1, compareCells(nil, uint64(0)))
+	require.Equal(t, 1, compareCells(uint64(2), nil))
+	require.Equal(t, -1, compareCells(uint64(1), uint64(2)))
+	require.Equal(t, 1, compareCells(ts.Add(time.Second), ts))
+	require.Equal(t, 0, compareCells("abc", []byte("abc")))
+	require.Equal(t, -1, compareCells([]byte("abc"), "abd"))
+}
+
+func TestValueCell(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	for _, c := range []struct {
+		t    types.Type
+		v    interface{}
+		cell interface{}
+	}{
+		{types.TypeTimestamp, ts, ts.UTC()},
+		{types.TypeTimestamp, "2024-05-01T07:00:00.000Z", ts.UTC()},
+		{types.Optional(types.TypeTimestamp), nil, nil},
+		{types.Optional(types.TypeTimestamp), "invalid", nil},
+		{types.TypeTimestamp, nil, time.UnixMicro(0).UTC()},
+		{types.TypeText, []byte("app"), "app"},
+		{types.Optional(types.TypeText), nil, nil},
+		{types.TypeText, nil, ""},
+		{types.TypeBytes, "abc", []byte("abc")},
+		{types.Optional(types.TypeBytes), []byte("abc"), []byte("abc")},
+		{types.TypeBytes, nil, []byte{}},
+		{types.TypeUint64, uint64(7), uint64(7)},
+		{types.Optional(types.TypeUint64), uint64(7), uint64(7)},
+		{types.TypeJSON, map[interface{}]interface{}{"pod": "app-1"}, `{"pod":"app-1"}`},
+		{types.Optional(types.TypeJSONDocument), map[interface{}]interface{}{"pod": "app-1"}, `{"pod":"app-1"}`},
+		{types.TypeJSON, nil, "{}"},
+	} {
+		value, _, err := type2Type(c.t, c.v, nil)
+		require.NoError(t, err)
+		cell, err := valueCell(value)
+		require.NoError(t, err)
+		require.Equal(t, c.cell, cell, "%s %v", c.t, c.v)
+	}
+}
+
+// BenchmarkSortRows measures the ordering of a portion of 1000 rows by a two-column key.
+func BenchmarkSortRows(b *testing.B) {
+	mapping := testMapping("message")
+	mapping.sortKey = map[string]int{"input": 0, "timestamp": 1}
+	events := testPayloadEvents(1000)
+	for i, event := range events {
+		event.Metadata = []string{"app", "db", "proxy"}[i%3]
+	}
+	rows, sizes, err := (&YDB{cfg: &config.Config{}}).convertRows(mapping, events)
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		sortRows(events, rows, sizes)
+	}
+}
+
+// BenchmarkPortionShards measures the number of the shards each request of a flush is written to: 1000 rows
+// of 16 inputs arriving interleaved, to a table split into 16 key ranges by input, in portions of 100 rows.
+func BenchmarkPortionShards(b *testing.B) {
+	inputs := make([]string, 16)
+	var bounds [][]interface{}
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf("input-%02d", i)
+		if i > 0 {
+			bounds = append(bounds, []interface{}{inputs[i]})
+		}
+	}
+	events := testPayloadEvents(1000)
+	for i, event := range events {
+		event.Metadata = inputs[i%len(inputs)]
+	}
+
+	for _, sorted := range []bool{false, true} {
+		b.Run(fmt.Sprintf("sorted=%t", sorted), func(b *testing.B) {
+			mapping := testMapping("message")
+			if sorted {
+				mapping.sortKey = map[string]int{"input": 0, "timestamp": 1}
+				mapping.bounds = bounds
+			}
+			rows, sizes, err := (&YDB{cfg: &config.Config{}}).convertRows(mapping, events)
+			require.NoError(b, err)
+
+			var portions, shards int
+			for range b.N {
+				events, rows, sizes := sortRows(events, rows, sizes)
+				for _, p := range newPortionSizer(1<<20, 100).split(events, rows, sizes, 0) {
+					// the inputs are the shards
+					touched := make(map[string]bool)
+					for _, event := range p.events {
+						touched[event.Metadata] = true
+					}
+					portions++
+					shards += len(touched)
+				}
+			}
+			b.ReportMetric(float64(shards)/float64(portions), "shards/request")
+			b.ReportMetric(float64(portions)/float64(b.N), "requests/flush")
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/bitutil"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+	"github.com/ydb-platform/ydb-go-genproto/protos/Ydb"
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+)
+
+// csvNull is the CSV value of NULL, the empty value is the empty string. If a value of the portion
+// is the same text, the number is appended to the marker until it is unique.
+const csvNull = `\N`
+
+// csvFallbackPeriod is how long the portions are written as CSV after the database rejected the Arrow payload,
+// before the Arrow payload is tried again.
+const csvFallbackPeriod = 10 * time.Minute
+
+// unsupportedFormatMessages are the markers of the BAD_REQUEST errors of the databases
+// which do not accept the Arrow payload, unlike the errors of its rows.
+var unsupportedFormatMessages = []string{"not supported", "unsupported", "unknown format", "unexpected format"}
+
+// csvTimestampLayout is the format of the Timestamp values in the CSV payload.
+const csvTimestampLayout = "2006-01-02T15:04:05.000000Z"
+
+// payloadLayout is the order and the types of the columns in the Arrow and CSV payloads.
+// It is built with the field mapping, so the columns of unsupported types are reported at startup.
+type payloadLayout struct {
+	format  string
+	columns []options.Column // sorted by name
+	// binary is set if the values of some columns are compressed, encrypted or pseudonymized bytes,
+	// which the CSV payload cannot carry
+	binary bool
+	index  map[string]int // {columnName : position}
+	schema *arrow.Schema
+	// schemaMessage is the serialized Arrow schema, passed along with each record batch.
+	schemaMessage []byte
+}
+
+// newPayloadLayout returns nil for the rows payload. The binary columns are the ones
+// with the compressed, encrypted or pseudonymized Bytes values.
+func newPayloadLayout(format string, mapping map[string]options.Column, binary map[string]bool,
+) (*payloadLayout, error) {
+	if format != config.BulkUpsertFormatArrow && format != config.BulkUpsertFormatCSV {
+		return nil, nil
+	}
+
+	l := &payloadLayout{format: format, index: make(map[string]int, len(mapping))}
+	for _, column := range mapping {
+		if _, has := l.index[column.Name]; !has {
+			l.index[column.Name] = -1
+			l.columns = append(l.columns, column)
+		}
+		if binary[column.Name] {
+			if format == config.BulkUpsertFormatCSV {
+				return nil, fmt.Errorf("column '%s' has the binary values, which are not supported by the '%s' BulkUpsert format",
+					column.Name, format)
+			}
+			l.binary = true
+		}
+	}
+	sort.Slice(l.columns, func(i, j int) bool { return l.columns[i].Name < l.columns[j].Name })
+
+	fields := make([]arrow.Field, 0, len(l.columns))
+	for i, column := range l.columns {
+		l.index[column.Name] = i
+
+		optional, columnType := convertTypeIfOptional(column.Type)
+		var dataType arrow.DataType
+		switch yqlType(columnType) {
+		case timestampType:
+			dataType = &arrow.TimestampType{Unit: arrow.Microsecond}
+		case bytesType:
+			dataType = arrow.BinaryTypes.Binary
+		case textType, jsonType, jsonDocumentType:
+			dataType = arrow.BinaryTypes.String
+		case uint64Type:
+			dataType = arrow.PrimitiveTypes.Uint64
+		default:
+			return nil, fmt.Errorf("column '%s' has type %s, which is not supported by the '%s' BulkUpsert format",
+				column.Name, column.Type, format)
+		}
+		fields = append(fields, arrow.Field{Name: column.Name, Type: dataType, Nullable: optional})
+	}
+	l.schema = arrow.NewSchema(fields, nil)
+
+	messages, err := arrowMessages(l.schema, nil)
+	if err != nil {
+		return nil, err
+	}
+	l.schemaMessage = messages[0]
+
+	return l, nil
+}
+
+// bulkUpsertData encodes the rows to the payload of the layout format.
+func (l *payloadLayout) bulkUpsertData(rows []row, format string) (table.BulkUpsertData, error) {
+	if format == config.BulkUpsertFormatCSV {
+		data, null, err := l.csv(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		return table.BulkUpsertDataCsv(data, table.WithCsvHeader(), table.WithCsvNullValue([]byte(null))), nil
+	}
+
+	data, err := l.arrow(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return table.BulkUpsertDataArrow(data, table.WithArrowSchema(l.schemaMessage)), nil
+}
+
+// bulkUpsertPayload writes the rows as the Arrow record batch or as CSV. If the database rejects
+// the format of the Arrow payload, the portion is written again as CSV, and the following ones
+// are written as CSV for csvFallbackPeriod. The layouts with the binary columns are not written as CSV.
+func (s *YDB) bulkUpsertPayload(ctx context.Context, t *target, fullPath string, layout *payloadLayout,
+	rows []row,
+) error {
+	format := layout.format
+	if format == config.BulkUpsertFormatArrow && time.Now().UnixNano() < t.csvFallbackUntil.Load() {
+		format = config.BulkUpsertFormatCSV
+	}
+	data, err := layout.bulkUpsertData(rows, format)
+	if err != nil {
+		return err
+	}
+
+	err = t.db.Table().BulkUpsert(ctx, fullPath, data)
+	if format != config.BulkUpsertFormatArrow || layout.binary || !arrowRejected(err) {
+		return err
+	}
+
+	if data, err = layout.bulkUpsertData(rows, config.BulkUpsertFormatCSV); err != nil {
+		return err
+	}
+	if csvErr := t.db.Table().BulkUpsert(ctx, fullPath, data); csvErr != nil {
+		return errors.Join(err, csvErr)
+	}
+	t.csvFallbackUntil.Store(time.Now().Add(csvFallbackPeriod).UnixNano())
+	log.Warn(fmt.Sprintf("database '%s' rejected the Arrow payload, falling back to CSV for %s: %v",
+		t.name, csvFallbackPeriod, err))
+
+	return nil
+}
+
+// arrowRejected reports whether the database does not accept the format of the Arrow payload,
+// rather than the values of its rows.
+func arrowRejected(err error) bool {
+	if ydb.IsOperationError(err, Ydb.StatusIds_UNSUPPORTED) {
+		return true
+	}
+
+	return ydb.IsOperationError(err, Ydb.StatusIds_BAD_REQUEST) && unsupportedFormat(err.Error())
+}
+
+func unsupportedFormat(message string) bool {
+	message = strings.ToLower(message)
+	for _, marker := range unsupportedFormatMessages {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// arrow encodes the rows to the serialized Arrow record batch, without the schema.
+func (l *payloadLayout) arrow(rows []row) ([]byte, error) {
+	b := array.NewRecordBuilder(memory.DefaultAllocator, l.schema)
+	defer b.Release()
+
+	for i, field := range b.Fields() {
+		field.Reserve(len(rows))
+		for _, r := range rows {
+			if err := appendCell(field, r.cells[i]); err != nil {
+				return nil, fmt.Errorf("column '%s': %w", l.columns[i].Name, err)
+			}
+		}
+	}
+
+	record := b.NewRecord()
+	defer record.Release()
+
+	messages, err := arrowMessages(l.schema, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages[1], nil
+}
+
+func appendCell(b array.Builder, cell interface{}) error {
+	if cell == nil {
+		b.AppendNull()
+
+		return nil
+	}
+
+	switch b := b.(type) {
+	case *array.TimestampBuilder:
+		if v, ok := cell.(time.Time); ok {
+			b.Append(arrow.Timestamp(v.UnixMicro()))
+
+			return nil
+		}
+	case *array.BinaryBuilder:
+		switch v := cell.(type) {
+		case []byte:
+			b.Append(v)
+
+			return nil
+		case string:
+			b.AppendString(v)
+
+			return nil
+		}
+	case *array.StringBuilder:
+		if v, ok := cell.(string); ok {
+			b.Append(v)
+
+			return nil
+		}
+	case *array.Uint64Builder:
+		if v, ok := cell.(uint64); ok {
+			b.Append(v)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unexpected value of type %T for %s", cell, b.Type())
+}
+
+// arrowMessages serializes the schema and the record, if it is set, as the separate IPC messages.
+func arrowMessages(schema *arrow.Schema, record arrow.Record) ([][]byte, error) {
+	var pw messageWriter
+	w := ipc.NewWriterWithPayloadWriter(&pw, ipc.WithSchema(schema))
+	if record != nil {
+		if err := w.Write(record); err != nil {
+			return nil, fmt.Errorf("failed to serialize arrow record batch: %w", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to serialize arrow record batch: %w", err)
+	}
+
+	return pw.messages, nil
+}
+
+// messageWriter keeps each IPC message in a separate buffer, in the encapsulated format of the stream:
+// the continuation marker, the length of the padded metadata, the metadata and the body.
+type messageWriter struct {
+	messages [][]byte
+}
+
+func (w *messageWriter) Start() error { return nil }
+
+func (w *messageWriter) Close() error { return nil }
+
+func (w *messageWriter) WritePayload(p ipc.Payload) error {
+	meta := p.Meta()
+	defer meta.Release()
+
+	var buf bytes.Buffer
+	metaLen := bitutil.CeilByte64(int64(meta.Len())+8) - 8
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[:4], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(metaLen))
+	buf.Write(prefix[:])
+	buf.Write(meta.Bytes())
+	buf.Write(make([]byte, int(metaLen)-meta.Len()))
+	if err := p.SerializeBody(&buf); err != nil {
+		return err
+	}
+	w.messages = append(w.messages, buf.Bytes())
+
+	return nil
+}
+
+// csv encodes the rows to the CSV text with the header, and returns the NULL marker of the text.
+func (l *payloadLayout) csv(rows []row) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	record := make([]string, len(l.columns))
+	for i, column := range l.columns {
+		record[i] = column.Name
+	}
+	if err := w.Write(record); err != nil {
+		return nil, "", err
+	}
+	null := csvNullValue(rows)
+	for _, r := range rows {
+		for i, cell := range r.cells {
+			record[i] = csvCell(cell, null)
+		}
+		if err := w.Write(record); err != nil {
+			return nil, "", err
+		}
+	}
+	w.Flush()
+
+	return buf.Bytes(), null, w.Error()
+}
+
+// csvNullValue returns the NULL marker which is not the same as any value of the rows.
+func csvNullValue(rows []row) string {
+	var taken map[string]bool
+	for _, r := range rows {
+		for _, cell := range r.cells {
+			var v string
+			switch cell := cell.(type) {
+			case string:
+				v = cell
+			case []byte:
+				if !bytes.HasPrefix(cell, []byte(csvNull)) {
+					continue
+				}
+				v = string(cell)
+			default:
+				continue
+			}
+			if !strings.HasPrefix(v, csvNull) {
+				continue
+			}
+			if taken == nil {
+				taken = make(map[string]bool)
+			}
+			taken[v] = true
+		}
+	}
+
+	null := csvNull
+	for i := 0; taken[null]; i++ {
+		null = csvNull + strconv.Itoa(i)
+	}
+
+	return null
+}
+
+func csvCell(cell interface{}, null string) string {
+	switch v := cell.(type) {
+	case nil:
+		return null
+	case time.Time:
+		return v.UTC().Format(csvTimestampLayout)
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+func testPayloadMapping(t testing.TB, format string) *fieldMapping {
+	columns := map[string]options.Column{
+		config.KeyTimestamp: {Name: "timestamp", Type: types.TypeTimestamp},
+		config.KeyInput:     {Name: "input", Type: types.TypeText},
+		config.KeySeq:       {Name: "seq", Type: types.Optional(types.TypeUint64)},
+		config.KeyOthers:    {Name: "others", Type: types.Optional(types.TypeJSON)},
+		"message":           {Name: "message", Type: types.Optional(types.TypeBytes)},
+		"level":             {Name: "level", Type: types.TypeText},
+		"user":              {Name: "user", Type: types.Optional(types.TypeText)},
+	}
+	layout, err := newPayloadLayout(format, columns, nil)
+	require.NoError(t, err)
+
+	return &fieldMapping{columns: columns, layout: layout}
+}
+
+func testPayloadEvents(n int) []*model.Event {
+	events := make([]*model.Event, 0, n)
+	for i := range n {
+		message := map[string]interface{}{
+			"message": []byte(fmt.Sprintf("request %d served in %dms", i, i%100)),
+			"level":   "info",
+			"host":    []byte("app-1"),
+		}
+		if i%2 == 0 {
+			message["user"] = []byte("alice")
+		}
+		events = append(events, &model.Event{
+			Timestamp: time.Date(2024, 5, 1, 10, 0, i, 0, time.UTC),
+			Metadata:  "app",
+			Seq:       uint64(i),
+			Message:   message,
+		})
+	}
+
+	return events
+}
+
+func TestPayloadArrow(t *testing.T) {
+	s := &YDB{cfg: &config.Config{}}
+	mapping := testPayloadMapping(t, config.BulkUpsertFormatArrow)
+	events := testPayloadEvents(3)
+
+	rows, sizes, err := s.convertRows(mapping, events)
+	require.NoError(t, err)
+	_, structSizes, err := s.convertRows(&fieldMapping{columns: mapping.columns}, events)
+	require.NoError(t, err)
+	require.Equal(t, structSizes, sizes)
+
+	batch, err := mapping.layout.arrow(rows)
+	require.NoError(t, err)
+
+	// the schema and the record batch are the messages of the IPC stream
+	stream := append(append([]byte{}, mapping.layout.schemaMessage...), batch...)
+	r, err := ipc.NewReader(bytes.NewReader(stream))
+	require.NoError(t, err)
+	defer r.Release()
+	require.True(t, r.Next())
+	record := r.Record()
+	require.Equal(t, int64(3), record.NumRows())
+
+	column := func(name string) arrow.Array {
+		indices := record.Schema().FieldIndices(name)
+		require.Len(t, indices, 1)
+
+		return record.Column(indices[0])
+	}
+	require.Equal(t, arrow.Timestamp(events[1].Timestamp.UnixMicro()), column("timestamp").(*array.Timestamp).Value(1))
+	require.Equal(t, "app", column("input").(*array.String).Value(0))
+	require.Equal(t, uint64(2), column("seq").(*array.Uint64).Value(2))
+	require.Equal(t, []byte("request 1 served in 1ms"), column("message").(*array.Binary).Value(1))
+	require.Equal(t, "alice", column("user").(*array.String).Value(0))
+	require.True(t, column("user").IsNull(1))
+	require.JSONEq(t, `{"host": "app-1"}`, column("others").(*array.String).Value(2))
+}
+
+func TestPayloadCSV(t *testing.T) {
+	s := &YDB{cfg: &config.Config{}}
+	mapping := testPayloadMapping(t, config.BulkUpsertFormatCSV)
+
+	rows, _, err := s.convertRows(mapping, testPayloadEvents(2))
+	require.NoError(t, err)
+	data, null, err := mapping.layout.csv(rows)
+	require.NoError(t, err)
+	require.Equal(t, `\N`, null)
+
+	require.Equal(t, `input,level,message,others,seq,timestamp,user
+app,info,request 0 served in 0ms,"{""host"":""app-1""}",0,2024-05-01T10:00:00.000000Z,alice
+app,info,request 1 served in 1ms,"{""host"":""app-1""}",1,2024-05-01T10:00:01.000000Z,\N
+`, string(data))
+}
+
+func TestPayloadCSVNullCollision(t *testing.T) {
+	s := &YDB{cfg: &config.Config{}}
+	mapping := testPayloadMapping(t, config.BulkUpsertFormatCSV)
+	events := testPayloadEvents(2)
+	events[0].Message["level"] = `\N`
+	events[1].Message["message"] = []byte(`\N0`)
+
+	rows, _, err := s.convertRows(mapping, events)
+	require.NoError(t, err)
+	data, null, err := mapping.layout.csv(rows)
+	require.NoError(t, err)
+	require.Equal(t, `\N1`, null)
+
+	require.Equal(t, `input,level,message,others,seq,timestamp,user
+app,\N,request 0 served in 0ms,"{""host"":""app-1""}",0,2024-05-01T10:00:00.000000Z,alice
+app,info,\N0,"{""host"":""app-1""}",1,2024-05-01T10:00:01.000000Z,\N1
+`, string(data))
+}
+
+func TestPayloadBinaryColumns(t *testing.T) {
+	columns := map[string]options.Column{
+		"message": {Name: "message", Type: types.Optional(types.TypeBytes)},
+		"level":   {Name: "level", Type: types.TypeText},
+	}
+	binary := map[string]bool{"message": true}
+
+	_, err := newPayloadLayout(config.BulkUpsertFormatCSV, columns, binary)
+	require.Error(t, err)
+
+	layout, err := newPayloadLayout(config.BulkUpsertFormatArrow, columns, binary)
+	require.NoError(t, err)
+	require.True(t, layout.binary, "the Arrow payload is not written again as CSV")
+
+	layout, err = newPayloadLayout(config.BulkUpsertFormatCSV, columns, nil)
+	require.NoError(t, err)
+	require.False(t, layout.binary)
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	require.True(t, unsupportedFormat("Arrow format is not supported for the row tables"))
+	require.True(t, unsupportedFormat("Unsupported data format"))
+	require.False(t, unsupportedFormat("Cannot parse value of column 'seq'"))
+	require.False(t, arrowRejected(nil))
+}
+
+func TestPayloadUnsupportedColumn(t *testing.T) {
+	_, err := newPayloadLayout(config.BulkUpsertFormatArrow, map[string]options.Column{
+		"level": {Name: "level", Type: types.TypeInt32},
+	}, nil)
+	require.Error(t, err)
+}
+
+// BenchmarkPayload measures the conversion of a portion of wide rows and its encoding to the payload.
+// The rows payload is also converted to protobuf by the SDK, which is not measured here.
+func BenchmarkPayload(b *testing.B) {
+	events := testPayloadEvents(1000)
+	for _, event := range events {
+		for i := range 20 {
+			event.Message[fmt.Sprintf("field%d", i)] = []byte("value of the field")
+		}
+	}
+
+	for _, format := range []string{config.BulkUpsertFormatRows, config.BulkUpsertFormatArrow, config.BulkUpsertFormatCSV} {
+		b.Run(format, func(b *testing.B) {
+			s := &YDB{cfg: &config.Config{}}
+			mapping := testPayloadMapping(b, format)
+			for i := range 20 {
+				field := fmt.Sprintf("field%d", i)
+				mapping.columns[field] = options.Column{Name: field, Type: types.Optional(types.TypeText)}
+			}
+			layout, err := newPayloadLayout(format, mapping.columns, nil)
+			require.NoError(b, err)
+			mapping.layout = layout
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				rows, _, err := s.convertRows(mapping, events)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if layout == nil {
+					_ = structList(rows)
+				} else if _, err = layout.bulkUpsertData(rows, format); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
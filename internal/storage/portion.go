@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+// row is the event converted to the table columns: the struct value for the rows payload,
+// or the cells in the order of the payload layout for the Arrow and CSV payloads.
+type row struct {
+	value types.Value
+	cells []interface{}
+	key   []interface{} // cells of the sort key columns, nil if the rows are not ordered
+	shard int           // index of the shard key range of the key
+}
+
+// structList returns the list of the struct values of the rows.
+func structList(rows []row) types.Value {
+	values := make([]types.Value, 0, len(rows))
+	for _, r := range rows {
+		values = append(values, r.value)
+	}
+
+	return types.ListValue(values...)
+}
+
+// portion is a part of the flushed chunk which is written by a single BulkUpsert request.
+type portion struct {
+	events []*model.Event
+	rows   []row
+	sizes  []int // serialized sizes of the rows
+	bytes  int   // serialized size of the rows in the request
+	err    error // last write error, nil if the portion is written
+}
+
+func portionsEvents(portions []*portion) []*model.Event {
+	var events []*model.Event
+	for _, p := range portions {
+		events = append(events, p.events...)
+	}
+
+	return events
+}
+
+func portionsError(portions []*portion) error {
+	errs := make([]error, 0, len(portions))
+	for _, p := range portions {
+		errs = append(errs, p.err)
+	}
+
+	return errors.Join(errs...)
+}
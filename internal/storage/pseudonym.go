@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"sync"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+)
+
+// minPseudonymKeySize is the minimal length of the HMAC key, shorter keys are easy to brute force.
+const minPseudonymKeySize = 16
+
+// pseudonymizer replaces the identifiers with their HMAC-SHA256 under the active key of the key file.
+// The equal identifiers have the equal pseudonyms as long as the key is the same, so the rows can be
+// joined and counted by them.
+type pseudonymizer struct {
+	keyID   string
+	columns map[string]bool
+	macs    sync.Pool
+}
+
+// pseudonymKeyFile is the format of the key file:
+//
+//	{"active": "2024-05", "keys": {"2024-01": "<base64 key>", "2024-05": "<base64 key>"}}
+type pseudonymKeyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+func newPseudonymizer(columns []string, keyFile string) (*pseudonymizer, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file '%s': %w", keyFile, err)
+	}
+	var f pseudonymKeyFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to decode key file '%s': %w", keyFile, err)
+	}
+	encoded, has := f.Keys[f.Active]
+	if !has {
+		return nil, fmt.Errorf("no active key '%s' in key file '%s'", f.Active, keyFile)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("key '%s' of key file '%s' is not base64 encoded: %w", f.Active, keyFile, err)
+	}
+	if len(key) < minPseudonymKeySize {
+		return nil, fmt.Errorf("key '%s' of key file '%s' must be at least %d bytes long",
+			f.Active, keyFile, minPseudonymKeySize)
+	}
+
+	p := &pseudonymizer{keyID: f.Active, columns: make(map[string]bool, len(columns))}
+	for _, column := range columns {
+		p.columns[column] = true
+	}
+	p.macs.New = func() interface{} {
+		return hmac.New(sha256.New, key)
+	}
+
+	return p, nil
+}
+
+// pseudonymize returns the pseudonym of the value if the column is pseudonymized: the HMAC itself
+// for Bytes columns, its hex for Text columns and its first 8 bytes for Uint64 columns.
+func (p *pseudonymizer) pseudonymize(column options.Column, v interface{}) interface{} {
+	if p == nil || v == nil || !p.columns[column.Name] {
+		return v
+	}
+
+	mac, _ := p.macs.Get().(hash.Hash)
+	defer p.macs.Put(mac)
+
+	mac.Reset()
+	switch v := v.(type) {
+	case string:
+		mac.Write([]byte(v))
+	case []byte:
+		mac.Write(v)
+	case map[interface{}]interface{}:
+		j, _ := json.Marshal(convertByteFieldsToString(v))
+		mac.Write(j)
+	default:
+		fmt.Fprint(mac, v)
+	}
+	sum := mac.Sum(nil)
+
+	_, columnType := convertTypeIfOptional(column.Type)
+	switch yqlType(columnType) {
+	case textType:
+		return hex.EncodeToString(sum)
+	case uint64Type:
+		return binary.BigEndian.Uint64(sum)
+	default:
+		return sum
+	}
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+)
+
+func testPseudonymizer(t *testing.T, active string) *pseudonymizer {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys := fmt.Sprintf(`{"active": %q, "keys": {"v1": %q, "v2": %q}}`, active,
+		base64.StdEncoding.EncodeToString([]byte(strings.Repeat("1", 32))),
+		base64.StdEncoding.EncodeToString([]byte(strings.Repeat("2", 32))))
+	require.NoError(t, os.WriteFile(path, []byte(keys), 0o600))
+
+	p, err := newPseudonymizer([]string{"user_bytes", "user_text", "user_id"}, path)
+	require.NoError(t, err)
+
+	return p
+}
+
+func TestPseudonymize(t *testing.T) {
+	var (
+		p      = testPseudonymizer(t, "v1")
+		bytes  = options.Column{Name: "user_bytes", Type: types.Optional(types.TypeBytes)}
+		text   = options.Column{Name: "user_text", Type: types.TypeText}
+		number = options.Column{Name: "user_id", Type: types.Optional(types.TypeUint64)}
+		plain  = options.Column{Name: "message", Type: types.TypeText}
+	)
+
+	sum, ok := p.pseudonymize(bytes, "alice").([]byte)
+	require.True(t, ok)
+	require.Len(t, sum, 32)
+
+	hexSum, ok := p.pseudonymize(text, []byte("alice")).(string)
+	require.True(t, ok)
+	require.Equal(t, fmt.Sprintf("%x", sum), hexSum)
+
+	id, ok := p.pseudonymize(number, "alice").(uint64)
+	require.True(t, ok)
+	require.NotEqual(t, id, p.pseudonymize(number, "bob"))
+	require.Equal(t, id, p.pseudonymize(number, "alice"))
+
+	require.Equal(t, "alice", p.pseudonymize(plain, "alice"))
+	require.Nil(t, p.pseudonymize(number, nil))
+
+	// the pseudonyms change with the key
+	rotated := testPseudonymizer(t, "v2")
+	require.Equal(t, "v2", rotated.keyID)
+	require.NotEqual(t, id, rotated.pseudonymize(number, "alice"))
+}
+
+func TestPseudonymizerKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"active": "v1", "keys": {"v1": "c2hvcnQ="}}`), 0o600))
+	_, err := newPseudonymizer([]string{"user_id"}, path)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"active": "v2", "keys": {}}`), 0o600))
+	_, err = newPseudonymizer([]string{"user_id"}, path)
+	require.Error(t, err)
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/query"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+)
+
+// tablePlaceholder is replaced in the write query by the full path of the table.
+const tablePlaceholder = "{table}"
+
+var rowsDeclaration = regexp.MustCompile(`(?i)\bDECLARE\s+\$rows\b`)
+
+// writeQuery runs the YQL statement of the user with the rows as the $rows parameter, instead of BulkUpsert.
+// It allows the INSERT-only semantics, the conditional upserts and the atomic writes to several tables.
+type writeQuery struct {
+	template  string
+	txControl *query.TransactionControl
+}
+
+func newWriteQuery(cfg *config.Config) *writeQuery {
+	if cfg.WriteMode != config.WriteModeQuery {
+		return nil
+	}
+
+	q := &writeQuery{template: cfg.WriteQuery, txControl: query.SerializableReadWriteTxControl(query.CommitTx())}
+	if cfg.WriteQueryTxMode == config.WriteQueryTxNone {
+		q.txControl = query.NoTx()
+	}
+
+	return q
+}
+
+// rowsType returns the type of the $rows parameter: the list of the structs having the mapped columns.
+func rowsType(mapping *fieldMapping) string {
+	fields := make(map[string]string, len(mapping.columns))
+	for _, column := range mapping.columns {
+		fields[column.Name] = column.Type.Yql()
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	members := make([]string, 0, len(names))
+	for _, name := range names {
+		members = append(members, "`"+name+"`: "+fields[name])
+	}
+
+	return "List<Struct<" + strings.Join(members, ", ") + ">>"
+}
+
+// text returns the statement for the table, declaring the $rows parameter unless the template declares it.
+func (q *writeQuery) text(fullPath string, mapping *fieldMapping) string {
+	text := strings.ReplaceAll(q.template, tablePlaceholder, fullPath)
+	if rowsDeclaration.MatchString(text) {
+		return text
+	}
+
+	return "DECLARE $rows AS " + rowsType(mapping) + ";\n" + text
+}
+
+// writeList writes the rows converted with the mapping to the table: by BulkUpsert, or by the write query if it is set.
+func (s *YDB) writeList(ctx context.Context, t *target, fullPath string, mapping *fieldMapping, rows []row) error {
+	if s.query != nil {
+		return t.db.Query().Exec(ctx, s.query.text(fullPath, mapping),
+			query.WithParameters(ydb.ParamsBuilder().Param("$rows").Any(structList(rows)).Build()),
+			query.WithTxControl(s.query.txControl),
+		)
+	}
+	if mapping.layout != nil {
+		return s.bulkUpsertPayload(ctx, t, fullPath, mapping.layout, rows)
+	}
+
+	return t.db.Table().BulkUpsert(ctx, fullPath, table.BulkUpsertDataRows(structList(rows)))
+}
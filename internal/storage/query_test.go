@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+)
+
+func TestWriteQueryText(t *testing.T) {
+	mapping := testMapping("message")
+
+	q := newWriteQuery(&config.Config{
+		WriteMode:        config.WriteModeQuery,
+		WriteQuery:       "INSERT INTO `{table}` SELECT * FROM AS_TABLE($rows);",
+		WriteQueryTxMode: config.WriteQueryTxSerializable,
+	})
+	require.Equal(t,
+		"DECLARE $rows AS List<Struct<`input`: Utf8, `message`: Optional<Utf8>, `timestamp`: Timestamp>>;\n"+
+			"INSERT INTO `/local/logs` SELECT * FROM AS_TABLE($rows);",
+		q.text("/local/logs", mapping))
+
+	declared := newWriteQuery(&config.Config{
+		WriteMode:  config.WriteModeQuery,
+		WriteQuery: "declare $rows as List<Struct<message: Utf8>>;\nUPSERT INTO logs SELECT * FROM AS_TABLE($rows);",
+	})
+	require.Equal(t, declared.template, declared.text("/local/logs", mapping))
+
+	require.Nil(t, newWriteQuery(&config.Config{WriteMode: config.WriteModeBulkUpsert}))
+}
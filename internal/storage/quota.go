@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/ratelimiter"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+)
+
+var (
+	// ErrQuotaExceeded is returned when the cluster-wide quota denied the units for the write.
+	ErrQuotaExceeded = fmt.Errorf("ingest quota exceeded: %w", ErrRetryLater)
+
+	// errQuotaSpool makes the portion denied by the quota to be passed to the fallback.
+	errQuotaSpool = errors.New("ingest quota exceeded, passing to fallback")
+)
+
+// quota acquires the units of the YDB rate limiter resource before each write, so all the agents
+// writing to the database share the budget configured in the coordination node.
+type quota struct {
+	client   ratelimiter.Client
+	node     string
+	resource string
+	unit     string
+	action   string
+	timeout  time.Duration
+	wait     time.Duration // the longest wait for the units with the wait action
+}
+
+func newQuota(ctx context.Context, db *ydb.Driver, cfg *config.Config) (*quota, error) {
+	if cfg.RateLimiterResource == "" {
+		return nil, nil //nolint:nilnil
+	}
+
+	node := cfg.RateLimiterCoordinationNode
+	if !strings.HasPrefix(node, "/") {
+		node = path.Join(db.Name(), node)
+	}
+
+	q := &quota{
+		client:   db.Ratelimiter(),
+		node:     node,
+		resource: cfg.RateLimiterResource,
+		unit:     cfg.RateLimiterUnit,
+		action:   cfg.RateLimiterAction,
+		timeout:  cfg.RateLimiterTimeout,
+		wait:     cfg.UpsertQueueTimeout,
+	}
+	// without the queue timeout the portion waits for the units no longer than for its write
+	if q.wait <= 0 {
+		q.wait = cfg.WriteTimeout
+	}
+	if q.wait <= 0 {
+		q.wait = config.DefaultWriteTimeout
+	}
+
+	if _, err := q.client.DescribeResource(ctx, q.node, q.resource); err != nil {
+		return nil, fmt.Errorf("failed to describe rate limiter resource '%s' of coordination node '%s': %w",
+			q.resource, q.node, err)
+	}
+
+	return q, nil
+}
+
+func (q *quota) amount(p *portion) uint64 {
+	if q.unit == config.RateLimiterUnitBytes {
+		return uint64(p.bytes)
+	}
+
+	return uint64(len(p.rows))
+}
+
+// acquire takes the units required to write the portion. When the units are denied,
+// the configured action decides whether to keep waiting, retry later or pass the portion to the fallback.
+// The wait is bounded by UpsertQueueTimeout, or by WriteTimeout if the queue timeout is not set.
+func (q *quota) acquire(ctx context.Context, p *portion) error {
+	if q == nil {
+		return nil
+	}
+
+	amount := q.amount(p)
+	if amount == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, q.wait)
+	defer cancel()
+
+	for {
+		err := q.client.AcquireResource(ctx, q.node, q.resource, amount,
+			ratelimiter.WithAcquire(),
+			ratelimiter.WithOperationTimeout(q.timeout),
+		)
+		switch {
+		case err == nil:
+			return nil
+		case !ydb.IsRatelimiterAcquireError(err):
+			return fmt.Errorf("failed to acquire %d units of rate limiter resource '%s': %w", amount, q.resource, err)
+		case q.action == config.RateLimiterActionSpool:
+			return errQuotaSpool
+		case q.action == config.RateLimiterActionRetry:
+			return ErrQuotaExceeded
+		case ctx.Err() != nil:
+			return ErrQuotaExceeded
+		}
+	}
+}
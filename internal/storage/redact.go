@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
+)
+
+// detectors are the built-in patterns of the personal data. The matches are redacted
+// only if they pass the check, when the pattern alone gives too many false positives,
+// and only if they are not adjacent to the characters which would continue the match.
+var detectors = map[string]struct {
+	pattern  string
+	valid    func(string) bool
+	adjacent func(byte) bool
+}{
+	"email":  {pattern: `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`},
+	"card":   {pattern: `\b\d(?:[ \-]?\d){12,18}\b`, valid: luhn},
+	"ipv4":   {pattern: `\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`},
+	"ipv6":   {pattern: `(?i)(?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{0,4}`, valid: isIPv6, adjacent: isAddressChar},
+	"bearer": {pattern: `(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`},
+}
+
+// luhn checks the card number checksum.
+func luhn(number string) bool {
+	sum, digits := 0, 0
+	for i := len(number) - 1; i >= 0; i-- {
+		if number[i] < '0' || number[i] > '9' {
+			continue
+		}
+		d := int(number[i] - '0')
+		if digits%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+
+	return digits >= 13 && sum%10 == 0
+}
+
+func isIPv6(address string) bool {
+	return net.ParseIP(address) != nil
+}
+
+// isAddressChar reports whether the character may continue the address, so the part of
+// the identifiers like 'std::vector' is not taken for the address.
+func isAddressChar(c byte) bool {
+	return c == ':' || c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+type redactRule struct {
+	name        string
+	re          *regexp.Regexp
+	valid       func(string) bool
+	adjacent    func(byte) bool
+	fields      []string // all the values if empty
+	action      string
+	replacement string
+	keep        int
+	redactions  *metrics.Counter
+}
+
+// redactor masks the personal data in the records before the rows are built.
+type redactor struct {
+	rules []*redactRule
+}
+
+// newRedactor compiles the rules, it returns nil if there are no rules.
+func newRedactor(rules []config.RedactionRule, table string) (*redactor, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	r := &redactor{rules: make([]*redactRule, 0, len(rules))}
+	for _, rule := range rules {
+		pattern := rule.Pattern
+		var (
+			valid    func(string) bool
+			adjacent func(byte) bool
+		)
+		if rule.Detector != "" {
+			d, has := detectors[strings.ToLower(rule.Detector)]
+			if !has {
+				return nil, fmt.Errorf("unknown detector '%s' of redaction rule '%s'", rule.Detector, rule.Name)
+			}
+			pattern, valid, adjacent = d.pattern, d.valid, d.adjacent
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern of redaction rule '%s': %w", rule.Name, err)
+		}
+
+		r.rules = append(r.rules, &redactRule{
+			name:        rule.Name,
+			re:          re,
+			valid:       valid,
+			adjacent:    adjacent,
+			fields:      rule.Fields,
+			action:      rule.Action,
+			replacement: rule.Replacement,
+			keep:        *rule.Keep,
+			redactions: metrics.NewCounter("fluentbit_ydb_redactions_total",
+				"Number of the matches redacted by the rule.", "table", table, "rule", rule.Name),
+		})
+	}
+
+	return r, nil
+}
+
+// applies reports whether the rule redacts the value of the field at the dot separated path.
+func (rule *redactRule) applies(path string) bool {
+	if len(rule.fields) == 0 {
+		return true
+	}
+	for _, field := range rule.fields {
+		if path == field || strings.HasPrefix(path, field+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule *redactRule) redact(value string) string {
+	var (
+		b    strings.Builder
+		n    uint64
+		last int
+	)
+	for _, m := range rule.re.FindAllStringIndex(value, -1) {
+		match := value[m[0]:m[1]]
+		if !rule.matches(value, m[0], m[1]) {
+			continue
+		}
+		n++
+
+		b.WriteString(value[last:m[0]])
+		switch rule.action {
+		case config.RedactMask:
+			b.WriteString(mask(match, rule.keep))
+		case config.RedactDrop:
+		default:
+			b.WriteString(rule.replacement)
+		}
+		last = m[1]
+	}
+	if n == 0 {
+		return value
+	}
+	b.WriteString(value[last:])
+	rule.redactions.Add(n)
+
+	return b.String()
+}
+
+// matches reports whether the match at value[start:end] is to be redacted.
+func (rule *redactRule) matches(value string, start, end int) bool {
+	if rule.adjacent != nil &&
+		((start > 0 && rule.adjacent(value[start-1])) || (end < len(value) && rule.adjacent(value[end]))) {
+		return false
+	}
+
+	return rule.valid == nil || rule.valid(value[start:end])
+}
+
+// mask replaces the letters and digits with '*', except the last keep ones.
+func mask(match string, keep int) string {
+	runes := []rune(match)
+	for i := len(runes) - 1; i >= 0; i-- {
+		if !unicode.IsLetter(runes[i]) && !unicode.IsDigit(runes[i]) {
+			continue
+		}
+		if keep > 0 {
+			keep--
+
+			continue
+		}
+		runes[i] = '*'
+	}
+
+	return string(runes)
+}
+
+// redact returns the message with the matches redacted. The message itself is not modified,
+// as the events are converted again when the table schema changes; the unchanged values are shared.
+func (r *redactor) redact(message map[string]interface{}) map[string]interface{} {
+	var redacted map[string]interface{}
+	for field, value := range message {
+		v, changed := r.value(field, value)
+		if !changed {
+			continue
+		}
+		if redacted == nil {
+			redacted = make(map[string]interface{}, len(message))
+			for k, v := range message {
+				redacted[k] = v
+			}
+		}
+		redacted[field] = v
+	}
+	if redacted == nil {
+		return message
+	}
+
+	return redacted
+}
+
+// value redacts the strings in the value at the path, including the ones in the nested maps and lists.
+func (r *redactor) value(path string, value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		redacted := r.text(path, v)
+
+		return redacted, redacted != v
+	case []byte:
+		redacted := r.text(path, string(v))
+		if redacted == string(v) {
+			return v, false
+		}
+
+		return []byte(redacted), true
+	case map[interface{}]interface{}:
+		var copied map[interface{}]interface{}
+		for key, item := range v {
+			redacted, changed := r.value(path+"."+keyString(key), item)
+			if !changed {
+				continue
+			}
+			if copied == nil {
+				copied = make(map[interface{}]interface{}, len(v))
+				for k, item := range v {
+					copied[k] = item
+				}
+			}
+			copied[key] = redacted
+		}
+		if copied == nil {
+			return v, false
+		}
+
+		return copied, true
+	case []interface{}:
+		var copied []interface{}
+		for i, item := range v {
+			redacted, changed := r.value(path, item)
+			if !changed {
+				continue
+			}
+			if copied == nil {
+				copied = append([]interface{}{}, v...)
+			}
+			copied[i] = redacted
+		}
+		if copied == nil {
+			return v, false
+		}
+
+		return copied, true
+	default:
+		return value, false
+	}
+}
+
+func (r *redactor) text(path, value string) string {
+	for _, rule := range r.rules {
+		if rule.applies(path) {
+			value = rule.redact(value)
+		}
+	}
+
+	return value
+}
+
+func keyString(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	default:
+		return fmt.Sprint(k)
+	}
+}
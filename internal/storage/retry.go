@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3/retry"
+)
+
+// ErrRetryLater marks the failures after which Fluent Bit should deliver the chunk again.
+var ErrRetryLater = errors.New("retry later")
+
+// IsRetryable reports whether the write may succeed if it is repeated later.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, ErrRetryLater) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	return retry.Check(err).MustRetry(true)
+}
+
+type backoff struct {
+	base time.Duration
+	max  time.Duration
+}
+
+// delay returns the exponential delay with jitter for the given (zero-based) attempt.
+func (b backoff) delay(attempt int) time.Duration {
+	if b.base <= 0 {
+		return 0
+	}
+
+	d := b.base
+	for i := 0; i < attempt && (b.max <= 0 || d < b.max); i++ {
+		d *= 2
+	}
+	if b.max > 0 && d > b.max {
+		d = b.max
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) //nolint:gosec
+}
+
+// retryQueue keeps the portions which failed to be written and sends them again
+// with backoff, so the portions that have already been written are not repeated.
+type retryQueue struct {
+	portions    []*portion
+	backoff     backoff
+	maxAttempts int
+}
+
+// run re-sends the queued portions until all of them are written, the attempts are
+// exhausted, the remaining errors are not retryable or the context is done. It returns
+// the portions which are still not written.
+func (q *retryQueue) run(ctx context.Context, send func([]*portion) []*portion) []*portion {
+	for attempt := 0; attempt < q.maxAttempts && len(q.portions) > 0; attempt++ {
+		var retryable, rest []*portion
+		for _, p := range q.portions {
+			if IsRetryable(p.err) && !errors.Is(p.err, ErrCircuitOpen) {
+				retryable = append(retryable, p)
+			} else {
+				rest = append(rest, p)
+			}
+		}
+		if len(retryable) == 0 {
+			break
+		}
+
+		timer := time.NewTimer(q.backoff.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return q.portions
+		case <-timer.C:
+		}
+
+		q.portions = append(rest, send(retryable)...)
+	}
+
+	return q.portions
+}
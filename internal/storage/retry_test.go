@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := backoff{base: 100 * time.Millisecond, max: time.Second}
+
+	for attempt, expected := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		t.Run(fmt.Sprintf("attempt %d", attempt), func(t *testing.T) {
+			d := b.delay(attempt)
+
+			require.GreaterOrEqual(t, d, expected/2)
+			require.LessOrEqual(t, d, expected)
+		})
+	}
+}
+
+func TestRetryQueueRetriesOnlyFailedPortions(t *testing.T) {
+	written := &portion{err: fmt.Errorf("overloaded: %w", ErrRetryLater)}
+	failing := &portion{err: fmt.Errorf("overloaded: %w", ErrRetryLater)}
+	broken := &portion{err: errors.New("bad request")}
+
+	var sent [][]*portion
+	q := retryQueue{
+		portions:    []*portion{written, failing, broken},
+		maxAttempts: 3,
+	}
+	rest := q.run(context.Background(), func(portions []*portion) (failed []*portion) {
+		sent = append(sent, portions)
+		for _, p := range portions {
+			if p == written {
+				p.err = nil
+
+				continue
+			}
+			failed = append(failed, p)
+		}
+
+		return failed
+	})
+
+	require.ElementsMatch(t, []*portion{failing, broken}, rest)
+	require.Len(t, sent, 3)
+	require.ElementsMatch(t, []*portion{written, failing}, sent[0])
+	require.Equal(t, []*portion{failing}, sent[1])
+	require.Equal(t, []*portion{failing}, sent[2])
+}
+
+func TestIsRetryable(t *testing.T) {
+	require.False(t, IsRetryable(nil))
+	require.False(t, IsRetryable(errors.New("bad request")))
+	require.True(t, IsRetryable(fmt.Errorf("queue timeout: %w", ErrRetryLater)))
+}
+
+func TestRetryQueueStopsOnContextDone(t *testing.T) {
+	failing := &portion{err: fmt.Errorf("overloaded: %w", ErrRetryLater)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	q := retryQueue{
+		portions:    []*portion{failing},
+		backoff:     backoff{base: time.Hour},
+		maxAttempts: 3,
+	}
+	rest := q.run(ctx, func([]*portion) []*portion {
+		t.Fatal("portions must not be sent after the context is done")
+
+		return nil
+	})
+
+	require.Equal(t, []*portion{failing}, rest)
+}
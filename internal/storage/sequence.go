@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+// The state of the failed flushes is kept for their retry within the limits. Fluent Bit retries a chunk
+// within its scheduler cap, 2000 seconds by default.
+const (
+	maxRetriedFlushes  = 1024
+	maxRetriedFlushAge = time.Hour
+)
+
+// errPartiallyWritten marks the failed writes after which some of the events are in the database.
+var errPartiallyWritten = errors.New("some of the events are written")
+
+// sequencer numbers the events of each tag sent by the agent, so the gaps in the written
+// numbers reveal the lost records. The last numbers are stored into the state file before
+// the events are written, so the numbers keep increasing across the restarts.
+//
+// Fluent Bit delivers the failed chunk again as new events, so the numbers of a failed flush
+// are kept for its retry. When no event of the flush was written, the numbers are rolled back,
+// unless the following flushes have already taken the next ones. Otherwise the numbers are
+// remembered for the events of the flush, and assigned to the same events delivered again,
+// so the written events are written again with the same numbers.
+type sequencer struct {
+	mu      sync.Mutex
+	path    string
+	last    map[string]uint64       // {tag : last assigned number}
+	written map[string]uint64       // {tag : last number of the written events}
+	version uint64                  // incremented on each change of the numbers
+	stored  uint64                  // version in the state file
+	retries failedFlushes[[]uint64] // numbers of the events of the failed flushes
+
+	storeMu sync.Mutex // serializes the writes of the state file
+}
+
+type sequenceState struct {
+	AgentID   string            `json:"agent_id"`
+	Sequences map[string]uint64 `json:"sequences"`
+}
+
+// assignment is the numbers given to the events of a flush.
+type assignment struct {
+	events []*model.Event
+	first  map[string]uint64 // {tag : first number}, nil if the numbers are taken from a failed flush
+	last   map[string]uint64 // {tag : last number}
+}
+
+func newSequencer(path string) (*sequencer, error) {
+	s := &sequencer{path: path, last: make(map[string]uint64), written: make(map[string]uint64)}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err = os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create directory of sequence state '%s': %w", path, err)
+		}
+
+		return s, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to read sequence state '%s': %w", path, err)
+	}
+
+	var state sequenceState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode sequence state '%s': %w", path, err)
+	}
+	for tag, seq := range state.Sequences {
+		s.last[tag] = seq
+	}
+
+	return s, nil
+}
+
+// assign numbers the events which are not numbered yet, and stores the last numbers.
+// The returned assignment must be released with the result of the write.
+func (s *sequencer) assign(agentID string, events []*model.Event) (*assignment, error) {
+	a := &assignment{}
+	for _, event := range events {
+		if event.Seq == 0 {
+			a.events = append(a.events, event)
+		}
+	}
+	if len(a.events) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	s.mu.Lock()
+	retried := s.reuse(a)
+	if !retried {
+		a.first = make(map[string]uint64)
+		a.last = make(map[string]uint64)
+		for _, event := range a.events {
+			s.last[event.Metadata]++
+			event.Seq = s.last[event.Metadata]
+			if _, has := a.first[event.Metadata]; !has {
+				a.first[event.Metadata] = event.Seq
+			}
+			a.last[event.Metadata] = event.Seq
+		}
+		s.version++
+	}
+	version := s.version
+	s.mu.Unlock()
+
+	if retried {
+		// the numbers were stored when they were assigned first
+		return a, nil
+	}
+	if err := s.persist(agentID, version); err != nil {
+		s.release(a, err)
+
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// reuse assigns the numbers of the failed flush of the same events. Must be called with the lock held.
+func (s *sequencer) reuse(a *assignment) bool {
+	seqs, has := s.retries.take(a.events)
+	if !has || len(seqs) != len(a.events) {
+		return false
+	}
+
+	for i, event := range a.events {
+		event.Seq = seqs[i]
+	}
+
+	return true
+}
+
+// release completes the write of the numbered events. After a failure the numbers are rolled back
+// if none of the events was written, or kept for the same events delivered again.
+func (s *sequencer) release(a *assignment, err error) {
+	if s == nil || a == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		for _, event := range a.events {
+			s.written[event.Metadata] = max(s.written[event.Metadata], event.Seq)
+		}
+
+		return
+	}
+	if a.first != nil && !errors.Is(err, errPartiallyWritten) && s.rollback(a) {
+		return
+	}
+
+	seqs := make([]uint64, len(a.events))
+	for i, event := range a.events {
+		seqs[i] = event.Seq
+	}
+	s.retries.put(a.events, seqs)
+}
+
+// rollback returns the numbers of the flush, if no later numbers are assigned. Must be called with the lock held.
+func (s *sequencer) rollback(a *assignment) bool {
+	for tag, last := range a.last {
+		if s.last[tag] != last {
+			return false
+		}
+	}
+	for tag, first := range a.first {
+		s.last[tag] = first - 1
+	}
+	s.version++
+
+	return true
+}
+
+// fingerprint identifies the events of the flush by their tags, timestamps and fields.
+func fingerprint(events []*model.Event) (uint64, bool) {
+	h := fnv.New64a()
+	enc := json.NewEncoder(h)
+	for _, event := range events {
+		message := make(map[interface{}]interface{}, len(event.Message))
+		for k, v := range event.Message {
+			message[k] = v
+		}
+		if err := enc.Encode(fallbackRecord{
+			Timestamp: event.Timestamp,
+			Tag:       event.Metadata,
+			Record:    convertByteFieldsToString(message),
+		}); err != nil {
+			return 0, false
+		}
+	}
+
+	return h.Sum64(), true
+}
+
+// failedFlushes keeps the state of the failed flushes until Fluent Bit delivers the same events again,
+// up to maxRetriedFlushes for up to maxRetriedFlushAge. The flushes are looked up by the number, the first
+// timestamp and the tag of their events first, so the fingerprint is computed only for the flushes
+// which may be the retries. The zero value is empty, the caller serializes the calls.
+type failedFlushes[V any] struct {
+	flushes map[uint64]failedFlush[V] // {fingerprint of the events : flush}
+	order   []uint64                  // fingerprints, oldest first
+	shapes  map[flushShape]int        // {shape : number of the kept flushes}
+}
+
+type failedFlush[V any] struct {
+	state  V
+	shape  flushShape
+	failed time.Time
+}
+
+type flushShape struct {
+	events    int
+	timestamp int64 // of the first event, in Unix nanoseconds
+	tag       string
+}
+
+func shapeOf(events []*model.Event) flushShape {
+	shape := flushShape{events: len(events)}
+	if len(events) > 0 {
+		shape.timestamp = events[0].Timestamp.UnixNano()
+		shape.tag = events[0].Metadata
+	}
+
+	return shape
+}
+
+// put keeps the state of the failed flush of the events.
+func (f *failedFlushes[V]) put(events []*model.Event, state V) {
+	key, ok := fingerprint(events)
+	if !ok {
+		return
+	}
+	if f.flushes == nil {
+		f.flushes = make(map[uint64]failedFlush[V])
+		f.shapes = make(map[flushShape]int)
+	}
+
+	f.remove(key)
+	shape := shapeOf(events)
+	f.flushes[key] = failedFlush[V]{state: state, shape: shape, failed: time.Now()}
+	f.order = append(f.order, key)
+	f.shapes[shape]++
+	f.expire()
+}
+
+// take returns and forgets the state of the failed flush of the same events.
+func (f *failedFlushes[V]) take(events []*model.Event) (state V, ok bool) {
+	f.expire()
+	if f.shapes[shapeOf(events)] == 0 {
+		return state, false
+	}
+	key, ok := fingerprint(events)
+	if !ok {
+		return state, false
+	}
+	flush, has := f.flushes[key]
+	if !has {
+		return state, false
+	}
+	f.remove(key)
+
+	return flush.state, true
+}
+
+// expire forgets the oldest flushes over the limits.
+func (f *failedFlushes[V]) expire() {
+	for len(f.order) > 0 {
+		oldest := f.flushes[f.order[0]]
+		if len(f.order) <= maxRetriedFlushes && time.Since(oldest.failed) <= maxRetriedFlushAge {
+			return
+		}
+		f.remove(f.order[0])
+	}
+}
+
+func (f *failedFlushes[V]) remove(key uint64) {
+	flush, has := f.flushes[key]
+	if !has {
+		return
+	}
+	delete(f.flushes, key)
+	if i := slices.Index(f.order, key); i >= 0 {
+		f.order = slices.Delete(f.order, i, i+1)
+	}
+	if f.shapes[flush.shape]--; f.shapes[flush.shape] == 0 {
+		delete(f.shapes, flush.shape)
+	}
+}
+
+func (f *failedFlushes[V]) len() int {
+	return len(f.flushes)
+}
+
+// persist stores the numbers assigned up to the version. The flushes waiting for the running write of the state
+// file are covered by the next single write, so the concurrent flushes do not sync the file each.
+func (s *sequencer) persist(agentID string, version uint64) error {
+	s.storeMu.Lock()
+	defer s.storeMu.Unlock()
+
+	s.mu.Lock()
+	if s.stored >= version {
+		s.mu.Unlock()
+
+		return nil
+	}
+	state := sequenceState{AgentID: agentID, Sequences: maps.Clone(s.last)}
+	current := s.version
+	s.mu.Unlock()
+
+	if err := s.store(state); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.stored = current
+	s.mu.Unlock()
+
+	return nil
+}
+
+// store writes the state into a temporary file, which replaces the state file after it is synced to disk.
+func (s *sequencer) store(state sequenceState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to write sequence state: %w", err)
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write sequence state: %w", err)
+	}
+
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// lastWritten returns the last numbers of the written events. The numbers assigned to the events
+// which are still being written, or failed, are not included, so they are not reported as lost.
+func (s *sequencer) lastWritten() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return maps.Clone(s.written)
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+func TestSequencerKeepsNumbersAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "seq.json")
+
+	seq, err := newSequencer(path)
+	require.NoError(t, err)
+
+	events := []*model.Event{{Metadata: "a"}, {Metadata: "b"}, {Metadata: "a"}}
+	_, err = seq.assign("agent", events)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 1, 2}, []uint64{events[0].Seq, events[1].Seq, events[2].Seq})
+
+	// the events which are already numbered keep their numbers when they are written again
+	numbered, err := seq.assign("agent", events)
+	require.NoError(t, err)
+	require.Nil(t, numbered)
+	require.Equal(t, uint64(2), events[2].Seq)
+
+	seq, err = newSequencer(path)
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"a": 2, "b": 1}, seq.last)
+
+	next := []*model.Event{{Metadata: "a"}}
+	_, err = seq.assign("agent", next)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), next[0].Seq)
+}
+
+// chunk returns the events as Fluent Bit delivers them on each attempt.
+func chunk(tag string, messages ...string) []*model.Event {
+	ts := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	events := make([]*model.Event, len(messages))
+	for i, message := range messages {
+		events[i] = &model.Event{Timestamp: ts, Metadata: tag, Message: map[string]interface{}{"log": []byte(message)}}
+	}
+
+	return events
+}
+
+func seqs(events []*model.Event) []uint64 {
+	numbers := make([]uint64, len(events))
+	for i, event := range events {
+		numbers[i] = event.Seq
+	}
+
+	return numbers
+}
+
+func TestSequencerRollback(t *testing.T) {
+	seq, err := newSequencer(filepath.Join(t.TempDir(), "seq.json"))
+	require.NoError(t, err)
+
+	numbered, err := seq.assign("agent", chunk("app", "a", "b"))
+	require.NoError(t, err)
+	seq.release(numbered, nil)
+
+	// none of the events is written, the numbers are taken again by the retry
+	failed := chunk("app", "c", "d")
+	numbered, err = seq.assign("agent", failed)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4}, seqs(failed))
+	seq.release(numbered, ErrRetryLater)
+	require.Equal(t, map[string]uint64{"app": 2}, seq.last)
+
+	retried := chunk("app", "c", "d")
+	numbered, err = seq.assign("agent", retried)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4}, seqs(retried))
+	seq.release(numbered, nil)
+}
+
+func TestSequencerPartialWrite(t *testing.T) {
+	seq, err := newSequencer(filepath.Join(t.TempDir(), "seq.json"))
+	require.NoError(t, err)
+
+	// some of the events are written before the failure
+	failed := chunk("app", "a", "b", "c")
+	numbered, err := seq.assign("agent", failed)
+	require.NoError(t, err)
+	seq.release(numbered, fmt.Errorf("%w: %w", errPartiallyWritten, ErrRetryLater))
+
+	// the following chunk takes the next numbers
+	next := chunk("app", "d")
+	numbered, err = seq.assign("agent", next)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{4}, seqs(next))
+	seq.release(numbered, nil)
+
+	// the chunk delivered again gets the same numbers, and keeps them over the following failures
+	for range 2 {
+		retried := chunk("app", "a", "b", "c")
+		numbered, err = seq.assign("agent", retried)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{1, 2, 3}, seqs(retried))
+		seq.release(numbered, fmt.Errorf("%w: %w", errPartiallyWritten, ErrRetryLater))
+	}
+
+	retried := chunk("app", "a", "b", "c")
+	numbered, err = seq.assign("agent", retried)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, seqs(retried))
+	seq.release(numbered, nil)
+
+	// the numbers are forgotten after the success
+	again := chunk("app", "a", "b", "c")
+	_, err = seq.assign("agent", again)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{5, 6, 7}, seqs(again))
+}
+
+func TestSequencerFailureAfterNextChunk(t *testing.T) {
+	seq, err := newSequencer(filepath.Join(t.TempDir(), "seq.json"))
+	require.NoError(t, err)
+
+	failed := chunk("app", "a")
+	numbered, err := seq.assign("agent", failed)
+	require.NoError(t, err)
+
+	// the concurrent flush takes the next number before the failure, so the number is not rolled back
+	next := chunk("app", "b")
+	_, err = seq.assign("agent", next)
+	require.NoError(t, err)
+	seq.release(numbered, errors.New("unavailable"))
+	require.Equal(t, map[string]uint64{"app": 2}, seq.last)
+
+	retried := chunk("app", "a")
+	_, err = seq.assign("agent", retried)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, seqs(retried))
+}
+
+func TestSequencerConcurrentAssign(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seq.json")
+	seq, err := newSequencer(path)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				_, err := seq.assign("agent", chunk("app", fmt.Sprintf("%d-%d", i, j)))
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every assigned number is in the state file
+	seq, err = newSequencer(path)
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"app": 400}, seq.last)
+}
+
+func TestSequencerLastWritten(t *testing.T) {
+	seq, err := newSequencer(filepath.Join(t.TempDir(), "seq.json"))
+	require.NoError(t, err)
+
+	written, err := seq.assign("agent", chunk("app", "a", "b"))
+	require.NoError(t, err)
+	failed, err := seq.assign("agent", chunk("app", "c"))
+	require.NoError(t, err)
+	pending, err := seq.assign("agent", chunk("app", "d"))
+	require.NoError(t, err)
+
+	seq.release(written, nil)
+	seq.release(failed, errors.New("unavailable"))
+	require.Equal(t, map[string]uint64{"app": 2}, seq.lastWritten(), "the failed and pending numbers are not reported")
+
+	seq.release(pending, nil)
+	require.Equal(t, map[string]uint64{"app": 4}, seq.lastWritten())
+}
+
+func TestFailedFlushes(t *testing.T) {
+	var flushes failedFlushes[int]
+	_, has := flushes.take(chunk("app", "a"))
+	require.False(t, has)
+
+	flushes.put(chunk("app", "a"), 1)
+	flushes.put(chunk("app", "b"), 2)
+	_, has = flushes.take(chunk("app", "c"))
+	require.False(t, has, "the flush of the same shape and other events is not taken")
+	_, has = flushes.take(chunk("app", "a", "b"))
+	require.False(t, has)
+
+	state, has := flushes.take(chunk("app", "a"))
+	require.True(t, has)
+	require.Equal(t, 1, state)
+	_, has = flushes.take(chunk("app", "a"))
+	require.False(t, has, "the flush is taken once")
+
+	// the flushes are forgotten after maxRetriedFlushAge
+	key, _ := fingerprint(chunk("app", "b"))
+	flush := flushes.flushes[key]
+	flush.failed = time.Now().Add(-maxRetriedFlushAge - time.Second)
+	flushes.flushes[key] = flush
+	_, has = flushes.take(chunk("app", "b"))
+	require.False(t, has)
+	require.Zero(t, flushes.len())
+	require.Empty(t, flushes.shapes)
+
+	// and over maxRetriedFlushes, oldest first
+	for i := range maxRetriedFlushes + 1 {
+		flushes.put(chunk("app", strconv.Itoa(i)), i)
+	}
+	require.Equal(t, maxRetriedFlushes, flushes.len())
+	_, has = flushes.take(chunk("app", "0"))
+	require.False(t, has)
+	state, has = flushes.take(chunk("app", "1"))
+	require.True(t, has)
+	require.Equal(t, 1, state)
+}
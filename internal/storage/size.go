@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+	grpcCodes "google.golang.org/grpc/codes"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+// Sizes of the values in the protobuf encoding of the BulkUpsert request (Ydb.Value message).
+const (
+	// uint64 and timestamp values are encoded as fixed64 field.
+	fixed64ValueSize = 1 + 8
+	// NULL is encoded as an enum field with zero value.
+	nullValueSize = 1 + 1
+	// Type description of each column in the request.
+	columnTypeSize = 16
+	// Table name, operation parameters and other fields of the request.
+	requestOverheadSize = 128
+)
+
+func varintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+
+	return n
+}
+
+// bytesValueSize is the size of the length-delimited (string, bytes or embedded message) field.
+func bytesValueSize(n int) int {
+	return 1 + varintSize(uint64(n)) + n
+}
+
+var (
+	errPortionTooLarge = fmt.Errorf("portion is too large for a single request: %w", ErrRetryLater)
+
+	portionTooLargeMessages = []string{
+		"larger than max",
+		"message too large",
+		"too many rows",
+		"too big",
+		"size limit",
+	}
+)
+
+// isPortionTooLarge reports whether YDB rejected the request because of its size or number of rows.
+func isPortionTooLarge(err error) bool {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if !ydb.IsTransportError(err, grpcCodes.ResourceExhausted) && !ydb.IsOperationError(err) {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, m := range portionTooLargeMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// portionSizer adapts the limits of a portion to the ones accepted by YDB.
+// The limits are cut by half of the rejected portion, and grow back slowly after a series
+// of successful writes, up to the configured maximum.
+type portionSizer struct {
+	mu        sync.Mutex
+	maxBytes  int
+	maxRows   int // zero means no limit
+	bytes     int
+	rows      int
+	successes int
+}
+
+// portionSizerGrowAfter is the number of successful writes after which the limits grow.
+const portionSizerGrowAfter = 16
+
+func newPortionSizer(maxBytes, maxRows int) *portionSizer {
+	return &portionSizer{
+		maxBytes: maxBytes,
+		maxRows:  maxRows,
+		bytes:    maxBytes,
+		rows:     maxRows,
+	}
+}
+
+func (ps *portionSizer) limits() (bytes, rows int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.bytes, ps.rows
+}
+
+// shrink cuts the limits to the half of the portion which was rejected by YDB.
+func (ps *portionSizer) shrink(p *portion) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.successes = 0
+	if b := max(p.bytes/2, 1); b < ps.bytes {
+		ps.bytes = b
+	}
+	if r := max(len(p.rows)/2, 1); ps.rows == 0 || r < ps.rows {
+		ps.rows = r
+	}
+}
+
+// success grows the limits after a series of successful writes.
+func (ps *portionSizer) success() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.bytes == ps.maxBytes && ps.rows == ps.maxRows {
+		return
+	}
+
+	ps.successes++
+	if ps.successes < portionSizerGrowAfter {
+		return
+	}
+	ps.successes = 0
+
+	ps.bytes = min(ps.bytes*2, ps.maxBytes)
+	if ps.rows != 0 {
+		ps.rows *= 2
+		if ps.maxRows != 0 && ps.rows >= ps.maxRows {
+			ps.rows = ps.maxRows
+		} else if ps.maxRows == 0 && ps.bytes == ps.maxBytes {
+			ps.rows = 0
+		}
+	}
+}
+
+// split splits the rows into portions within the current limits, and at the boundaries of the shard
+// key ranges of the ordered rows. Each portion contains at least one row, even if the row exceeds the limits.
+func (ps *portionSizer) split(events []*model.Event, rows []row, sizes []int, overhead int) []*portion {
+	maxBytes, maxRows := ps.limits()
+
+	var (
+		portions []*portion
+		current  = &portion{}
+	)
+	for i := range rows {
+		size := bytesValueSize(sizes[i])
+		full := len(current.rows) > 0 &&
+			(overhead+current.bytes+size > maxBytes || (maxRows > 0 && len(current.rows) >= maxRows) ||
+				(rows[i].key != nil && rows[i].shard != current.rows[0].shard))
+		if full {
+			portions = append(portions, current)
+			current = &portion{}
+		}
+		current.events = append(current.events, events[i])
+		current.rows = append(current.rows, rows[i])
+		current.sizes = append(current.sizes, sizes[i])
+		current.bytes += size
+	}
+	if len(current.rows) > 0 {
+		portions = append(portions, current)
+	}
+
+	return portions
+}
+
+// resplit splits again the portions which were rejected by YDB because of their size.
+func (ps *portionSizer) resplit(portions []*portion, overhead int) []*portion {
+	result := make([]*portion, 0, len(portions))
+	for _, p := range portions {
+		if errors.Is(p.err, errPortionTooLarge) {
+			result = append(result, ps.split(p.events, p.rows, p.sizes, overhead)...)
+		} else {
+			result = append(result, p)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-genproto/protos/Ydb"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+func TestType2TypeSize(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	ts := time.Date(2024, 5, 2, 12, 36, 13, 0, time.UTC)
+
+	cases := []struct {
+		name     string
+		column   types.Type
+		value    interface{}
+		expected *Ydb.Value
+	}{
+		{
+			name:     "text",
+			column:   types.TypeText,
+			value:    long,
+			expected: &Ydb.Value{Value: &Ydb.Value_TextValue{TextValue: long}},
+		},
+		{
+			name:     "optional bytes",
+			column:   types.Optional(types.TypeBytes),
+			value:    []byte("some"),
+			expected: &Ydb.Value{Value: &Ydb.Value_BytesValue{BytesValue: []byte("some")}},
+		},
+		{
+			name:     "timestamp",
+			column:   types.TypeTimestamp,
+			value:    ts,
+			expected: &Ydb.Value{Value: &Ydb.Value_Uint64Value{Uint64Value: uint64(ts.UnixMicro())}},
+		},
+		{
+			name:     "uint64",
+			column:   types.TypeUint64,
+			value:    uint64(1),
+			expected: &Ydb.Value{Value: &Ydb.Value_Uint64Value{Uint64Value: 1}},
+		},
+		{
+			name:     "null",
+			column:   types.Optional(types.TypeText),
+			value:    nil,
+			expected: &Ydb.Value{Value: &Ydb.Value_NullFlagValue{NullFlagValue: structpb.NullValue_NULL_VALUE}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, size, err := type2Type(tc.column, tc.value, nil)
+
+			require.NoError(t, err)
+			item := &Ydb.Value{Items: []*Ydb.Value{tc.expected}}
+			require.Equal(t, proto.Size(item), bytesValueSize(size))
+		})
+	}
+}
+
+func TestPortionSizerSplit(t *testing.T) {
+	events := make([]*model.Event, 10)
+	rows := make([]row, 10)
+	sizes := make([]int, 10)
+	for i := range rows {
+		events[i] = &model.Event{}
+		rows[i] = row{value: types.Uint64Value(uint64(i))}
+		sizes[i] = 98 // 100 bytes in the request
+	}
+
+	t.Run("bytes", func(t *testing.T) {
+		portions := newPortionSizer(350, 0).split(events, rows, sizes, 50)
+
+		require.Len(t, portions, 4)
+		require.Len(t, portions[0].rows, 3)
+		require.Equal(t, 300, portions[0].bytes)
+		require.Len(t, portions[3].rows, 1)
+	})
+
+	t.Run("rows", func(t *testing.T) {
+		portions := newPortionSizer(1<<20, 4).split(events, rows, sizes, 50)
+
+		require.Len(t, portions, 3)
+		require.Len(t, portions[2].rows, 2)
+	})
+
+	t.Run("oversized row", func(t *testing.T) {
+		portions := newPortionSizer(10, 0).split(events[:2], rows[:2], sizes[:2], 0)
+
+		require.Len(t, portions, 2)
+	})
+}
+
+func TestPortionSizerAdapts(t *testing.T) {
+	ps := newPortionSizer(1000, 0)
+
+	ps.shrink(&portion{rows: make([]row, 8), bytes: 800})
+	bytes, rows := ps.limits()
+	require.Equal(t, 400, bytes)
+	require.Equal(t, 4, rows)
+
+	for i := 0; i < portionSizerGrowAfter; i++ {
+		ps.success()
+	}
+	bytes, rows = ps.limits()
+	require.Equal(t, 800, bytes)
+	require.Equal(t, 8, rows)
+
+	for i := 0; i < portionSizerGrowAfter; i++ {
+		ps.success()
+	}
+	bytes, rows = ps.limits()
+	require.Equal(t, 1000, bytes)
+	require.Equal(t, 0, rows)
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+	grpcCodes "google.golang.org/grpc/codes"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
+)
+
+// tokenBucket limits the rate of units per second. A request larger than the bucket
+// is let through, but the following requests wait until the debt is paid off.
+type tokenBucket struct {
+	rate   float64 // units per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+// reserve takes the units from the bucket and returns the time to wait until they are available.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) cancel(n float64) {
+	b.tokens = min(b.rate, b.tokens+n)
+}
+
+// The rate is cut by half on overload, at most once per cooldown, and recovers by a
+// small step after each cooldown of successful writes, up to the configured limit.
+const (
+	throttleDecrease  = 0.5
+	throttleIncrease  = 0.05
+	throttleMinFactor = 0.01
+	throttleCooldown  = time.Second
+)
+
+// throttle limits the rate of writes in rows and bytes per second, and adapts the rate to
+// the overload reported by YDB in the AIMD (additive increase, multiplicative decrease) way.
+type throttle struct {
+	mu       sync.Mutex
+	maxRows  float64 // configured rate, zero means no limit
+	maxBytes float64
+	rows     *tokenBucket
+	bytes    *tokenBucket
+	factor   float64 // current share of the configured rate
+	changed  time.Time
+
+	rowsRate  *metrics.Gauge
+	bytesRate *metrics.Gauge
+}
+
+// newThrottle returns nil if no limit is configured.
+func newThrottle(maxRows, maxBytes int, table string) *throttle {
+	if maxRows <= 0 && maxBytes <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	t := &throttle{
+		maxRows:  float64(maxRows),
+		maxBytes: float64(maxBytes),
+		factor:   1,
+		changed:  now,
+		rowsRate: metrics.NewGauge("fluentbit_ydb_write_rate_rows",
+			"Effective limit of the written rows per second.", "table", table),
+		bytesRate: metrics.NewGauge("fluentbit_ydb_write_rate_bytes",
+			"Effective limit of the written bytes per second.", "table", table),
+	}
+	if maxRows > 0 {
+		t.rows = newTokenBucket(t.maxRows, now)
+	}
+	if maxBytes > 0 {
+		t.bytes = newTokenBucket(t.maxBytes, now)
+	}
+	t.report()
+
+	return t
+}
+
+// acquire waits until the rows and bytes may be written within the current rate.
+func (t *throttle) acquire(ctx context.Context, rows, bytes int) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	var wait time.Duration
+	if t.rows != nil {
+		wait = max(wait, t.rows.reserve(now, float64(rows)))
+	}
+	if t.bytes != nil {
+		wait = max(wait, t.bytes.reserve(now, float64(bytes)))
+	}
+	t.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		if t.rows != nil {
+			t.rows.cancel(float64(rows))
+		}
+		if t.bytes != nil {
+			t.bytes.cancel(float64(bytes))
+		}
+		t.mu.Unlock()
+
+		return ErrQueueTimeout
+	}
+}
+
+// overloaded cuts the rate after YDB reported the overload.
+func (t *throttle) overloaded() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.changed) < throttleCooldown {
+		return
+	}
+	t.changed = now
+	t.factor = max(t.factor*throttleDecrease, throttleMinFactor)
+	t.apply()
+	log.Info(fmt.Sprintf("YDB is overloaded, write rate is cut to %s", t.describe()))
+}
+
+// succeeded slowly restores the rate after the successful write.
+func (t *throttle) succeeded() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.factor >= 1 || now.Sub(t.changed) < throttleCooldown {
+		return
+	}
+	t.changed = now
+	t.factor = min(t.factor+throttleIncrease, 1)
+	t.apply()
+	if t.factor < 1 {
+		log.Debug(fmt.Sprintf("write rate is restored to %s", t.describe()))
+	} else {
+		log.Info(fmt.Sprintf("write rate is fully restored to %s", t.describe()))
+	}
+}
+
+// apply sets the rates of the buckets to the current share. Must be called with the lock held.
+func (t *throttle) apply() {
+	if t.rows != nil {
+		t.rows.rate = t.maxRows * t.factor
+	}
+	if t.bytes != nil {
+		t.bytes.rate = t.maxBytes * t.factor
+	}
+	t.report()
+}
+
+func (t *throttle) report() {
+	rows, bytes := t.rates()
+	t.rowsRate.Set(rows)
+	t.bytesRate.Set(bytes)
+}
+
+func (t *throttle) rates() (rows, bytes float64) {
+	if t.rows != nil {
+		rows = t.rows.rate
+	}
+	if t.bytes != nil {
+		bytes = t.bytes.rate
+	}
+
+	return rows, bytes
+}
+
+// describe describes the effective rate. Must be called with the lock held.
+func (t *throttle) describe() string {
+	rows, bytes := t.rates()
+
+	return fmt.Sprintf("%.0f rows/s, %.0f bytes/s (%.0f%% of configured)", rows, bytes, t.factor*100)
+}
+
+// isOverloaded reports whether YDB rejected the write because of overload or exhausted resources.
+func isOverloaded(err error) bool {
+	if err == nil || isPortionTooLarge(err) {
+		return false
+	}
+
+	return ydb.IsOperationErrorOverloaded(err) || ydb.IsTransportError(err, grpcCodes.ResourceExhausted)
+}
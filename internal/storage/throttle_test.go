@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(100, now)
+
+	require.Equal(t, time.Duration(0), b.reserve(now, 60))
+	require.Equal(t, 200*time.Millisecond, b.reserve(now, 60))
+
+	// the debt is paid off in time
+	now = now.Add(200 * time.Millisecond)
+	require.Equal(t, time.Duration(0), b.reserve(now, 0))
+	require.Equal(t, 500*time.Millisecond, b.reserve(now, 50))
+}
+
+func TestThrottleAIMD(t *testing.T) {
+	th := newThrottle(1000, 0, "test")
+	th.changed = time.Time{}
+
+	th.overloaded()
+	require.InDelta(t, 500, th.rows.rate, 0.001)
+	require.InDelta(t, 500, th.rowsRate.Value(), 0.001)
+
+	// the rate is not cut again within the cooldown
+	th.overloaded()
+	require.InDelta(t, 500, th.rows.rate, 0.001)
+
+	th.changed = time.Time{}
+	th.succeeded()
+	require.InDelta(t, 550, th.rows.rate, 0.001)
+}
+
+func TestThrottleAcquireTimeout(t *testing.T) {
+	th := newThrottle(10, 0, "test")
+
+	require.NoError(t, th.acquire(context.Background(), 10, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, th.acquire(ctx, 10, 0), ErrQueueTimeout)
+}
+
+func TestThrottleDisabled(t *testing.T) {
+	th := newThrottle(0, 0, "test")
+
+	require.Nil(t, th)
+	require.NoError(t, th.acquire(context.Background(), 1000, 1000))
+	th.overloaded()
+	th.succeeded()
+}
@@ -0,0 +1,531 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/surge/cityhash"
+	ugorji "github.com/ugorji/go/codec"
+	ydb "github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicoptions"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topictypes"
+	"github.com/ydb-platform/ydb-go-sdk/v3/topic/topicwriter"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+var (
+	_ interface {
+		Write(event []*model.Event) error
+	} = (*Topic)(nil)
+
+	_ interface {
+		Exit() error
+	} = (*Topic)(nil)
+)
+
+// Metadata items of the topic messages.
+const (
+	topicMetadataTag = "tag"
+	topicMetadataKey = "key"
+)
+
+// Topic writes the records as the messages of a YDB topic instead of the table rows.
+type Topic struct {
+	cfg      *config.Config
+	db       *ydb.Driver
+	writers  []*topicWriter // one per partition if the messages are partitioned by key
+	seq      *sequencer
+	redactor *redactor
+	msgpack  *ugorji.MsgpackHandle
+	backoff  backoff
+
+	ctx      context.Context // canceled when the writes are aborted on exit
+	abort    context.CancelFunc
+	writesMu sync.Mutex
+	closing  bool
+	writes   sync.WaitGroup
+	written  atomic.Int64
+	failed   atomic.Int64
+
+	retriesMu sync.Mutex
+	retries   failedFlushes[*topicRetry]
+}
+
+// topicRetry is the state of the partitions of a failed flush, kept for its retry.
+type topicRetry struct {
+	written []bool    // partitions written by the flush
+	seqNos  [][]int64 // sequence numbers of the messages of the failed partitions
+}
+
+// topicWriter is the write session of a producer. The sequence numbers of the messages are assigned
+// by the plugin, so the messages written again after a failure are skipped by YDB if they were
+// written before it.
+type topicWriter struct {
+	producerID string
+	partition  int64 // -1 if the partition is chosen by YDB
+
+	mu   sync.Mutex // serializes the writes, so the sequence numbers increase
+	w    *topicwriter.Writer
+	last int64 // the last assigned sequence number
+}
+
+// topicMessage is the encoded record. The messages are built from it again on each attempt,
+// as the data reader of a message is consumed by the write.
+type topicMessage struct {
+	seqNo     int64
+	createdAt time.Time
+	data      []byte
+	metadata  map[string][]byte
+}
+
+func NewTopic(cfg *config.Config) (*Topic, error) {
+	ctx, abort := context.WithCancel(context.Background())
+	t := &Topic{
+		cfg:     cfg,
+		ctx:     ctx,
+		abort:   abort,
+		msgpack: &ugorji.MsgpackHandle{},
+		backoff: backoff{base: cfg.RetryBackoff, max: cfg.RetryMaxBackoff},
+	}
+
+	var err error
+	if t.redactor, err = newRedactor(cfg.RedactionRules, cfg.TopicPath); err != nil {
+		return t, err
+	}
+	if cfg.SequenceStatePath != "" {
+		if t.seq, err = newSequencer(cfg.SequenceStatePath); err != nil {
+			return t, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.InitTimeout)
+	defer cancel()
+
+	if t.db, err = OpenDriver(ctx, cfg.Endpoints()[0]); err != nil {
+		return t, err
+	}
+
+	if cfg.TopicMessageKey == "" {
+		t.writers = []*topicWriter{{producerID: cfg.TopicProducerID, partition: -1}}
+	} else {
+		desc, err := t.db.Topic().Describe(ctx, cfg.TopicPath)
+		if err != nil {
+			return t, fmt.Errorf("failed to describe topic '%s': %w", cfg.TopicPath, err)
+		}
+		for _, p := range desc.Partitions {
+			if p.Active {
+				t.writers = append(t.writers, &topicWriter{
+					producerID: fmt.Sprintf("%s-%d", cfg.TopicProducerID, p.PartitionID),
+					partition:  p.PartitionID,
+				})
+			}
+		}
+		if len(t.writers) == 0 {
+			return t, fmt.Errorf("topic '%s' has no active partitions", cfg.TopicPath)
+		}
+	}
+
+	for _, w := range t.writers {
+		if err = t.open(ctx, w); err != nil {
+			return t, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *Topic) writerOptions(w *topicWriter) []topicoptions.WriterOption {
+	opts := []topicoptions.WriterOption{
+		topicoptions.WithWriterProducerID(w.producerID),
+		topicoptions.WithWriterSetAutoSeqNo(false),
+		topicoptions.WithWriterSetAutoCreatedAt(false),
+		topicoptions.WithWriterWaitServerAck(true),
+	}
+	if w.partition >= 0 {
+		opts = append(opts, topicoptions.WithWriterPartitionID(w.partition))
+	}
+
+	switch t.cfg.TopicCodec {
+	case config.TopicCodecRaw:
+		opts = append(opts, topicoptions.WithWriterCodec(topictypes.CodecRaw))
+	case config.TopicCodecGzip:
+		opts = append(opts, topicoptions.WithWriterCodec(topictypes.CodecGzip))
+	case config.TopicCodecZstd:
+		opts = append(opts,
+			topicoptions.WithWriterAddEncoder(topictypes.CodecZstd, func(w io.Writer) (io.WriteCloser, error) {
+				return zstd.NewWriter(w)
+			}),
+			topicoptions.WithWriterCodec(topictypes.CodecZstd),
+		)
+	}
+
+	return opts
+}
+
+// open starts the write session, and continues the sequence numbers from the last one written by the producer.
+func (t *Topic) open(ctx context.Context, w *topicWriter) error {
+	writer, err := t.db.Topic().StartWriter(t.cfg.TopicPath, t.writerOptions(w)...)
+	if err != nil {
+		return fmt.Errorf("failed to start writer of topic '%s': %w", t.cfg.TopicPath, err)
+	}
+	info, err := writer.WaitInitInfo(ctx)
+	if err != nil {
+		_ = writer.Close(context.Background())
+
+		return fmt.Errorf("failed to start writer of topic '%s': %w", t.cfg.TopicPath, err)
+	}
+
+	w.w = writer
+	w.last = max(w.last, info.LastSeqNum)
+
+	return nil
+}
+
+// reopen replaces the failed write session. The messages queued by the old session are dropped,
+// they are written again by the new one.
+func (t *Topic) reopen(w *topicWriter) error {
+	ctx, cancel := context.WithTimeout(t.ctx, exitAbortTimeout)
+	_ = w.w.Close(ctx)
+	cancel()
+
+	ctx, cancel = context.WithTimeout(t.ctx, t.cfg.InitTimeout)
+	defer cancel()
+
+	return t.open(ctx, w)
+}
+
+func (t *Topic) Write(events []*model.Event) error {
+	t.writesMu.Lock()
+	if t.closing {
+		t.writesMu.Unlock()
+
+		return ErrShuttingDown
+	}
+	t.writes.Add(1)
+	t.writesMu.Unlock()
+	defer t.writes.Done()
+
+	if t.seq == nil {
+		return t.publish(events)
+	}
+
+	numbered, err := t.seq.assign(t.cfg.AgentID, events)
+	if err != nil {
+		return err
+	}
+	err = t.publish(events)
+	t.seq.release(numbered, err)
+
+	return err
+}
+
+// publish encodes the events and writes them by the writers of their partitions. When the flush fails,
+// the written partitions and the sequence numbers of the failed ones are remembered for it. When Fluent Bit
+// delivers the same events again, the written partitions are skipped, and the messages of the failed ones
+// get the same numbers, so YDB skips those of them which were written before the failure.
+func (t *Topic) publish(events []*model.Event) error {
+	groups := make([][]*topicMessage, len(t.writers))
+	for _, event := range events {
+		m, i, err := t.message(event)
+		if err != nil {
+			return err
+		}
+		groups[i] = append(groups[i], m)
+	}
+
+	retry := t.retried(events)
+	if retry == nil {
+		retry = &topicRetry{written: make([]bool, len(t.writers)), seqNos: make([][]int64, len(t.writers))}
+	}
+	written := retry.written
+
+	var g errgroup.Group
+	for i, messages := range groups {
+		if len(messages) == 0 || written[i] {
+			continue
+		}
+		g.Go(func() error {
+			if err := t.send(t.writers[i], messages, retry.seqNos[i]); err != nil {
+				t.failed.Add(int64(len(messages)))
+
+				return err
+			}
+			t.written.Add(int64(len(messages)))
+			written[i] = true
+
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err == nil {
+		return nil
+	}
+
+	failed := &topicRetry{written: written, seqNos: make([][]int64, len(t.writers))}
+	for i, messages := range groups {
+		if written[i] {
+			continue
+		}
+		for _, m := range messages {
+			failed.seqNos[i] = append(failed.seqNos[i], m.seqNo)
+		}
+	}
+	t.remember(events, failed)
+
+	if !slices.Contains(written, true) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", errPartiallyWritten, err)
+}
+
+// retried returns the state of the failed flush of the same events, or nil.
+func (t *Topic) retried(events []*model.Event) *topicRetry {
+	t.retriesMu.Lock()
+	defer t.retriesMu.Unlock()
+
+	retry, has := t.retries.take(events)
+	if !has || len(retry.written) != len(t.writers) {
+		return nil
+	}
+
+	return retry
+}
+
+// remember keeps the state of the failed flush for its retry.
+func (t *Topic) remember(events []*model.Event, retry *topicRetry) {
+	t.retriesMu.Lock()
+	defer t.retriesMu.Unlock()
+
+	t.retries.put(events, retry)
+}
+
+// message encodes the event, and chooses the writer of its partition.
+func (t *Topic) message(event *model.Event) (_ *topicMessage, writer int, err error) {
+	message := event.Message
+	if t.redactor != nil {
+		message = t.redactor.redact(message)
+	}
+
+	m := &topicMessage{
+		createdAt: event.Timestamp,
+		metadata:  map[string][]byte{topicMetadataTag: []byte(event.Metadata)},
+	}
+
+	switch t.cfg.TopicFormat {
+	case config.TopicFormatMsgpack:
+		err = ugorji.NewEncoderBytes(&m.data, t.msgpack).Encode(stringValues(message))
+	case config.TopicFormatRow:
+		var row map[string]interface{}
+		if row, err = t.row(event, message); err == nil {
+			m.data, err = json.Marshal(row)
+		}
+	default:
+		m.data, err = json.Marshal(stringValues(message))
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to encode record: %w", err)
+	}
+
+	if t.cfg.TopicMessageKey != "" {
+		var key string
+		if v, has := message[t.cfg.TopicMessageKey]; has && v != nil {
+			key = keyString(v)
+		}
+		m.metadata[topicMetadataKey] = []byte(key)
+		writer = int(cityhash.CityHash64([]byte(key), uint32(len(key))) % uint64(len(t.writers))) //nolint:gosec
+	}
+
+	return m, writer, nil
+}
+
+// row returns the values of the record keyed by the column names, the fields which are not
+// mapped go to the .others column. The pseudo-fields get the same values as in the table rows.
+func (t *Topic) row(event *model.Event, message map[string]interface{}) (map[string]interface{}, error) {
+	_, othersUsed := t.cfg.Columns[config.KeyOthers]
+	row := make(map[string]interface{}, len(t.cfg.Columns))
+	others := make(map[string]interface{})
+	hashed := make(map[string]interface{})
+	for field, value := range stringValues(message) {
+		if column, mapped := t.cfg.Columns[field]; mapped {
+			row[column] = value
+			hashed[field] = value
+		} else {
+			others[field] = value
+			if othersUsed {
+				hashed[field] = value
+			}
+		}
+	}
+
+	for field, column := range t.cfg.Columns {
+		switch field {
+		case config.KeyTimestamp:
+			row[column] = event.Timestamp
+		case config.KeyInput:
+			row[column] = event.Metadata
+		case config.KeyAgentID:
+			row[column] = t.cfg.AgentID
+		case config.KeySeq:
+			row[column] = event.Seq
+		case config.KeyOthers:
+			row[column] = others
+		case config.KeyHash:
+			j, err := json.Marshal(hashed)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal json value: %w. Value: %#v", err, hashed)
+			}
+			row[column] = cityhash.CityHash64(j, uint32(len(j))) //nolint:gosec
+		case config.KeyChunkIndex:
+			row[column] = event.ChunkIndex
+		case config.KeyChunkCount:
+			row[column] = max(event.ChunkCount, 1)
+		default:
+			if _, has := row[column]; !has {
+				row[column] = nil
+			}
+		}
+	}
+
+	return row, nil
+}
+
+// stringValues converts the byte values of the record to the strings, so they are encoded as text.
+func stringValues(message map[string]interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(message))
+	for field, value := range message {
+		switch v := value.(type) {
+		case []byte:
+			values[field] = string(v)
+		case map[interface{}]interface{}:
+			values[field] = convertByteFieldsToString(v)
+		default:
+			values[field] = v
+		}
+	}
+
+	return values
+}
+
+// send writes the messages with the sequence numbers of the failed flush or the next numbers
+// of the writer, and writes them again on the retryable failures.
+func (t *Topic) send(w *topicWriter, messages []*topicMessage, seqNos []int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.number(messages, seqNos)
+
+	err := t.write(w, messages)
+	for attempt := 0; err != nil && IsRetryable(err) && attempt < t.cfg.RetryMaxAttempts; attempt++ {
+		log.Warn(fmt.Sprintf("failed to write %d messages to topic '%s' by producer '%s', retrying: %v",
+			len(messages), t.cfg.TopicPath, w.producerID, err))
+
+		timer := time.NewTimer(t.backoff.delay(attempt))
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+
+			return ErrShuttingDown
+		case <-timer.C:
+		}
+
+		// the new session gets the last number written by the producer, and YDB skips
+		// the messages which were written before the failure
+		if err = t.reopen(w); err == nil {
+			err = t.write(w, messages)
+		}
+	}
+
+	return err
+}
+
+// number assigns the sequence numbers of the failed flush to its messages delivered again. YDB skips
+// the messages numbered below the last written one, so the numbers are reused only if the writer has
+// not assigned the later numbers since, otherwise the messages get the next numbers and the ones
+// written before the failure are written again. Must be called with the lock held.
+func (w *topicWriter) number(messages []*topicMessage, seqNos []int64) {
+	if len(seqNos) == len(messages) && seqNos[len(seqNos)-1] == w.last {
+		for i, m := range messages {
+			m.seqNo = seqNos[i]
+		}
+
+		return
+	}
+
+	for _, m := range messages {
+		w.last++
+		m.seqNo = w.last
+	}
+}
+
+func (t *Topic) write(w *topicWriter, messages []*topicMessage) error {
+	ctx, cancel := context.WithTimeout(t.ctx, t.cfg.WriteTimeout)
+	defer cancel()
+
+	batch := make([]topicwriter.Message, 0, len(messages))
+	for _, m := range messages {
+		batch = append(batch, topicwriter.Message{
+			SeqNo:     m.seqNo,
+			CreatedAt: m.createdAt,
+			Data:      bytes.NewReader(m.data),
+			Metadata:  m.metadata,
+		})
+	}
+
+	return w.w.Write(ctx, batch...)
+}
+
+func (t *Topic) Exit() error {
+	started := time.Now()
+	deadline := started.Add(t.cfg.ExitTimeout)
+
+	t.writesMu.Lock()
+	t.closing = true
+	t.writesMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		t.writes.Wait()
+	}()
+
+	var err error
+	if !waitUntil(drained, deadline) {
+		log.Warn(fmt.Sprintf("writes are not completed within %s, aborting them", t.cfg.ExitTimeout))
+		t.abort()
+		if !waitUntil(drained, time.Now().Add(exitAbortTimeout)) {
+			err = errors.New("aborted writes are not completed")
+		}
+	}
+	t.abort()
+
+	ctx, cancel := context.WithTimeout(context.Background(), max(time.Until(deadline), exitCloseMinTimeout))
+	defer cancel()
+	for _, w := range t.writers {
+		if w.w != nil {
+			err = errors.Join(err, w.w.Close(ctx))
+		}
+	}
+	if t.db != nil {
+		err = errors.Join(err, closeDriver(t.db, max(time.Until(deadline), exitCloseMinTimeout)))
+	}
+
+	log.Info(fmt.Sprintf("YDB topic output is stopped in %s: %d messages written, %d messages failed",
+		time.Since(started).Round(time.Millisecond), t.written.Load(), t.failed.Load()))
+
+	return err
+}
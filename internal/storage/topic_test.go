@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	ugorji "github.com/ugorji/go/codec"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+)
+
+func testTopic(cfg *config.Config, partitions int) *Topic {
+	t := &Topic{cfg: cfg, msgpack: &ugorji.MsgpackHandle{}}
+	for i := range partitions {
+		t.writers = append(t.writers, &topicWriter{partition: int64(i)})
+	}
+
+	return t
+}
+
+func testTopicEvent() *model.Event {
+	return &model.Event{
+		Timestamp: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		Metadata:  "app",
+		Seq:       7,
+		Message: map[string]interface{}{
+			"message": []byte("hello"),
+			"user":    "alice",
+			"kubernetes": map[interface{}]interface{}{
+				"pod": []byte("app-1"),
+			},
+		},
+	}
+}
+
+func TestTopicMessageFormats(t *testing.T) {
+	event := testTopicEvent()
+
+	m, _, err := testTopic(&config.Config{TopicFormat: config.TopicFormatJSON}, 1).message(event)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"message": "hello", "user": "alice", "kubernetes": {"pod": "app-1"}}`, string(m.data))
+	require.Equal(t, event.Timestamp, m.createdAt)
+	require.Equal(t, []byte("app"), m.metadata[topicMetadataTag])
+
+	m, _, err = testTopic(&config.Config{TopicFormat: config.TopicFormatMsgpack}, 1).message(event)
+	require.NoError(t, err)
+	var (
+		decoded map[string]interface{}
+		h       ugorji.MsgpackHandle
+	)
+	h.RawToString = true
+	require.NoError(t, ugorji.NewDecoderBytes(m.data, &h).Decode(&decoded))
+	require.Equal(t, "hello", decoded["message"])
+
+	m, _, err = testTopic(&config.Config{
+		TopicFormat: config.TopicFormatRow,
+		AgentID:     "host-1",
+		Columns: map[string]string{
+			config.KeyTimestamp: "timestamp",
+			config.KeyInput:     "input",
+			config.KeyAgentID:   "agent_id",
+			config.KeySeq:       "seq",
+			config.KeyOthers:    "others",
+			"message":           "msg",
+			"level":             "level",
+		},
+	}, 1).message(event)
+	require.NoError(t, err)
+	var row map[string]interface{}
+	require.NoError(t, json.Unmarshal(m.data, &row))
+	require.Equal(t, map[string]interface{}{
+		"timestamp": "2024-05-01T10:00:00Z",
+		"input":     "app",
+		"agent_id":  "host-1",
+		"seq":       float64(7),
+		"msg":       "hello",
+		"level":     nil,
+		"others":    map[string]interface{}{"user": "alice", "kubernetes": map[string]interface{}{"pod": "app-1"}},
+	}, row)
+}
+
+func TestTopicRowPseudoFields(t *testing.T) {
+	topic := testTopic(&config.Config{
+		TopicFormat: config.TopicFormatRow,
+		Columns: map[string]string{
+			config.KeyHash:       "hash",
+			config.KeyChunkIndex: "chunk_index",
+			config.KeyChunkCount: "chunk_count",
+			"message":            "msg",
+		},
+	}, 1)
+
+	event := testTopicEvent()
+	row, err := topic.row(event, event.Message)
+	require.NoError(t, err)
+	require.NotNil(t, row["hash"])
+	require.Equal(t, 0, row["chunk_index"])
+	require.Equal(t, 1, row["chunk_count"])
+
+	again, err := topic.row(event, event.Message)
+	require.NoError(t, err)
+	require.Equal(t, row["hash"], again["hash"])
+
+	event.Message["message"] = []byte("bye")
+	changed, err := topic.row(event, event.Message)
+	require.NoError(t, err)
+	require.NotEqual(t, row["hash"], changed["hash"])
+}
+
+func TestTopicMessageKey(t *testing.T) {
+	topic := testTopic(&config.Config{TopicFormat: config.TopicFormatJSON, TopicMessageKey: "user"}, 4)
+
+	partitions := make(map[int]bool)
+	for _, user := range []string{"alice", "bob", "carol", "dave", "eve", "frank"} {
+		event := testTopicEvent()
+		event.Message["user"] = []byte(user)
+
+		m, first, err := topic.message(event)
+		require.NoError(t, err)
+		require.Equal(t, []byte(user), m.metadata[topicMetadataKey])
+
+		_, second, err := topic.message(event)
+		require.NoError(t, err)
+		require.Equal(t, first, second)
+		partitions[first] = true
+	}
+	require.Greater(t, len(partitions), 1)
+}
+
+func TestTopicRetrySkipsWrittenPartitions(t *testing.T) {
+	topic := testTopic(&config.Config{TopicFormat: config.TopicFormatJSON}, 2)
+	events := []*model.Event{testTopicEvent()}
+	require.Nil(t, topic.retried(events))
+
+	topic.remember(events, &topicRetry{written: []bool{true, false}, seqNos: make([][]int64, 2)})
+	again := []*model.Event{testTopicEvent()}
+	require.NoError(t, topic.publish(again), "the messages of the written partition are not sent again")
+	require.Zero(t, topic.retries.len())
+
+	other := testTopicEvent()
+	other.Message["user"] = "bob"
+	retry := &topicRetry{written: []bool{true, false}, seqNos: [][]int64{nil, {5, 6}}}
+	topic.remember(events, retry)
+	require.Nil(t, topic.retried([]*model.Event{other}))
+	require.Equal(t, retry, topic.retried(events))
+}
+
+func TestTopicRetryReusesSeqNos(t *testing.T) {
+	w := &topicWriter{last: 4}
+	messages := []*topicMessage{{}, {}}
+	w.number(messages, nil)
+	require.Equal(t, []int64{5, 6}, []int64{messages[0].seqNo, messages[1].seqNo})
+
+	again := []*topicMessage{{}, {}}
+	w.number(again, []int64{5, 6})
+	require.Equal(t, []int64{5, 6}, []int64{again[0].seqNo, again[1].seqNo}, "the numbers of the failed flush are reused")
+	require.EqualValues(t, 6, w.last)
+
+	w.number([]*topicMessage{{}}, nil)
+	later := []*topicMessage{{}, {}}
+	w.number(later, []int64{5, 6})
+	require.Equal(t, []int64{8, 9}, []int64{later[0].seqNo, later[1].seqNo},
+		"the messages get the next numbers after the later ones are written, so YDB does not skip them")
+}
@@ -2,13 +2,14 @@ package storage
 
 import (
 	"context"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"path"
 	"reflect"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/surge/cityhash"
@@ -17,9 +18,11 @@ import (
 	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
 	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
 	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
 )
 
@@ -33,44 +36,231 @@ var (
 	} = (*YDB)(nil)
 )
 
+var (
+	// ErrNotReady is returned while the connection to YDB is being established in background.
+	ErrNotReady = fmt.Errorf("storage is not ready: %w", ErrRetryLater)
+	// ErrShuttingDown is returned for the writes which are not accepted or not completed on exit.
+	ErrShuttingDown = fmt.Errorf("storage is shutting down: %w", ErrRetryLater)
+)
+
 type YDB struct {
-	db           *ydb.Driver
-	cfg          *config.Config
-	fieldMapping map[string]options.Column // {fieldName : Column}
+	cfg         *config.Config
+	targets     []*target // the primary database first
+	active      atomic.Pointer[target]
+	failover    *failover
+	switchMu    sync.Mutex // serializes the switches between the targets
+	fallback    fallback
+	upsertSlots *semaphore.Weighted
+	batch       *batcher
+	mirror      *mirror
+	seq         *sequencer
+	oversized   *oversized
+	encoders    map[string]*columnEncoder // {columnName : encoder} of the compressed and encrypted columns
+	redactor    *redactor
+	pseudonyms  *pseudonymizer
+	query       *writeQuery // nil if the rows are written by BulkUpsert
+
+	ready         atomic.Bool
+	stopConnect   context.CancelFunc
+	connectorDone chan struct{}
+
+	ctx        context.Context // canceled when the writes are aborted on exit
+	abort      context.CancelFunc
+	writesMu   sync.Mutex
+	closing    bool
+	writes     sync.WaitGroup // flushes in progress
+	background sync.WaitGroup // failover and failback
+	stats      writeStats
+}
+
+// writeStats counts the rows by their outcome, for the summary logged on exit.
+type writeStats struct {
+	written atomic.Int64
+	stored  atomic.Int64 // passed to the fallback
+	failed  atomic.Int64 // returned to Fluent Bit with an error
 }
 
 func New(cfg *config.Config) (*YDB, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	ctx, abort := context.WithCancel(context.Background())
+	s := &YDB{
+		ctx:         ctx,
+		abort:       abort,
+		cfg:         cfg,
+		upsertSlots: sharedUpsertSlots(cfg.MaxConcurrentUpserts),
+		query:       newWriteQuery(cfg),
+		oversized:   newOversized(cfg.MaxValueBytes, cfg.OversizedPolicy),
+	}
 
-	opts := []ydb.Option{cfg.CredentialsOption}
-	if cfg.Certificates != "" {
-		_, err := os.Stat(cfg.Certificates)
-		if err == nil {
-			opts = append(opts, ydb.WithCertificatesFromFile(cfg.Certificates))
-		} else {
-			opts = append(opts, ydb.WithCertificatesFromPem([]byte(cfg.Certificates)))
+	encoders, err := newColumnEncoders(cfg)
+	if err != nil {
+		return s, err
+	}
+	s.encoders = encoders
+	if s.redactor, err = newRedactor(cfg.RedactionRules, cfg.TablePath); err != nil {
+		return s, err
+	}
+	if s.pseudonyms, err = newPseudonymizer(cfg.PseudonymizeColumns, cfg.PseudonymizationKeyFile); err != nil {
+		return s, err
+	}
+
+	// the primary and the secondary databases share the limits, as only one of them is written at a time
+	var (
+		sizer = newPortionSizer(cfg.PortionMaxBytes, cfg.PortionMaxRows)
+		th    = newThrottle(cfg.RateLimitRows, cfg.RateLimitBytes, cfg.TablePath)
+		br    = newBreaker(cfg.BreakerFailureThreshold, cfg.BreakerOpenTimeout, cfg.TablePath)
+	)
+	for _, endpoint := range cfg.Endpoints() {
+		t := newTarget(endpoint, cfg.TablePath)
+		t.sizer, t.throttle, t.breaker = sizer, th, br
+		t.active = metrics.NewGauge("fluentbit_ydb_active_target",
+			"Whether the rows are written to the database: 1 - active, 0 - standby.", "table", t.table, "target", t.name)
+		s.targets = append(s.targets, t)
+	}
+	if len(s.targets) > 1 {
+		s.failover = &failover{after: cfg.FailoverAfter}
+	}
+	if cfg.Mirror != nil {
+		s.mirror = newMirror(cfg)
+	}
+	if cfg.SequenceStatePath != "" {
+		seq, err := newSequencer(cfg.SequenceStatePath)
+		if err != nil {
+			return s, err
 		}
+		s.seq = seq
 	}
 
-	// Opening connection.
-	db, err := ydb.Open(ctx, cfg.ConnectionURL, opts...)
-	if err != nil {
-		return nil, err
+	if cfg.FallbackPath != "" {
+		f, err := newFileFallback(cfg.FallbackPath)
+		if err != nil {
+			return s, err
+		}
+		s.fallback = f
 	}
 
-	s := &YDB{
-		db:  db,
-		cfg: cfg,
+	if cfg.LazyInit {
+		s.connectInBackground(s.connect, backoff{base: initRetryBackoff, max: initRetryMaxBackoff})
+
+		return s, nil
 	}
 
-	if err := s.resolveFieldMapping(ctx); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.InitTimeout)
+	defer cancel()
+
+	if err := s.connect(ctx); err != nil {
 		return s, err
 	}
 
 	return s, nil
 }
 
+// connect opens the connection to the first available database, resolves the table schema
+// and makes the storage ready for writes.
+func (s *YDB) connect(ctx context.Context) (err error) {
+	var errs []error
+	for _, t := range s.targets {
+		if err = s.openTarget(ctx, t); err == nil {
+			s.activate(t)
+
+			break
+		}
+		if len(s.targets) > 1 {
+			err = fmt.Errorf("database '%s': %w", t.name, err)
+		}
+		errs = append(errs, err)
+	}
+	if s.target() == nil {
+		return errors.Join(errs...)
+	}
+	if t := s.target(); t != s.targets[0] {
+		log.Warn(fmt.Sprintf("primary database is not available, writing to '%s': %v", t.name, errors.Join(errs...)))
+	}
+
+	if s.cfg.CanaryWrite {
+		if err = s.canary(ctx, s.target()); err != nil {
+			return err
+		}
+	}
+	if s.cfg.HeartbeatTable != "" {
+		if err = s.describeHeartbeatTable(ctx, s.target().db); err != nil {
+			return err
+		}
+	}
+
+	if s.mirror != nil {
+		if err = s.mirror.connect(ctx, s); err != nil {
+			if s.cfg.MirrorPolicy == config.MirrorPolicyBoth {
+				return fmt.Errorf("mirror database '%s': %w", s.mirror.target.name, err)
+			}
+			log.Warn(fmt.Sprintf("mirror database '%s' is not available, the records are not mirrored until it is: %v",
+				s.mirror.target.name, err))
+		}
+	}
+
+	if s.cfg.BatchMaxRows > 0 || s.cfg.BatchMaxBytes > 0 || s.cfg.BatchMaxAge > 0 {
+		var spool *fileFallback
+		if s.cfg.BatchAck == config.BatchAckBuffer {
+			if spool, err = newFileFallback(s.cfg.BatchSpoolPath); err != nil {
+				return err
+			}
+		}
+		if s.batch, err = newBatcher(s.cfg.BatchMaxRows, s.cfg.BatchMaxBytes, s.cfg.BatchMaxAge, spool,
+			s.target, s.convertFor, s.writeRows); err != nil {
+			return err
+		}
+	}
+
+	if s.failover != nil {
+		s.background.Add(1)
+		go s.failbackLoop()
+	}
+	if s.cfg.HeartbeatTable != "" {
+		s.background.Add(1)
+		go s.heartbeatLoop()
+	}
+
+	s.ready.Store(true)
+
+	return nil
+}
+
+// connectInBackground keeps connecting to YDB with backoff until it succeeds or the storage is closed.
+func (s *YDB) connectInBackground(connect func(ctx context.Context) error, b backoff) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopConnect = cancel
+	s.connectorDone = make(chan struct{})
+
+	go func() {
+		defer close(s.connectorDone)
+
+		for attempt := 0; ; attempt++ {
+			attemptCtx, cancelAttempt := context.WithTimeout(ctx, s.cfg.InitTimeout)
+			err := connect(attemptCtx)
+			cancelAttempt()
+			if err == nil {
+				log.Info("connected to YDB, storage is ready")
+
+				return
+			}
+
+			delay := b.delay(attempt)
+			log.Warn(fmt.Sprintf("failed to connect to YDB (attempt %d), retrying in %s: %v", attempt+1, delay, err))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+}
+
+// Delays between the attempts to connect to YDB in background.
+const (
+	initRetryBackoff    = time.Second
+	initRetryMaxBackoff = time.Minute
+)
+
 const (
 	textType         = "Text"
 	bytesType        = "Bytes"
@@ -80,15 +270,19 @@ const (
 	uint64Type       = "Uint64"
 )
 
-func (s *YDB) resolveFieldMapping(ctx context.Context) error {
-	var columns map[string]options.Column
+// resolveFieldMapping builds the mapping snapshot from the table description.
+func (s *YDB) resolveFieldMapping(ctx context.Context, db *ydb.Driver, tablePath string) (*fieldMapping, error) {
+	var (
+		columns map[string]options.Column
+		storage tableStorage
+	)
 
 	// Getting table columns names and types.
-	if err := s.db.Table().Do(ctx,
+	if err := db.Table().Do(ctx,
 		func(ctx context.Context, session table.Session) (err error) {
-			desc, err := session.DescribeTable(ctx, path.Join(s.db.Name(), s.cfg.TablePath))
+			desc, err := session.DescribeTable(ctx, path.Join(db.Name(), tablePath))
 			if err != nil {
-				return fmt.Errorf("failed to describe table `%s`: %w", path.Join(s.db.Name(), s.cfg.TablePath), err)
+				return fmt.Errorf("failed to describe table `%s`: %w", path.Join(db.Name(), tablePath), err)
 			}
 
 			columns = make(map[string]options.Column, len(desc.Columns))
@@ -97,10 +291,16 @@ func (s *YDB) resolveFieldMapping(ctx context.Context) error {
 				columns[desc.Columns[i].Name] = desc.Columns[i]
 			}
 
-			return nil
+			storage = tableStorage{primaryKey: desc.PrimaryKey}
+			if s.cfg.SortRows == config.SortRowsOff {
+				return nil
+			}
+			storage, err = describeStorage(ctx, db, session.ID(), path.Join(db.Name(), tablePath))
+
+			return err
 		},
 	); err != nil {
-		return fmt.Errorf("failed to check columns names and types: %w", err)
+		return nil, fmt.Errorf("failed to check columns names and types: %w", err)
 	}
 
 	// Define log fields to columns mapping.
@@ -109,57 +309,97 @@ func (s *YDB) resolveFieldMapping(ctx context.Context) error {
 	for field, column := range s.cfg.Columns {
 		_, has := columns[column]
 		if !has {
-			return fmt.Errorf("not found column '%s' in destination table for field %s", column, field)
+			return nil, fmt.Errorf("not found column '%s' in destination table for field %s", column, field)
 		}
 		fieldToColumnMapping[field] = columns[column]
 	}
 
-	s.fieldMapping = fieldToColumnMapping
+	for column := range s.encoders {
+		if _, columnType := convertTypeIfOptional(columns[column].Type); yqlType(columnType) != bytesType {
+			return nil, fmt.Errorf("column '%s' has type %s, only %s columns may be compressed or encrypted",
+				column, columns[column].Type, bytesType)
+		}
+	}
+	for _, column := range s.cfg.PseudonymizeColumns {
+		switch _, columnType := convertTypeIfOptional(columns[column].Type); yqlType(columnType) {
+		case bytesType, textType, uint64Type:
+		default:
+			return nil, fmt.Errorf("column '%s' has type %s, only %s, %s and %s columns may be pseudonymized",
+				column, columns[column].Type, bytesType, textType, uint64Type)
+		}
+	}
 
-	return nil
-}
+	binary := make(map[string]bool, len(s.encoders))
+	for column := range s.encoders {
+		binary[column] = true
+	}
+	for _, column := range s.cfg.PseudonymizeColumns {
+		if _, columnType := convertTypeIfOptional(columns[column].Type); yqlType(columnType) == bytesType {
+			binary[column] = true
+		}
+	}
 
-const (
-	Sz8   = 8
-	Sz16  = 16
-	Sz32  = 32
-	Sz64  = 64
-	Sz30M = 30 * 1024 * 1024
-)
+	layout, err := newPayloadLayout(s.cfg.BulkUpsertFormat, fieldToColumnMapping, binary)
+	if err != nil {
+		return nil, err
+	}
+
+	mapped := make(map[string]bool, len(fieldToColumnMapping))
+	for _, column := range fieldToColumnMapping {
+		mapped[column.Name] = true
+	}
+
+	return &fieldMapping{
+		columns: fieldToColumnMapping,
+		layout:  layout,
+		sortKey: storage.sortKey(s.cfg.SortRows, mapped),
+		bounds:  storage.bounds,
+	}, nil
+}
 
 func null2Type(t types.Type, optional bool, columnTypeYql string) (types.Value, int, error) {
 	if optional {
 		switch columnTypeYql {
 		case timestampType:
-			return types.NullableTimestampValue(nil), Sz64, nil
+			return types.NullableTimestampValue(nil), nullValueSize, nil
 		case bytesType:
-			return types.NullableBytesValue(nil), Sz16, nil
+			return types.NullableBytesValue(nil), nullValueSize, nil
 		case textType:
-			return types.NullableTextValue(nil), Sz16, nil
+			return types.NullableTextValue(nil), nullValueSize, nil
 		case jsonType:
-			return types.NullableJSONValue(nil), Sz16, nil
+			return types.NullableJSONValue(nil), nullValueSize, nil
 		case jsonDocumentType:
-			return types.NullableJSONDocumentValue(nil), Sz16, nil
+			return types.NullableJSONDocumentValue(nil), nullValueSize, nil
 		}
 	} else {
 		switch columnTypeYql {
 		case timestampType:
-			return types.TimestampValueFromTime(time.UnixMicro(0)), Sz64, nil
+			return types.TimestampValueFromTime(time.UnixMicro(0)), fixed64ValueSize, nil
 		case bytesType:
-			return types.BytesValue(make([]byte, 0)), Sz16, nil
+			return types.BytesValue(make([]byte, 0)), bytesValueSize(0), nil
 		case textType:
-			return types.TextValue(""), Sz16, nil
+			return types.TextValue(""), bytesValueSize(0), nil
 		case jsonType:
-			return types.JSONValue("{}"), Sz32, nil
+			return types.JSONValue("{}"), bytesValueSize(len("{}")), nil
 		case jsonDocumentType:
-			return types.JSONDocumentValue("{}"), Sz32, nil
+			return types.JSONDocumentValue("{}"), bytesValueSize(len("{}")), nil
 		}
 	}
 
 	return nil, -1, fmt.Errorf("not supported conversion from NULL to '%s' (%s)", columnTypeYql, t)
 }
 
-func type2Type(t types.Type, v interface{}) (types.Value, int, error) { //nolint:funlen
+// bytesValue makes the Bytes value, compressed and encrypted if the column is configured so.
+func bytesValue(optional bool, enc *columnEncoder, v []byte) (types.Value, int, error) {
+	v, err := enc.encode(v)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return convertValueIfOptional(optional, types.BytesValue(v)), bytesValueSize(len(v)), nil
+}
+
+func type2Type(t types.Type, v interface{}, enc *columnEncoder) (types.Value, int, error) { //nolint:funlen
 	optional, columnType := convertTypeIfOptional(t)
 	columnTypeYql := yqlType(columnType)
 
@@ -171,36 +411,40 @@ func type2Type(t types.Type, v interface{}) (types.Value, int, error) { //nolint
 	case time.Time:
 		switch columnTypeYql {
 		case timestampType:
-			return convertValueIfOptional(optional, types.TimestampValueFromTime(v)), Sz32, nil
+			return convertValueIfOptional(optional, types.TimestampValueFromTime(v)), fixed64ValueSize, nil
 		default:
 			return nil, -1, fmt.Errorf("not supported conversion (time) from '%s' to '%s' (%s)", v, columnTypeYql, t)
 		}
 	case []byte:
 		switch columnTypeYql {
 		case bytesType:
-			return convertValueIfOptional(optional, types.BytesValue(v)), Sz8 + len(v), nil
+			return bytesValue(optional, enc, v)
 		case textType:
-			return convertValueIfOptional(optional, types.TextValue(string(v))), Sz8 + len(v), nil
+			return convertValueIfOptional(optional, types.TextValue(string(v))), bytesValueSize(len(v)), nil
 		case timestampType:
-			return convertTimestamp(optional, string(v)), Sz64, nil
+			return convertTimestamp(optional, string(v)), fixed64ValueSize, nil
 		default:
 			return nil, -1, fmt.Errorf("not supported conversion (bytes) from '%s' to '%s' (%s)", v, columnTypeYql, t)
 		}
 	case string:
 		switch columnTypeYql {
 		case bytesType:
-			return convertValueIfOptional(optional, types.BytesValueFromString(v)), Sz8 + len(v), nil
+			if enc != nil {
+				return bytesValue(optional, enc, []byte(v))
+			}
+
+			return convertValueIfOptional(optional, types.BytesValueFromString(v)), bytesValueSize(len(v)), nil
 		case textType:
-			return convertValueIfOptional(optional, types.TextValue(v)), Sz8 + len(v), nil
+			return convertValueIfOptional(optional, types.TextValue(v)), bytesValueSize(len(v)), nil
 		case timestampType:
-			return convertTimestamp(optional, v), Sz64, nil
+			return convertTimestamp(optional, v), fixed64ValueSize, nil
 		default:
 			return nil, -1, fmt.Errorf("not supported conversion (string) from '%s' to '%s' (%s)", v, columnTypeYql, t)
 		}
 	case uint64:
 		switch columnTypeYql {
 		case uint64Type:
-			return convertValueIfOptional(optional, types.Uint64Value(v)), Sz8 + Sz8, nil
+			return convertValueIfOptional(optional, types.Uint64Value(v)), fixed64ValueSize, nil
 		default:
 			return nil, -1, fmt.Errorf("not supported conversion (uint64) from '%v' to '%s' (%s)", v, columnTypeYql, t)
 		}
@@ -212,15 +456,15 @@ func type2Type(t types.Type, v interface{}) (types.Value, int, error) { //nolint
 
 		switch columnTypeYql {
 		case bytesType:
-			return convertValueIfOptional(optional, types.BytesValue(j)), Sz8 + len(j), nil
+			return bytesValue(optional, enc, j)
 		case textType:
-			return convertValueIfOptional(optional, types.TextValue(string(j))), Sz8 + len(j), nil
+			return convertValueIfOptional(optional, types.TextValue(string(j))), bytesValueSize(len(j)), nil
 		case jsonType:
-			return convertValueIfOptional(optional, types.JSONValue(string(j))), Sz8 + len(j), nil
+			return convertValueIfOptional(optional, types.JSONValue(string(j))), bytesValueSize(len(j)), nil
 		case jsonDocumentType:
-			return convertValueIfOptional(optional, types.JSONDocumentValue(string(j))), Sz8 + len(j), nil
+			return convertValueIfOptional(optional, types.JSONDocumentValue(string(j))), bytesValueSize(len(j)), nil
 		case timestampType:
-			return convertTimestamp(optional, string(j)), Sz64, nil
+			return convertTimestamp(optional, string(j)), fixed64ValueSize, nil
 		default:
 			return nil, -1, fmt.Errorf("not supported conversion (map) '%s' to '%s' (%s)", v, columnTypeYql, t)
 		}
@@ -229,49 +473,135 @@ func type2Type(t types.Type, v interface{}) (types.Value, int, error) { //nolint
 	}
 }
 
-func (s *YDB) BuildColumnUsageMap() map[string]bool {
-	m := make(map[string]bool)
-	for k := range s.fieldMapping {
-		if !strings.HasPrefix(k, ".") {
-			m[k] = true
+// rowBuilder collects the column values of a row: as the struct fields for the rows payload,
+// or as the cells of the payload layout for the Arrow and CSV payloads.
+type rowBuilder struct {
+	s       *YDB
+	layout  *payloadLayout // nil for the rows payload
+	sortKey map[string]int // nil if the rows are not ordered
+	bounds  [][]interface{}
+	columns int
+	fields  []types.StructValueOption
+	cells   []interface{}
+	key     []interface{}
+	bytes   int // serialized size of the row
+}
+
+func (b *rowBuilder) reset() {
+	b.bytes = 0
+	if b.layout == nil {
+		b.fields = make([]types.StructValueOption, 0, b.columns)
+	} else {
+		b.cells = make([]interface{}, len(b.layout.columns))
+	}
+	if b.sortKey != nil {
+		b.key = make([]interface{}, len(b.sortKey))
+	}
+}
+
+func (b *rowBuilder) add(column options.Column, v interface{}) error {
+	v = b.s.pseudonyms.pseudonymize(column, v)
+	enc := b.s.encoders[column.Name]
+
+	value, size, err := type2Type(column.Type, v, enc)
+	if err != nil {
+		return err
+	}
+	b.bytes += bytesValueSize(size)
+
+	i, keyed := b.sortKey[column.Name]
+	if b.layout == nil {
+		b.fields = append(b.fields, types.StructFieldValue(column.Name, value))
+		if !keyed {
+			return nil
+		}
+	}
+
+	cell, err := valueCell(value)
+	if err != nil {
+		return fmt.Errorf("failed to convert value of column '%s': %w", column.Name, err)
+	}
+	if keyed {
+		b.key[i] = cell
+	}
+	if b.layout != nil {
+		b.cells[b.layout.index[column.Name]] = cell
+	}
+
+	return nil
+}
+
+// valueCell returns the value of the rows payload as the cell of the Arrow and CSV payloads:
+// time.Time, []byte, string, uint64 or nil for NULL. The key of the row is made of the cells too,
+// so it is compared the same way for all the formats.
+func valueCell(v types.Value) (interface{}, error) {
+	var cell driver.Value
+	if err := types.CastTo(v, &cell); err != nil {
+		// Json values are cast to strings only
+		var s string
+		if err = types.CastTo(v, &s); err != nil {
+			return nil, err
 		}
+		cell = s
+	}
+	if t, ok := cell.(time.Time); ok {
+		return t.UTC(), nil
 	}
 
-	return m
+	return cell, nil
 }
 
-func (s *YDB) AppendColumnPlain(cref options.Column, in interface{}, rowbytes int, columns []types.StructValueOption) (
-	[]types.StructValueOption, int, error,
-) {
-	v, vlen, err := type2Type(cref.Type, in)
+func (b *rowBuilder) addField(mapping *fieldMapping, name string, v interface{}) error {
+	column, err := mapping.column(name)
 	if err != nil {
-		return columns, rowbytes, err
+		return err
 	}
 
-	columns = append(columns, types.StructFieldValue(cref.Name, v))
-	rowbytes += Sz64 + vlen + len(cref.Name)
-
-	return columns, rowbytes, nil
+	return b.add(column, v)
 }
 
-func (s *YDB) AppendColumn(name string, in interface{}, rowbytes int, columns []types.StructValueOption) (
-	[]types.StructValueOption, int, error,
-) {
-	cref, exists := s.fieldMapping[name]
-	if !exists {
-		return columns, rowbytes, errors.New("field does not exist: " + name)
+func (b *rowBuilder) row() row {
+	r := row{cells: b.cells, key: b.key}
+	if b.layout == nil {
+		r = row{value: types.StructValue(b.fields...), key: b.key}
+	}
+	if b.key != nil {
+		r.shard = shard(b.bounds, b.key)
 	}
 
-	return s.AppendColumnPlain(cref, in, rowbytes, columns)
+	return r
 }
 
-func (s *YDB) ConvertRows(events []*model.Event) ([]types.Value, int, error) { //nolint:funlen
-	rows := make([]types.Value, 0, len(events))
-	maxrowbytes := 1
-	colCount := len(s.fieldMapping)
+// ConvertRows converts the events to the rows of the active database table, and computes
+// the serialized size of each row.
+func (s *YDB) ConvertRows(events []*model.Event) ([]row, []int, error) {
+	return s.convertRows(s.target().mapping.load(), events)
+}
+
+// convertFor converts the events with the current field mapping of the target and returns the mapping.
+func (s *YDB) convertFor(t *target, events []*model.Event) (*fieldMapping, []row, []int, error) {
+	mapping := t.mapping.load()
+	rows, sizes, err := s.convertRows(mapping, events)
 
-	othersColumn, othersUsed := s.fieldMapping[config.KeyOthers]
-	hashColumn, hashUsed := s.fieldMapping[config.KeyHash]
+	return mapping, rows, sizes, err
+}
+
+func (s *YDB) convertRows(mapping *fieldMapping, events []*model.Event) ( //nolint:funlen
+	[]row, []int, error,
+) {
+	rows := make([]row, 0, len(events))
+	sizes := make([]int, 0, len(events))
+	b := rowBuilder{
+		s: s, layout: mapping.layout, sortKey: mapping.sortKey, bounds: mapping.bounds, columns: len(mapping.columns),
+	}
+
+	othersColumn, othersUsed := mapping.columns[config.KeyOthers]
+	hashColumn, hashUsed := mapping.columns[config.KeyHash]
+	agentIDColumn, agentIDUsed := mapping.columns[config.KeyAgentID]
+	seqColumn, seqUsed := mapping.columns[config.KeySeq]
+	chunkIndexColumn, chunkIndexUsed := mapping.columns[config.KeyChunkIndex]
+	chunkCountColumn, chunkCountUsed := mapping.columns[config.KeyChunkCount]
+	pseudonymKeyColumn, pseudonymKeyUsed := mapping.columns[config.KeyPseudonymKey]
 
 	var othersValue map[interface{}]interface{}
 	var hashValue map[interface{}]interface{}
@@ -284,22 +614,57 @@ func (s *YDB) ConvertRows(events []*model.Event) ([]types.Value, int, error) { /
 		if hashUsed {
 			hashValue = make(map[interface{}]interface{})
 		}
-		rowbytes := Sz64 + Sz64
-		columns := make([]types.StructValueOption, 0, colCount)
+		b.reset()
 
-		columns, rowbytes, err = s.AppendColumn(config.KeyTimestamp, event.Timestamp, rowbytes, columns)
+		message := event.Message
+		if s.redactor != nil {
+			// before the values get to the columns, .others and .hash
+			message = s.redactor.redact(message)
+		}
+
+		err = b.addField(mapping, config.KeyTimestamp, event.Timestamp)
 		if err != nil {
-			return nil, -1, err
+			return nil, nil, err
 		}
-		columns, rowbytes, err = s.AppendColumn(config.KeyInput, event.Metadata, rowbytes, columns)
+		err = b.addField(mapping, config.KeyInput, event.Metadata)
 		if err != nil {
-			return nil, -1, err
+			return nil, nil, err
+		}
+		if agentIDUsed {
+			err = b.add(agentIDColumn, s.cfg.AgentID)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if seqUsed {
+			err = b.add(seqColumn, event.Seq)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if chunkIndexUsed {
+			err = b.add(chunkIndexColumn, uint64(event.ChunkIndex))
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if chunkCountUsed {
+			err = b.add(chunkCountColumn, uint64(max(event.ChunkCount, 1)))
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if pseudonymKeyUsed {
+			err = b.add(pseudonymKeyColumn, s.pseudonyms.keyID)
+			if err != nil {
+				return nil, nil, err
+			}
 		}
 
-		columnUsageMap := s.BuildColumnUsageMap()
+		columnUsageMap := mapping.BuildColumnUsageMap()
 
-		for field, value := range event.Message {
-			column, exists := s.fieldMapping[field]
+		for field, value := range message {
+			column, exists := mapping.columns[field]
 			if !exists {
 				if othersUsed {
 					othersValue[field] = value
@@ -311,7 +676,7 @@ func (s *YDB) ConvertRows(events []*model.Event) ([]types.Value, int, error) { /
 				continue
 			}
 
-			columns, rowbytes, err = s.AppendColumnPlain(column, value, rowbytes, columns)
+			err = b.add(column, value)
 			if err != nil {
 				log.Warn(fmt.Sprintf("failed to convert column for message key: %s (value: %v), skipped. %v",
 					field, value, err))
@@ -328,89 +693,440 @@ func (s *YDB) ConvertRows(events []*model.Event) ([]types.Value, int, error) { /
 		if len(columnUsageMap) > 0 {
 			// some columns were not included
 			for cname := range columnUsageMap {
-				columns, rowbytes, err = s.AppendColumn(cname, nil, rowbytes, columns)
+				err = b.addField(mapping, cname, nil)
 				if err != nil {
 					// this error cannot be skipped
-					return nil, -1, err
+					return nil, nil, err
 				}
 			}
 		}
 
 		if othersUsed {
-			columns, rowbytes, err = s.AppendColumnPlain(othersColumn, othersValue, rowbytes, columns)
+			err = b.add(othersColumn, othersValue)
 			if err != nil {
-				return nil, -1, err
+				return nil, nil, err
 			}
 		}
 
 		if hashUsed {
 			j, err := json.Marshal(convertByteFieldsToString(hashValue))
 			if err != nil {
-				return nil, -1, fmt.Errorf("failed to marshal json value: %w. Value: %#v", err, hashValue)
+				return nil, nil, fmt.Errorf("failed to marshal json value: %w. Value: %#v", err, hashValue)
 			}
 			hashval := cityhash.CityHash64(j, uint32(len(j))) //nolint:gosec
-			columns, rowbytes, err = s.AppendColumnPlain(hashColumn, hashval, rowbytes, columns)
+			err = b.add(hashColumn, hashval)
 			if err != nil {
-				return nil, -1, err
+				return nil, nil, err
 			}
 		}
 
-		rows = append(rows, types.StructValue(columns...))
-		if rowbytes > maxrowbytes {
-			maxrowbytes = rowbytes
-		}
+		rows = append(rows, b.row())
+		sizes = append(sizes, b.bytes)
 	}
 
-	return rows, maxrowbytes, nil
+	return rows, sizes, nil
 }
 
 func (s *YDB) Write(events []*model.Event) error {
-	// convert the input events to the database rows
-	rows, maxrowbytes, err := s.ConvertRows(events)
+	if !s.ready.Load() {
+		return ErrNotReady
+	}
+
+	s.writesMu.Lock()
+	if s.closing {
+		s.writesMu.Unlock()
+
+		return ErrShuttingDown
+	}
+	s.writes.Add(1)
+	s.writesMu.Unlock()
+	defer s.writes.Done()
+
+	if s.seq == nil {
+		return s.write(events)
+	}
+
+	numbered, err := s.seq.assign(s.cfg.AgentID, events)
 	if err != nil {
 		return err
 	}
-	sz := len(events)
-	// split the rows into portions having size of no more than 30 megabytes
-	portion := Sz30M / maxrowbytes
-	if portion < 1 {
-		portion = 1
+	err = s.write(events)
+	s.seq.release(numbered, err)
+
+	return err
+}
+
+// write converts the events and writes them, or puts them into the batch.
+func (s *YDB) write(events []*model.Event) error {
+	if s.oversized != nil {
+		var rejected []*model.Event
+		if events, rejected = s.oversized.apply(events); len(rejected) > 0 {
+			s.reject(rejected)
+		}
+		if len(events) == 0 {
+			return nil
+		}
+	}
+
+	// convert the input events to the database rows of the active database, which receives the whole flush
+	t := s.target()
+	mapping, rows, sizes, err := s.convertFor(t, events)
+	if err != nil {
+		return err
 	}
-	if portion > sz {
-		portion = sz
+
+	if s.batch != nil {
+		return s.batch.add(t, mapping, events, rows, sizes)
 	}
+
+	return s.writeRows(t, mapping, events, rows, sizes)
+}
+
+// writeRows writes the rows converted with the mapping to the database and to the mirror, if it is configured.
+func (s *YDB) writeRows(t *target, mapping *fieldMapping, events []*model.Event, rows []row, sizes []int) error {
+	if s.mirror == nil {
+		return s.writePrimary(t, mapping, events, rows, sizes)
+	}
+
 	var (
-		position = 0
-		writes   = errgroup.Group{}
+		mirrorErr error
+		mirrored  = make(chan struct{})
 	)
-	for position < sz {
-		finish := position + portion
-		if finish > sz {
-			finish = sz
+	go func() {
+		defer close(mirrored)
+		mirrorErr = s.writeMirror(events)
+	}()
+
+	err := s.writePrimary(t, mapping, events, rows, sizes)
+	<-mirrored
+
+	result := s.mirror.result(err, mirrorErr)
+	if result != nil && (err == nil || mirrorErr == nil) && !errors.Is(result, errPartiallyWritten) {
+		// the events are written to one of the databases
+		result = fmt.Errorf("%w: %w", errPartiallyWritten, result)
+	}
+
+	return result
+}
+
+// writePrimary writes the rows converted with the mapping by portions, retrying the failed ones. The rows rejected
+// because of the changed table schema are converted again and rewritten after the mapping is refreshed.
+func (s *YDB) writePrimary(t *target, mapping *fieldMapping, events []*model.Event, rows []row, sizes []int) error {
+	failed := s.writePortions(t, events, rows, sizes)
+	if len(failed) > 0 && ydb.IsOperationErrorSchemeError(portionsError(failed)) {
+		log.Warn("Detected scheme error, trying to resolve field mapping from table description")
+		// the refresh is skipped if the mapping was already refreshed by another flush
+		failed = s.rewrite(t, mapping, failed)
+	}
+	written := len(events) - len(portionsEvents(failed))
+	s.stats.written.Add(int64(written))
+	if len(failed) == 0 {
+		return nil
+	}
+
+	err := portionsError(failed)
+	if s.fallback == nil && written > 0 && IsRetryable(err) {
+		log.Warn(fmt.Sprintf("%d events of the chunk are written, they will be written again when FluentBit retries the chunk",
+			written))
+	}
+
+	if err = s.handOff(failed, err); err != nil && written > 0 {
+		return fmt.Errorf("%w: %w", errPartiallyWritten, err)
+	}
+
+	return err
+}
+
+// rewrite refreshes the mapping of the target which failed the write, converts the events
+// of the failed portions with the new mapping and writes them again.
+func (s *YDB) rewrite(t *target, seen *fieldMapping, failed []*portion) []*portion {
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.InitTimeout)
+	defer cancel()
+
+	mapping, err := t.mapping.refresh(ctx, seen)
+	if err != nil {
+		return failedWith(failed, err)
+	}
+
+	events := portionsEvents(failed)
+	rows, sizes, err := s.convertRows(mapping, events)
+	if err != nil {
+		return failedWith(failed, err)
+	}
+
+	if failed = s.writePortions(t, events, rows, sizes); len(failed) == 0 {
+		log.Info(fmt.Sprintf("%d events were rewritten to '%s' after field mapping refresh", len(events), t.name))
+	}
+
+	return failed
+}
+
+// failedWith adds the error which prevented the rewrite to the errors of the portions.
+func failedWith(failed []*portion, err error) []*portion {
+	for _, p := range failed {
+		p.err = errors.Join(p.err, err)
+	}
+
+	return failed
+}
+
+// writePortions splits the rows into portions and writes them to the target with retries.
+// It returns the portions which are still not written.
+func (s *YDB) writePortions(t *target, events []*model.Event, rows []row, sizes []int) []*portion {
+	overhead := s.requestOverhead(t)
+	// the rows of a shard key range get to the same portions, so each request is written to a single shard
+	events, rows, sizes = sortRows(events, rows, sizes)
+	portions := t.sizer.split(events, rows, sizes, overhead)
+	if !t.breaker.allow() {
+		for _, p := range portions {
+			p.err = ErrCircuitOpen
 		}
-		part := rows[position:finish]
+		s.recordFailover(t, ErrCircuitOpen)
+
+		return portions
+	}
+
+	failed := s.upsertPortions(t, portions)
+	if len(failed) > 0 {
+		queue := retryQueue{
+			portions:    failed,
+			backoff:     backoff{base: s.cfg.RetryBackoff, max: s.cfg.RetryMaxBackoff},
+			maxAttempts: s.cfg.RetryMaxAttempts,
+		}
+		failed = queue.run(s.ctx, func(portions []*portion) []*portion {
+			if !t.breaker.allow() {
+				for _, p := range portions {
+					p.err = ErrCircuitOpen
+				}
+
+				return portions
+			}
+
+			return s.upsertPortions(t, t.sizer.resplit(portions, overhead))
+		})
+	}
+
+	return failed
+}
+
+// upsertPortions writes the portions concurrently and returns the ones which failed.
+func (s *YDB) upsertPortions(t *target, portions []*portion) (failed []*portion) {
+	var (
+		mu     sync.Mutex
+		writes errgroup.Group
+	)
+	if s.cfg.MaxConcurrentUpsertsPerFlush > 0 {
+		writes.SetLimit(s.cfg.MaxConcurrentUpsertsPerFlush)
+	}
+	for _, p := range portions {
 		writes.Go(func() error {
-			return s.db.Table().BulkUpsert(context.Background(),
-				path.Join(s.db.Name(), s.cfg.TablePath),
-				table.BulkUpsertDataRows(types.ListValue(part...)),
-			)
+			p.err = s.upsert(t, p)
+			if p.err != nil && s.ctx.Err() != nil {
+				p.err = ErrShuttingDown
+			}
+			t.breaker.record(p.err)
+			s.recordFailover(t, p.err)
+			switch {
+			case p.err == nil:
+				t.sizer.success()
+				t.throttle.succeeded()
+
+				return nil
+			case isOverloaded(p.err):
+				t.throttle.overloaded()
+			case isPortionTooLarge(p.err) && len(p.rows) > 1:
+				log.Warn(fmt.Sprintf("portion of %d rows (%d bytes) is too large, splitting: %v",
+					len(p.rows), p.bytes, p.err))
+				t.sizer.shrink(p)
+				p.err = fmt.Errorf("%w: %w", errPortionTooLarge, p.err)
+			}
+
+			mu.Lock()
+			failed = append(failed, p)
+			mu.Unlock()
+
+			return nil
 		})
-		position = finish
 	}
+	_ = writes.Wait()
 
-	err = writes.Wait()
-	if err != nil && ydb.IsOperationErrorSchemeError(err) {
-		log.Warn("Detected scheme error, trying to resolve field mapping from table description")
-		if resolveErr := s.resolveFieldMapping(context.Background()); resolveErr != nil {
-			return errors.Join(err, resolveErr)
+	return failed
+}
+
+// requestOverhead estimates the size of the BulkUpsert request without the rows.
+func (s *YDB) requestOverhead(t *target) int {
+	size := requestOverheadSize + len(t.db.Name()) + len(t.table)
+	for _, column := range t.mapping.load().columns {
+		size += columnTypeSize + len(column.Name)
+	}
+
+	return size
+}
+
+func (s *YDB) upsert(t *target, p *portion) error {
+	queueCtx, cancel := queueContext(s.ctx, s.cfg.UpsertQueueTimeout)
+	defer cancel()
+
+	if err := t.throttle.acquire(queueCtx, len(p.rows), p.bytes); err != nil {
+		return err
+	}
+
+	if err := t.quota.acquire(queueCtx, p); err != nil {
+		return err
+	}
+
+	release, err := acquireUpsertSlot(queueCtx, s.upsertSlots)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx := s.ctx
+	if s.cfg.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.WriteTimeout)
+		defer cancel()
+	}
+
+	return s.writeList(ctx, t, path.Join(t.db.Name(), t.table), t.mapping.load(), p.rows)
+}
+
+// handOff passes the portions which could not be written to the fallback, if it is configured.
+// Otherwise the write error is returned, so Fluent Bit decides whether to deliver the chunk again.
+func (s *YDB) handOff(failed []*portion, err error) error {
+	events := portionsEvents(failed)
+	if s.fallback == nil {
+		s.stats.failed.Add(int64(len(events)))
+
+		return err
+	}
+
+	if storeErr := s.fallback.Store(events); storeErr != nil {
+		s.stats.failed.Add(int64(len(events)))
+
+		return errors.Join(err, storeErr)
+	}
+	s.stats.stored.Add(int64(len(events)))
+
+	log.Warn(fmt.Sprintf("%d events were passed to the fallback after write failure: %v", len(events), err))
+
+	return nil
+}
+
+// Time given to the aborted writes to pass their rows to the fallback,
+// and the minimal time given to close the connection, when the exit deadline is exceeded.
+const (
+	exitAbortTimeout    = time.Second
+	exitCloseMinTimeout = time.Second
+)
+
+// Exit stops accepting the writes, drains the batched and in-flight rows within ExitTimeout,
+// aborts the writes which are still running after that, and closes the connection.
+func (s *YDB) Exit() error {
+	started := time.Now()
+	deadline := started.Add(s.cfg.ExitTimeout)
+
+	if s.stopConnect != nil {
+		s.stopConnect()
+		<-s.connectorDone
+	}
+
+	s.writesMu.Lock()
+	s.closing = true
+	s.writesMu.Unlock()
+
+	if !s.ready.Load() {
+		log.Info("YDB output is stopped before the connection was established")
+
+		return nil
+	}
+
+	var (
+		batchErr error
+		drained  = make(chan struct{})
+	)
+	go func() {
+		defer close(drained)
+		if s.batch != nil {
+			batchErr = s.batch.close()
+		}
+		s.writes.Wait()
+	}()
+
+	var err error
+	if !waitUntil(drained, deadline) {
+		log.Warn(fmt.Sprintf("writes are not completed within %s, aborting them", s.cfg.ExitTimeout))
+		s.abort()
+		if !waitUntil(drained, time.Now().Add(exitAbortTimeout)) {
+			err = errors.New("aborted writes are not completed")
+		}
+	}
+	if err == nil {
+		err = batchErr
+	}
+	s.abort()
+	s.background.Wait()
+
+	if s.batch != nil {
+		if n := s.batch.orphanCount(); n > 0 {
+			log.Warn(fmt.Sprintf("%d batch spool files are left to be written after restart", n))
 		}
 	}
 
+	// the last sequence numbers after the drain
+	if s.cfg.HeartbeatTable != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), max(time.Until(deadline), exitCloseMinTimeout))
+		if heartbeatErr := s.heartbeat(ctx); heartbeatErr != nil {
+			log.Warn(fmt.Sprintf("failed to write heartbeat: %v", heartbeatErr))
+		}
+		cancel()
+	}
+
+	targets := s.targets
+	if s.mirror != nil {
+		targets = append(targets[:len(targets):len(targets)], s.mirror.target)
+	}
+	for _, t := range targets {
+		if t.db != nil {
+			err = errors.Join(err, closeDriver(t.db, max(time.Until(deadline), exitCloseMinTimeout)))
+		}
+	}
+
+	log.Info(fmt.Sprintf("YDB output is stopped in %s: %d rows written, %d rows passed to the fallback, %d rows failed",
+		time.Since(started).Round(time.Millisecond), s.stats.written.Load(), s.stats.stored.Load(), s.stats.failed.Load()))
+
 	return err
 }
 
-func (s *YDB) Exit() error {
-	return s.db.Close(context.Background())
+// closeDriver closes the connection, without waiting for it longer than the timeout.
+func closeDriver(db *ydb.Driver, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- db.Close(ctx)
+	}()
+
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("failed to close connection within %s: %w", timeout, ctx.Err())
+	}
+}
+
+// waitUntil waits for the channel to be closed and reports whether it happened before the deadline.
+func waitUntil(done <-chan struct{}, deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
 }
 
 func yqlType(t types.Type) string {
@@ -467,12 +1183,22 @@ const (
 )
 
 func convertTimestamp(optional bool, v string) types.Value {
+	tv, ok := parseTimestamp(optional, v)
+	if !ok {
+		return types.NullValue(types.TypeTimestamp)
+	}
+
+	return convertValueIfOptional(optional, types.TimestampValueFromTime(tv))
+}
+
+// parseTimestamp parses the RFC 3339 timestamp. The invalid timestamps are NULL in the optional columns,
+// and the current time otherwise; ok is false for NULL.
+func parseTimestamp(optional bool, v string) (tv time.Time, ok bool) {
 	var err error
 	if len(v) >= LenTimestamp3339 {
-		var tv time.Time
 		tv, err = time.Parse(time.RFC3339, v)
 		if err == nil {
-			return convertValueIfOptional(optional, types.TimestampValueFromTime(tv))
+			return tv, true
 		}
 	}
 	if err == nil {
@@ -481,10 +1207,10 @@ func convertTimestamp(optional bool, v string) types.Value {
 		log.Warn(fmt.Sprintf("failed to parse value [%s] as timestamp - %s", v, err))
 	}
 	if optional {
-		return types.NullValue(types.TypeTimestamp)
+		return time.Time{}, false
 	}
 
-	return convertValueIfOptional(optional, types.TimestampValueFromTime(time.Now()))
+	return time.Now(), true
 }
 
 func pointer[T any](v T) *T {
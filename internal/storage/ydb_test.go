@@ -1,11 +1,23 @@
 package storage
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+
+	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
+	"github.com/ydb-platform/fluent-bit-ydb/pkg/codec"
+	"github.com/ydb-platform/fluent-bit-ydb/pkg/fieldcrypt"
 )
 
 func TestConvertJson(t *testing.T) {
@@ -114,10 +126,205 @@ func TestType2TypeOk(t *testing.T) {
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			actual, _, err := type2Type(tc.column, tc.value)
+			actual, _, err := type2Type(tc.column, tc.value, nil)
 
 			require.NoError(t, err)
 			require.Equal(t, tc.expected, actual)
 		})
 	}
 }
+
+func TestType2TypeEncoded(t *testing.T) {
+	compress, err := codec.NewEncoder(codec.Spec{Name: codec.Zstd}, true)
+	require.NoError(t, err)
+	keyring, err := fieldcrypt.ParseKeyring([]byte(`{"active": "k1", "keys": {"k1": "` +
+		base64.StdEncoding.EncodeToString(make([]byte, 32)) + `"}}`))
+	require.NoError(t, err)
+
+	message := strings.Repeat("request served in 15ms\n", 100)
+	for _, enc := range []*columnEncoder{
+		{codec: compress},
+		{keyring: keyring},
+		{codec: compress, keyring: keyring},
+	} {
+		for _, value := range []interface{}{message, []byte(message)} {
+			actual, size, err := type2Type(types.Optional(types.TypeBytes), value, enc)
+			require.NoError(t, err)
+
+			var encoded []byte
+			require.NoError(t, types.CastTo(actual, &encoded))
+			require.Equal(t, bytesValueSize(len(encoded)), size)
+			if enc.keyring != nil {
+				encoded, err = keyring.Decrypt(encoded)
+				require.NoError(t, err)
+			}
+			if enc.codec != nil {
+				require.Less(t, len(encoded), len(message)/4)
+				encoded, err = codec.Decode(encoded)
+				require.NoError(t, err)
+			}
+			require.Equal(t, message, string(encoded))
+		}
+	}
+}
+
+// testStorage returns the storage which is not connected to YDB.
+func testStorage(cfg *config.Config) *YDB {
+	ctx, abort := context.WithCancel(context.Background())
+
+	return &YDB{ctx: ctx, abort: abort, cfg: cfg}
+}
+
+func TestWriteNotReady(t *testing.T) {
+	s := testStorage(&config.Config{InitTimeout: time.Second})
+
+	err := s.Write([]*model.Event{{Timestamp: time.Now(), Metadata: "app"}})
+	require.ErrorIs(t, err, ErrNotReady)
+	// the flush is returned to Fluent Bit for retry
+	require.True(t, IsRetryable(err))
+}
+
+func TestConnectInBackground(t *testing.T) {
+	s := testStorage(&config.Config{InitTimeout: time.Second, ExitTimeout: time.Second})
+
+	var attempts atomic.Int32
+	s.connectInBackground(func(context.Context) error {
+		if attempts.Add(1) < 3 {
+			return errors.New("unavailable")
+		}
+		s.ready.Store(true)
+
+		return nil
+	}, backoff{base: time.Millisecond, max: time.Millisecond})
+
+	select {
+	case <-s.connectorDone:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "background connection is not finished")
+	}
+	require.Equal(t, int32(3), attempts.Load())
+	require.True(t, s.ready.Load())
+	require.NoError(t, s.Exit())
+}
+
+func TestConnectInBackgroundExit(t *testing.T) {
+	s := testStorage(&config.Config{InitTimeout: time.Second, ExitTimeout: time.Second})
+
+	var attempts atomic.Int32
+	s.connectInBackground(func(context.Context) error {
+		attempts.Add(1)
+
+		return errors.New("unavailable")
+	}, backoff{base: time.Hour, max: time.Hour})
+
+	require.Eventually(t, func() bool { return attempts.Load() == 1 }, 5*time.Second, time.Millisecond)
+
+	// exit stops the connector waiting for the next attempt
+	require.NoError(t, s.Exit())
+	require.False(t, s.ready.Load())
+	require.ErrorIs(t, s.Write(nil), ErrNotReady)
+}
+
+// testWritingStorage returns the ready storage which writes each flush by the function instead of YDB.
+func testWritingStorage(t *testing.T, cfg *config.Config,
+	write func(s *YDB, events []*model.Event) error,
+) *YDB {
+	t.Helper()
+
+	s := testStorage(cfg)
+	active := &target{}
+	active.mapping.store(testMapping("message"))
+	s.active.Store(active)
+
+	var err error
+	s.batch, err = newBatcher(1, 0, 0, nil, s.target, s.convertFor,
+		func(_ *target, _ *fieldMapping, events []*model.Event, _ []row, _ []int) error {
+			return write(s, events)
+		})
+	require.NoError(t, err)
+	s.ready.Store(true)
+
+	return s
+}
+
+func testEvents() []*model.Event {
+	return []*model.Event{{
+		Timestamp: time.Now(),
+		Metadata:  "app",
+		Message:   map[string]interface{}{"message": "started"},
+	}}
+}
+
+func TestExitDrain(t *testing.T) {
+	started := make(chan struct{})
+	s := testWritingStorage(t, &config.Config{ExitTimeout: 5 * time.Second},
+		func(s *YDB, events []*model.Event) error {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			s.stats.written.Add(int64(len(events)))
+
+			return nil
+		})
+
+	written := make(chan error, 1)
+	go func() { written <- s.Write(testEvents()) }()
+	<-started
+
+	// the in-flight write is completed before the exit
+	require.NoError(t, s.Exit())
+	require.NoError(t, <-written)
+	require.Equal(t, int64(1), s.stats.written.Load())
+
+	require.ErrorIs(t, s.Write(testEvents()), ErrShuttingDown)
+}
+
+// abortedWrite waits until the write is aborted and hands the events off.
+func abortedWrite(started chan struct{}) func(s *YDB, events []*model.Event) error {
+	return func(s *YDB, events []*model.Event) error {
+		close(started)
+		<-s.ctx.Done()
+
+		return s.handOff([]*portion{{events: events, err: ErrShuttingDown}}, ErrShuttingDown)
+	}
+}
+
+func TestExitAbort(t *testing.T) {
+	started := make(chan struct{})
+	s := testWritingStorage(t, &config.Config{ExitTimeout: 50 * time.Millisecond}, abortedWrite(started))
+
+	written := make(chan error, 1)
+	go func() { written <- s.Write(testEvents()) }()
+	<-started
+
+	exited := time.Now()
+	require.NoError(t, s.Exit())
+	require.Less(t, time.Since(exited), exitAbortTimeout)
+
+	// without the fallback the flush is returned to Fluent Bit
+	err := <-written
+	require.ErrorIs(t, err, ErrShuttingDown)
+	require.True(t, IsRetryable(err))
+	require.Equal(t, int64(1), s.stats.failed.Load())
+}
+
+func TestExitAbortFallback(t *testing.T) {
+	dir := t.TempDir()
+	started := make(chan struct{})
+	s := testWritingStorage(t, &config.Config{ExitTimeout: 50 * time.Millisecond}, abortedWrite(started))
+	var err error
+	s.fallback, err = newFileFallback(dir)
+	require.NoError(t, err)
+
+	written := make(chan error, 1)
+	go func() { written <- s.Write(testEvents()) }()
+	<-started
+
+	require.NoError(t, s.Exit())
+
+	// the aborted rows are passed to the fallback, so the flush succeeds
+	require.NoError(t, <-written)
+	require.Equal(t, int64(1), s.stats.stored.Load())
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/ydb-platform/fluent-bit-ydb/internal/config"
 	"github.com/ydb-platform/fluent-bit-ydb/internal/log"
+	"github.com/ydb-platform/fluent-bit-ydb/internal/metrics"
 	"github.com/ydb-platform/fluent-bit-ydb/internal/model"
 	"github.com/ydb-platform/fluent-bit-ydb/internal/storage"
 )
@@ -30,7 +31,20 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 
 	log.SetLevel(cfg.LogLevel)
 
-	s, err := storage.New(&cfg)
+	if cfg.MetricsListen != "" {
+		if err := metrics.Serve(cfg.MetricsListen); err != nil {
+			log.Error(fmt.Sprintf("failed serve metrics: %v", err))
+
+			return output.FLB_ERROR
+		}
+	}
+
+	var s interface{}
+	if cfg.Sink == config.SinkTopic {
+		s, err = storage.NewTopic(&cfg)
+	} else {
+		s, err = storage.New(&cfg)
+	}
 	if err != nil {
 		log.Error(fmt.Sprintf("failed create new storage: %v", err))
 
@@ -103,6 +117,10 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	if err != nil {
 		log.Error(fmt.Sprintf("write events failed: %v", err))
 
+		if storage.IsRetryable(err) {
+			return output.FLB_RETRY
+		}
+
 		return output.FLB_ERROR
 	}
 
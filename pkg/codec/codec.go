@@ -0,0 +1,237 @@
+// Package codec compresses the values written to the Bytes columns and decompresses them back.
+//
+// The values are compressed with zstd, gzip, lz4 (frame format) or snappy (block format).
+// When the magic prefix is enabled, the compressed value starts with Magic followed by the codec ID,
+// so Decode can decompress it without knowing the codec configured for the column.
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Name identifies the compression algorithm.
+type Name string
+
+const (
+	None   Name = "none"
+	Zstd   Name = "zstd"
+	Gzip   Name = "gzip"
+	LZ4    Name = "lz4"
+	Snappy Name = "snappy"
+)
+
+// Magic starts the self-describing values, it is followed by the codec ID byte.
+var Magic = []byte{0xfb, 'Y', 'C'}
+
+// IDs of the codecs in the magic prefix.
+var ids = map[Name]byte{
+	Zstd:   1,
+	Gzip:   2,
+	LZ4:    3,
+	Snappy: 4,
+}
+
+var (
+	ErrUnknownCodec = errors.New("unknown codec")
+	ErrNoPrefix     = errors.New("value has no codec prefix")
+)
+
+// Spec is the codec of a column with its compression level. The zero level means the default one.
+type Spec struct {
+	Name  Name
+	Level int
+}
+
+func (s Spec) String() string {
+	if s.Level == 0 {
+		return string(s.Name)
+	}
+
+	return string(s.Name) + ":" + strconv.Itoa(s.Level)
+}
+
+// ParseSpec parses the 'codec' or 'codec:level' string, for example 'zstd:3'.
+func ParseSpec(value string) (Spec, error) {
+	name, level, hasLevel := strings.Cut(strings.TrimSpace(value), ":")
+	spec := Spec{Name: Name(strings.ToLower(strings.TrimSpace(name)))}
+	if hasLevel {
+		l, err := strconv.Atoi(strings.TrimSpace(level))
+		if err != nil {
+			return Spec{}, fmt.Errorf("level of codec '%s' must be an integer, got '%s'", spec.Name, level)
+		}
+		spec.Level = l
+	}
+
+	var lo, hi int
+	switch spec.Name {
+	case Zstd:
+		lo, hi = 1, 22
+	case Gzip:
+		lo, hi = gzip.BestSpeed, gzip.BestCompression
+	case LZ4:
+		lo, hi = 1, 9
+	case Snappy, None:
+		// no levels
+	default:
+		return Spec{}, fmt.Errorf("%w '%s', must be one of '%s', '%s', '%s' or '%s'",
+			ErrUnknownCodec, spec.Name, Zstd, Gzip, LZ4, Snappy)
+	}
+	if spec.Level != 0 && (spec.Level < lo || spec.Level > hi) {
+		if hi == 0 {
+			return Spec{}, fmt.Errorf("codec '%s' has no compression levels", spec.Name)
+		}
+
+		return Spec{}, fmt.Errorf("level of codec '%s' must be from %d to %d, got %d", spec.Name, lo, hi, spec.Level)
+	}
+
+	return spec, nil
+}
+
+// Encoder compresses the values with one codec. It is safe for concurrent use.
+type Encoder struct {
+	spec   Spec
+	prefix bool
+
+	zstd *zstd.Encoder
+	pool sync.Pool // of the gzip and lz4 writers
+}
+
+// NewEncoder creates the encoder of the codec, the values start with the magic prefix if prefix is set.
+func NewEncoder(spec Spec, prefix bool) (*Encoder, error) {
+	e := &Encoder{spec: spec, prefix: prefix}
+	switch spec.Name {
+	case Zstd:
+		level := zstd.SpeedDefault
+		if spec.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(spec.Level)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		e.zstd = enc
+	case Gzip:
+		level := gzip.DefaultCompression
+		if spec.Level != 0 {
+			level = spec.Level
+		}
+		e.pool.New = func() interface{} {
+			w, _ := gzip.NewWriterLevel(nil, level)
+
+			return w
+		}
+	case LZ4:
+		level := lz4.Fast
+		if spec.Level != 0 {
+			level = lz4.CompressionLevel(1 << (8 + spec.Level - 1))
+		}
+		e.pool.New = func() interface{} {
+			w := lz4.NewWriter(nil)
+			_ = w.Apply(lz4.CompressionLevelOption(level), lz4.ConcurrencyOption(1))
+
+			return w
+		}
+	case Snappy:
+	default:
+		return nil, fmt.Errorf("%w '%s'", ErrUnknownCodec, spec.Name)
+	}
+
+	return e, nil
+}
+
+// Spec returns the codec of the encoder.
+func (e *Encoder) Spec() Spec {
+	return e.spec
+}
+
+// Encode returns the compressed value.
+func (e *Encoder) Encode(src []byte) ([]byte, error) {
+	var dst []byte
+	if e.prefix {
+		dst = make([]byte, 0, len(Magic)+1+len(src)/2)
+		dst = append(append(dst, Magic...), ids[e.spec.Name])
+	}
+
+	switch e.spec.Name {
+	case Zstd:
+		return e.zstd.EncodeAll(src, dst), nil
+	case Snappy:
+		return append(dst, snappy.Encode(nil, src)...), nil
+	}
+
+	buf := bytes.NewBuffer(dst)
+	w, _ := e.pool.Get().(interface {
+		io.WriteCloser
+		Reset(io.Writer)
+	})
+	defer e.pool.Put(w)
+
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// zstd decoder is safe for concurrent DecodeAll calls, so one is shared by all callers.
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+})
+
+// Decode decompresses the value having the magic prefix.
+func Decode(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, Magic) || len(data) == len(Magic) {
+		return nil, ErrNoPrefix
+	}
+	id := data[len(Magic)]
+	for name, nameID := range ids {
+		if nameID == id {
+			return DecodeWith(name, data[len(Magic)+1:])
+		}
+	}
+
+	return nil, fmt.Errorf("%w with ID %d", ErrUnknownCodec, id)
+}
+
+// DecodeWith decompresses the value having no magic prefix with the codec.
+func DecodeWith(name Name, data []byte) ([]byte, error) {
+	switch name {
+	case None:
+		return data, nil
+	case Zstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+
+		return dec.DecodeAll(data, nil)
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		return io.ReadAll(r)
+	case LZ4:
+		return io.ReadAll(lz4.NewReader(bytes.NewReader(data)))
+	case Snappy:
+		return snappy.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("%w '%s'", ErrUnknownCodec, name)
+	}
+}
@@ -0,0 +1,81 @@
+package codec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	value := []byte(strings.Repeat("2024-05-01T10:00:00Z INFO request served in 15ms\n", 100))
+
+	for _, spec := range []Spec{
+		{Name: Zstd}, {Name: Zstd, Level: 19},
+		{Name: Gzip}, {Name: Gzip, Level: 9},
+		{Name: LZ4}, {Name: LZ4, Level: 9},
+		{Name: Snappy},
+	} {
+		t.Run(spec.String(), func(t *testing.T) {
+			for _, prefix := range []bool{false, true} {
+				e, err := NewEncoder(spec, prefix)
+				require.NoError(t, err)
+
+				// the pooled writers are reused
+				for range 2 {
+					encoded, err := e.Encode(value)
+					require.NoError(t, err)
+					require.Less(t, len(encoded), len(value)/4)
+					require.Equal(t, prefix, bytes.HasPrefix(encoded, Magic))
+
+					var decoded []byte
+					if prefix {
+						decoded, err = Decode(encoded)
+					} else {
+						decoded, err = DecodeWith(spec.Name, encoded)
+					}
+					require.NoError(t, err)
+					require.Equal(t, value, decoded)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeNoPrefix(t *testing.T) {
+	_, err := Decode([]byte("plain value"))
+	require.ErrorIs(t, err, ErrNoPrefix)
+
+	_, err = Decode(append(append([]byte{}, Magic...), 42))
+	require.ErrorIs(t, err, ErrUnknownCodec)
+}
+
+func TestParseSpec(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		spec  Spec
+		err   bool
+	}{
+		{value: "zstd", spec: Spec{Name: Zstd}},
+		{value: " ZSTD:3 ", spec: Spec{Name: Zstd, Level: 3}},
+		{value: "gzip:9", spec: Spec{Name: Gzip, Level: 9}},
+		{value: "lz4:1", spec: Spec{Name: LZ4, Level: 1}},
+		{value: "snappy", spec: Spec{Name: Snappy}},
+		{value: "gzip:10", err: true},
+		{value: "snappy:1", err: true},
+		{value: "zstd:fast", err: true},
+		{value: "brotli", err: true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			spec, err := ParseSpec(tc.value)
+			if tc.err {
+				require.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.spec, spec)
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// Package fieldcrypt encrypts the values written to the Bytes columns and decrypts them back.
+//
+// Each value is encrypted with its own random AES-256-GCM data key, and the data key is encrypted
+// (wrapped) with the AES-GCM master key from the key file. The encrypted value has the header:
+//
+//	Magic | version | key ID length | key ID | wrapped data key | nonce | ciphertext with tag
+//
+// The key ID names the master key, so the values encrypted before the key rotation are still
+// decrypted with the previous keys kept in the key file.
+package fieldcrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Magic starts the encrypted values.
+var Magic = []byte{0xfb, 'Y', 'E'}
+
+const (
+	version     = 1
+	dataKeySize = 32
+	nonceSize   = 12
+	tagSize     = 16
+	wrappedSize = nonceSize + dataKeySize + tagSize
+)
+
+var (
+	ErrNotEncrypted = errors.New("value is not encrypted")
+	ErrUnknownKey   = errors.New("unknown key")
+	ErrMalformed    = errors.New("malformed encrypted value")
+)
+
+// Keyring holds the master keys by their IDs, and the ID of the key encrypting the new values.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// keyFile is the format of the key file:
+//
+//	{"active": "2024-05", "keys": {"2024-01": "<base64 key>", "2024-05": "<base64 key>"}}
+type keyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// LoadKeyring reads the key file.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file '%s': %w", path, err)
+	}
+
+	k, err := ParseKeyring(data)
+	if err != nil {
+		return nil, fmt.Errorf("key file '%s': %w", path, err)
+	}
+
+	return k, nil
+}
+
+// ParseKeyring parses the content of the key file. The keys are base64 encoded, 16, 24 or 32 bytes long.
+// The active key may be omitted if only decryption is needed.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON: %w", err)
+	}
+
+	k := &Keyring{active: f.Active, keys: make(map[string]cipher.AEAD, len(f.Keys))}
+	for id, encoded := range f.Keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("key ID must be from 1 to 255 bytes long, got '%s'", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key '%s' is not base64 encoded: %w", id, err)
+		}
+		if k.keys[id], err = newAEAD(key); err != nil {
+			return nil, fmt.Errorf("key '%s': %w", id, err)
+		}
+	}
+	if _, has := k.keys[f.Active]; f.Active != "" && !has {
+		return nil, fmt.Errorf("%w '%s' is active", ErrUnknownKey, f.Active)
+	}
+
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Active returns the ID of the key encrypting the new values.
+func (k *Keyring) Active() string {
+	return k.active
+}
+
+// Encrypt encrypts the value with a new data key wrapped by the active key.
+func (k *Keyring) Encrypt(plaintext []byte) ([]byte, error) {
+	master, has := k.keys[k.active]
+	if !has {
+		return nil, fmt.Errorf("%w: no active key", ErrUnknownKey)
+	}
+
+	random := make([]byte, dataKeySize+2*nonceSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	dataKey, wrapNonce, nonce := random[:dataKeySize], random[dataKeySize:dataKeySize+nonceSize],
+		random[dataKeySize+nonceSize:]
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(Magic)+2+len(k.active)+wrappedSize+nonceSize+len(plaintext)+tagSize)
+	out = append(out, Magic...)
+	out = append(out, version, byte(len(k.active)))
+	out = append(out, k.active...)
+	header := out
+
+	// the header is authenticated along with the keys, so the key ID cannot be replaced
+	out = append(out, wrapNonce...)
+	out = master.Seal(out, wrapNonce, dataKey, header)
+	out = append(out, nonce...)
+
+	return data.Seal(out, nonce, plaintext, header), nil
+}
+
+// KeyID returns the ID of the master key the value is encrypted with.
+func KeyID(value []byte) (string, error) {
+	id, _, err := parseHeader(value)
+
+	return id, err
+}
+
+func parseHeader(value []byte) (id string, headerSize int, _ error) {
+	if !bytes.HasPrefix(value, Magic) {
+		return "", 0, ErrNotEncrypted
+	}
+	if len(value) < len(Magic)+2 || value[len(Magic)] != version {
+		return "", 0, ErrMalformed
+	}
+	idSize := int(value[len(Magic)+1])
+	headerSize = len(Magic) + 2 + idSize
+	if len(value) < headerSize+wrappedSize+nonceSize+tagSize {
+		return "", 0, ErrMalformed
+	}
+
+	return string(value[len(Magic)+2 : headerSize]), headerSize, nil
+}
+
+// Decrypt decrypts the value with the master key named in its header.
+func (k *Keyring) Decrypt(value []byte) ([]byte, error) {
+	id, headerSize, err := parseHeader(value)
+	if err != nil {
+		return nil, err
+	}
+	master, has := k.keys[id]
+	if !has {
+		return nil, fmt.Errorf("%w '%s'", ErrUnknownKey, id)
+	}
+
+	header, rest := value[:headerSize], value[headerSize:]
+	dataKey, err := master.Open(nil, rest[:nonceSize], rest[nonceSize:wrappedSize], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rest = rest[wrappedSize:]
+	plaintext, err := data.Open(nil, rest[:nonceSize], rest[nonceSize:], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %w", err)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,108 @@
+package fieldcrypt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyFile(active string, ids ...string) []byte {
+	keys := make([]string, 0, len(ids))
+	for i, id := range ids {
+		key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat(fmt.Sprint(i), 32)))
+		keys = append(keys, fmt.Sprintf("%q: %q", id, key))
+	}
+
+	return []byte(fmt.Sprintf(`{"active": %q, "keys": {%s}}`, active, strings.Join(keys, ",")))
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	k, err := ParseKeyring(testKeyFile("k1", "k1"))
+	require.NoError(t, err)
+
+	value := []byte("user@example.com")
+	encrypted, err := k.Encrypt(value)
+	require.NoError(t, err)
+	require.NotContains(t, string(encrypted), string(value))
+
+	again, err := k.Encrypt(value)
+	require.NoError(t, err)
+	require.NotEqual(t, encrypted, again)
+
+	id, err := KeyID(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "k1", id)
+
+	decrypted, err := k.Decrypt(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, value, decrypted)
+
+	empty, err := k.Encrypt(nil)
+	require.NoError(t, err)
+	decrypted, err = k.Decrypt(empty)
+	require.NoError(t, err)
+	require.Empty(t, decrypted)
+}
+
+func TestKeyRotation(t *testing.T) {
+	before, err := ParseKeyring(testKeyFile("k1", "k1"))
+	require.NoError(t, err)
+	old, err := before.Encrypt([]byte("old"))
+	require.NoError(t, err)
+
+	after, err := ParseKeyring(testKeyFile("k2", "k1", "k2"))
+	require.NoError(t, err)
+	fresh, err := after.Encrypt([]byte("new"))
+	require.NoError(t, err)
+
+	id, err := KeyID(fresh)
+	require.NoError(t, err)
+	require.Equal(t, "k2", id)
+
+	decrypted, err := after.Decrypt(old)
+	require.NoError(t, err)
+	require.Equal(t, "old", string(decrypted))
+
+	_, err = before.Decrypt(fresh)
+	require.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestDecryptTampered(t *testing.T) {
+	k, err := ParseKeyring(testKeyFile("k1", "k1", "k2"))
+	require.NoError(t, err)
+	encrypted, err := k.Encrypt([]byte("payment-42"))
+	require.NoError(t, err)
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = k.Decrypt(tampered)
+	require.Error(t, err)
+
+	// the key ID is authenticated
+	replaced := append([]byte{}, encrypted...)
+	replaced[len(Magic)+3] = '2'
+	_, err = k.Decrypt(replaced)
+	require.Error(t, err)
+
+	_, err = k.Decrypt([]byte("plain value"))
+	require.ErrorIs(t, err, ErrNotEncrypted)
+
+	_, err = k.Decrypt(encrypted[:len(encrypted)-tagSize-nonceSize])
+	require.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestParseKeyring(t *testing.T) {
+	_, err := ParseKeyring(testKeyFile("k3", "k1", "k2"))
+	require.ErrorIs(t, err, ErrUnknownKey)
+
+	_, err = ParseKeyring([]byte(`{"active": "k1", "keys": {"k1": "c2hvcnQ="}}`))
+	require.Error(t, err)
+
+	k, err := ParseKeyring(testKeyFile("", "k1"))
+	require.NoError(t, err)
+	_, err = k.Encrypt([]byte("value"))
+	require.ErrorIs(t, err, ErrUnknownKey)
+}